@@ -24,6 +24,10 @@ const (
 	ratePosition        time.Duration = (3 * time.Hour) + (26 * time.Second)
 	rateNeighborInfo    time.Duration = (12 * time.Hour) + (31 * time.Second)
 	rateInactiveCleanup time.Duration = 24 * time.Hour
+	rateWaypointCleanup time.Duration = 15 * time.Minute
+	ratePositionPrune   time.Duration = 6 * time.Hour
+	rateChannelTopic    time.Duration = 30 * time.Minute
+	rateAliasPrune      time.Duration = 24 * time.Hour
 )
 
 func init() {
@@ -183,6 +187,110 @@ func (c *MeshtasticConnector) RunInactiveCleanupTask(ctx context.Context) {
 	}()
 }
 
+// RunWaypointCleanupTask starts the background task for removing expired waypoints, removing waypoints
+// of inactive nodes, and warning Matrix users about their waypoints that will expire soon
+func (c *MeshtasticConnector) RunWaypointCleanupTask(ctx context.Context) {
+	c.log.Info().Msg("Starting waypoint cleanup task")
+
+	go func() {
+		c.cleanupWaypoints(ctx)
+
+		ticker := time.NewTicker(rateWaypointCleanup)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				c.log.Info().Msg("Stopping waypoint cleanup task")
+				return
+			case <-ticker.C:
+				c.cleanupWaypoints(ctx)
+			}
+		}
+	}()
+}
+
+// RunPositionPruneTask starts the background task for applying the position history retention limits
+func (c *MeshtasticConnector) RunPositionPruneTask(ctx context.Context) {
+	if !c.Config.PositionHistory.Enabled {
+		return
+	}
+
+	go func() {
+		c.prunePositions(ctx)
+
+		ticker := time.NewTicker(ratePositionPrune)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				c.log.Info().Msg("Stopping position prune task")
+				return
+			case <-ticker.C:
+				c.prunePositions(ctx)
+			}
+		}
+	}()
+}
+
+// RunMessageAliasPruneTask starts the background task for removing the aliases of old split messages
+func (c *MeshtasticConnector) RunMessageAliasPruneTask(ctx context.Context) {
+	go func() {
+		c.pruneMessageAliases(ctx)
+
+		ticker := time.NewTicker(rateAliasPrune)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				c.log.Info().Msg("Stopping message alias prune task")
+				return
+			case <-ticker.C:
+				c.pruneMessageAliases(ctx)
+			}
+		}
+	}()
+}
+
+// cleanupWaypoints removes expired waypoints and those of inactive nodes, and sends expiry warnings
+func (c *MeshtasticConnector) cleanupWaypoints(ctx context.Context) {
+	cfg := c.Config.Waypoints
+	now := time.Now()
+
+	expired, err := c.meshDB.Waypoint.GetExpired(ctx, now)
+	if err != nil {
+		c.log.Err(err).Msg("Failed to get expired waypoints")
+	}
+	for _, w := range expired {
+		c.expireWaypoint(ctx, w, "Waypoint expired")
+	}
+
+	if cfg.InactiveAuthorDays > 0 {
+		threshold := now.Add(-time.Duration(cfg.InactiveAuthorDays) * 24 * time.Hour)
+		inactive, err := c.meshDB.Waypoint.GetByInactiveAuthors(ctx, threshold)
+		if err != nil {
+			c.log.Err(err).Msg("Failed to get waypoints of inactive nodes")
+		}
+		for _, w := range inactive {
+			if !c.IsManagedNode(w.UpdatedBy) {
+				c.expireWaypoint(ctx, w, "Waypoint author is inactive")
+			}
+		}
+	}
+
+	if cfg.ExpiryWarningHours > 0 {
+		expiring, err := c.meshDB.Waypoint.GetUnwarnedExpiring(ctx, now.Add(time.Duration(cfg.ExpiryWarningHours)*time.Hour))
+		if err != nil {
+			c.log.Err(err).Msg("Failed to get expiring waypoints")
+		}
+		for _, w := range expiring {
+			c.warnWaypointExpiry(ctx, w)
+		}
+	}
+}
+
 // cleanupInactiveNodes removes inactive ghosts from all channel portals
 func (c *MeshtasticConnector) cleanupInactiveNodes(ctx context.Context) {
 	threshold := time.Now().Add(-time.Duration(c.Config.InactivityThreshold) * 24 * time.Hour)
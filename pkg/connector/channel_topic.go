@@ -0,0 +1,159 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kabili207/matrix-meshtastic/pkg/mesh"
+	"github.com/kabili207/matrix-meshtastic/pkg/meshid"
+	"go.mau.fi/util/ptr"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/bridgev2/simplevent"
+	"maunium.net/go/mautrix/id"
+)
+
+// Nodes heard on a channel within this window are counted as active, like the apps count online nodes
+const activeNodeWindow = 2 * time.Hour
+
+// channelActivity keeps track of when each node was last heard on each channel. It's only kept in
+// memory, so the counts start over when the bridge restarts
+type channelActivity struct {
+	lastHeard map[string]map[meshid.NodeID]time.Time
+	started   time.Time
+	lock      sync.Mutex
+}
+
+// isComplete checks if activity has been tracked for a whole window, so the counts can be trusted
+func (a *channelActivity) isComplete() bool {
+	return time.Since(a.started) >= activeNodeWindow
+}
+
+func (a *channelActivity) record(chanDef meshid.ChannelDef, nodeID meshid.NodeID) {
+	key := channelConfigKey(chanDef)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.lastHeard[key] == nil {
+		a.lastHeard[key] = map[meshid.NodeID]time.Time{}
+	}
+	a.lastHeard[key][nodeID] = time.Now()
+}
+
+// activeNodes counts the nodes heard on a channel recently, forgetting the ones that weren't
+func (a *channelActivity) activeNodes(chanDef meshid.ChannelDef) int {
+	key := channelConfigKey(chanDef)
+	cutoff := time.Now().Add(-activeNodeWindow)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for nodeID, heard := range a.lastHeard[key] {
+		if heard.Before(cutoff) {
+			delete(a.lastHeard[key], nodeID)
+		}
+	}
+	return len(a.lastHeard[key])
+}
+
+// recordChannelActivity notes that the sender of an event was heard on a channel
+func (c *MeshtasticConnector) recordChannelActivity(rawEvt any) {
+	base, ok := rawEvt.(interface{ Base() *mesh.MeshEvent })
+	if !ok {
+		return
+	}
+	evt := base.Base()
+	if evt.ChannelName == "" || evt.ChannelName == "PKI" || evt.ChannelKey == nil {
+		return
+	}
+	if chanDef, err := meshid.NewChannelDef(evt.ChannelName, evt.ChannelKey); err == nil {
+		c.channelActivity.record(chanDef, evt.From)
+	}
+}
+
+// channelTopic creates the topic of a channel portal. The key itself is only included when
+// show_channel_keys is enabled, as room topics are visible to anyone who can see the room
+func (c *MeshtasticConnector) channelTopic(ctx context.Context, portalKey networkid.PortalKey, chanDef meshid.ChannelDef) string {
+	var parts []string
+	if len(chanDef.GetKeyBytes()) == 0 {
+		parts = append(parts, "⚠️ Unencrypted, anyone in range can read messages sent here")
+	} else if c.Config.ShowChannelKeys {
+		parts = append(parts, fmt.Sprintf("🔑 Key %s (fingerprint %s)", chanDef.GetKeyString(), meshid.KeyFingerprint(chanDef.GetKeyBytes())))
+	} else {
+		parts = append(parts, fmt.Sprintf("🔑 Key fingerprint %s", meshid.KeyFingerprint(chanDef.GetKeyBytes())))
+	}
+	parts = append(parts, fmt.Sprintf("Hash %d", mesh.ChannelHash(chanDef)))
+	if c.meshClient != nil {
+		if preset, ok := c.meshClient.ModemPreset(); ok {
+			parts = append(parts, mesh.PresetName(preset))
+		}
+	}
+	// Left out until a whole window has been observed, rather than showing every channel as idle after a restart
+	if c.channelActivity.isComplete() {
+		parts = append(parts, fmt.Sprintf("%d active nodes", c.channelActivity.activeNodes(chanDef)))
+	}
+	if logins, err := c.bridge.GetUserLoginsInPortal(ctx, portalKey); err != nil {
+		c.log.Err(err).Str("portal_id", string(portalKey.ID)).Msg("Failed to get user logins in portal")
+	} else {
+		users := map[id.UserID]struct{}{}
+		for _, l := range logins {
+			users[l.UserMXID] = struct{}{}
+		}
+		parts = append(parts, fmt.Sprintf("%d Matrix users", len(users)))
+	}
+	return strings.Join(parts, " | ")
+}
+
+// updateChannelTopics refreshes the topics of all channel portals whose topic changed
+func (c *MeshtasticConnector) updateChannelTopics(ctx context.Context) {
+	portals, err := c.bridge.GetAllPortalsWithMXID(ctx)
+	if err != nil {
+		c.log.Err(err).Msg("Failed to get portals to update channel topics")
+		return
+	}
+	for _, p := range portals {
+		if p.RoomType == database.RoomTypeDM {
+			continue
+		}
+		chanDef, err := meshid.ChannelDefFromPortalID(p.ID)
+		if err != nil {
+			continue
+		}
+		topic := c.channelTopic(ctx, p.PortalKey, chanDef)
+		if topic == p.Topic {
+			continue
+		}
+		logins, err := c.bridge.GetUserLoginsInPortal(ctx, p.PortalKey)
+		if err != nil || len(logins) == 0 {
+			continue
+		}
+		logins[0].QueueRemoteEvent(&simplevent.ChatInfoChange{
+			EventMeta: simplevent.EventMeta{
+				Type:      bridgev2.RemoteEventChatInfoChange,
+				PortalKey: p.PortalKey,
+				Timestamp: time.Now(),
+			},
+			ChatInfoChange: &bridgev2.ChatInfoChange{
+				ChatInfo: &bridgev2.ChatInfo{Topic: ptr.Ptr(topic)},
+			},
+		})
+	}
+}
+
+// RunChannelTopicTask starts the background task that keeps the counts in channel portal topics up to date
+func (c *MeshtasticConnector) RunChannelTopicTask(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(rateChannelTopic)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				c.updateChannelTopics(ctx)
+			}
+		}
+	}()
+}
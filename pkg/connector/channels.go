@@ -0,0 +1,206 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/kabili207/matrix-meshtastic/pkg/meshid"
+	"go.mau.fi/util/ptr"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/bridgev2/simplevent"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var errDownlinkDisabled = errors.New("sending to this channel from Matrix is disabled")
+
+// channelConfigKey identifies a channel in the channels config. Keys are normalized first,
+// as the same key can be written in several ways
+func channelConfigKey(chanDef meshid.ChannelDef) string {
+	return chanDef.GetName() + "/" + chanDef.GetKeyString()
+}
+
+// loadConfiguredChannels starts listening to the channels listed in the config
+func (c *MeshtasticConnector) loadConfiguredChannels() {
+	c.channelConfigs = make(map[string]*BridgedChannel, len(c.Config.Channels))
+	for i := range c.Config.Channels {
+		cfg := &c.Config.Channels[i]
+		// Keys were checked in ValidateConfig
+		chanDef, _ := meshid.NewChannelDef(cfg.Name, &cfg.Key)
+		c.channelConfigs[channelConfigKey(chanDef)] = cfg
+		if err := c.meshClient.AddChannelDef(chanDef); err != nil {
+			c.log.Err(err).Str("channel", cfg.Name).Msg("Failed to add configured channel")
+		}
+	}
+}
+
+// getChannelConfig returns the config of a channel, or nil if it isn't listed in the config
+func (c *MeshtasticConnector) getChannelConfig(chanDef meshid.ChannelDef) *BridgedChannel {
+	return c.channelConfigs[channelConfigKey(chanDef)]
+}
+
+// isUplinkEnabled checks if packets received on a channel should be bridged to Matrix
+func (c *MeshtasticConnector) isUplinkEnabled(channelName string, channelKey *string) bool {
+	chanDef, err := meshid.NewChannelDef(channelName, channelKey)
+	if err != nil {
+		return true
+	}
+	cfg := c.getChannelConfig(chanDef)
+	return cfg == nil || cfg.UplinkEnabled()
+}
+
+// checkUnencryptedSender checks if a node may send to a channel. In licensed mode, only licensed
+// operators can send to unencrypted channels
+func (c *MeshtasticConnector) checkUnencryptedSender(ctx context.Context, chanDef meshid.ChannelDef, nodeID meshid.NodeID) error {
+	if !c.Config.LicensedMode || len(chanDef.GetKeyBytes()) > 0 {
+		return nil
+	}
+	nodeInfo, err := c.meshDB.MeshNodeInfo.GetByNodeID(ctx, nodeID)
+	if err != nil {
+		return err
+	} else if nodeInfo == nil || !nodeInfo.IsLicensed {
+		return errors.New("only licensed amateur radio operators can send to unencrypted channels")
+	}
+	return nil
+}
+
+// joinConfiguredChannels adds the login to the portals of the configured channels that
+// have auto_create_portal set, creating them if needed
+func (mc *MeshtasticClient) joinConfiguredChannels(ctx context.Context) {
+	for _, cfg := range mc.main.Config.Channels {
+		if !cfg.AutoCreatePortal {
+			continue
+		}
+		chanDef, _ := meshid.NewChannelDef(cfg.Name, &cfg.Key)
+		if err := mc.joinChannel(chanDef.GetName(), chanDef.GetKeyString()); err != nil {
+			mc.log.Err(err).Str("channel", cfg.Name).Msg("Failed to join configured channel")
+			continue
+		}
+		if cfg.Space == "" {
+			continue
+		}
+		portal, err := mc.bridge.GetExistingPortalByKey(ctx, mc.makePortalKey(chanDef.GetName(), ptr.Ptr(chanDef.GetKeyString())))
+		if err != nil || portal == nil || portal.MXID == "" {
+			continue
+		}
+		if err = mc.main.addPortalToSpace(ctx, portal, cfg.Space); err != nil {
+			mc.log.Err(err).Str("channel", cfg.Name).Stringer("space_id", cfg.Space).Msg("Failed to add portal to space")
+		}
+	}
+}
+
+// addPortalToSpace adds a portal to a space that isn't managed by the bridge. The bridge bot
+// needs permission to send state events in the space
+func (c *MeshtasticConnector) addPortalToSpace(ctx context.Context, portal *bridgev2.Portal, spaceID id.RoomID) error {
+	_, err := c.bridge.Bot.SendState(ctx, spaceID, event.StateSpaceChild, portal.MXID.String(), &event.Content{
+		Parsed: &event.SpaceChildEventContent{
+			Via: []string{c.bridge.Matrix.ServerName()},
+		},
+	}, time.Time{})
+	return err
+}
+
+func sameChannel(a, b meshid.ChannelDef) bool {
+	return a.GetName() == b.GetName() && a.GetKeyString() == b.GetKeyString()
+}
+
+// isChannelInUse checks if a portal other than the given one belongs to a channel, which is
+// possible when portals are split between users
+func (c *MeshtasticConnector) isChannelInUse(ctx context.Context, portalID networkid.PortalID, except networkid.PortalKey) (bool, error) {
+	portals, err := c.bridge.GetAllPortalsWithMXID(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, p := range portals {
+		if p.ID == portalID && p.PortalKey != except {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// releaseChannel stops listening to a channel once no portal needs it anymore
+func (c *MeshtasticConnector) releaseChannel(ctx context.Context, chanDef meshid.ChannelDef, portalKey networkid.PortalKey) error {
+	if primary := c.meshClient.GetPrimaryChannel(); primary != nil && sameChannel(primary, chanDef) {
+		return nil
+	} else if c.getChannelConfig(chanDef) != nil {
+		return nil
+	}
+	inUse, err := c.isChannelInUse(ctx, portalKey.ID, portalKey)
+	if err != nil || inUse {
+		return err
+	}
+	return c.meshClient.RemoveChannelDef(chanDef)
+}
+
+// leaveChannel removes the logins of a user from a channel portal. Once no other logins are left,
+// bridgev2 deletes the portal and the bridge stops listening to the channel
+func (c *MeshtasticConnector) leaveChannel(ctx context.Context, user *bridgev2.User, portal *bridgev2.Portal, chanDef meshid.ChannelDef) error {
+	logins, err := c.bridge.GetUserLoginsInPortal(ctx, portal.PortalKey)
+	if err != nil {
+		return err
+	}
+	var ownLogins []*bridgev2.UserLogin
+	othersRemain := false
+	for _, l := range logins {
+		if l.UserMXID == user.MXID {
+			ownLogins = append(ownLogins, l)
+		} else {
+			othersRemain = true
+		}
+	}
+	if len(ownLogins) == 0 {
+		return errors.New("you haven't joined this channel")
+	}
+	if !othersRemain {
+		if err = c.releaseChannel(ctx, chanDef, portal.PortalKey); err != nil {
+			return err
+		}
+	}
+	for _, l := range ownLogins {
+		l.QueueRemoteEvent(&simplevent.ChatDelete{
+			EventMeta: simplevent.EventMeta{
+				Type:      bridgev2.RemoteEventChatDelete,
+				PortalKey: portal.PortalKey,
+				Timestamp: time.Now(),
+			},
+			OnlyForMe: true,
+		})
+	}
+	return nil
+}
+
+// rekeyChannel moves a channel portal and its history to a new key
+func (c *MeshtasticClient) rekeyChannel(ctx context.Context, portal *bridgev2.Portal, oldDef meshid.ChannelDef, newKey string) (meshid.ChannelDef, error) {
+	newDef, err := meshid.NewChannelDef(oldDef.GetName(), &newKey)
+	if err != nil {
+		return nil, err
+	} else if sameChannel(oldDef, newDef) {
+		return nil, errors.New("the channel already uses that key")
+	} else if primary := c.MeshClient.GetPrimaryChannel(); primary != nil && sameChannel(primary, oldDef) {
+		return nil, errors.New("the primary channel is set in the bridge config")
+	} else if c.main.getChannelConfig(oldDef) != nil {
+		return nil, errors.New("the channel is listed in the bridge config")
+	}
+
+	oldKey := portal.PortalKey
+	newPortalKey := oldKey
+	newPortalKey.ID = meshid.MakePortalID(newDef.GetName(), ptr.Ptr(newDef.GetKeyString()))
+	if err = c.MeshClient.AddChannelDef(newDef); err != nil {
+		return nil, err
+	}
+	_, newPortal, err := c.bridge.ReIDPortal(ctx, oldKey, newPortalKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to move portal to the new key: %w", err)
+	}
+	if err = c.main.releaseChannel(ctx, oldDef, oldKey); err != nil {
+		c.log.Err(err).Str("channel", oldDef.GetName()).Msg("Failed to stop listening to the old channel key")
+	}
+	if newPortal != nil {
+		newPortal.UpdateInfo(ctx, c.wrapChatInfo(nil, newDef.GetName(), newDef.GetKeyString()), c.UserLogin, nil, time.Now())
+	}
+	return newDef, nil
+}
@@ -22,7 +22,7 @@ func (mc *MeshtasticConnector) FillPortalBridgeInfo(portal *bridgev2.Portal, con
 
 func (mc *MeshtasticClient) wrapDMInfo(synthNode, remoteNode meshid.NodeID) *bridgev2.ChatInfo {
 	info := &bridgev2.ChatInfo{
-		Topic: ptr.Ptr(fmt.Sprintf("Meshtastic node %s", remoteNode)),
+		Topic: ptr.Ptr(mc.main.dmTopic(context.Background(), synthNode, remoteNode)),
 		Members: &bridgev2.ChatMemberList{
 			IsFull:           true,
 			TotalMemberCount: 2,
@@ -41,7 +41,7 @@ func (mc *MeshtasticClient) wrapDMInfo(synthNode, remoteNode meshid.NodeID) *bri
 	return info
 }
 
-func (c MeshtasticConnector) setDMNames(info *bridgev2.ChatInfo, ghost *bridgev2.Ghost) {
+func (c *MeshtasticConnector) setDMNames(info *bridgev2.ChatInfo, ghost *bridgev2.Ghost) {
 	if ghost.Name != "" {
 		info.Name = &ghost.Name
 		if nodeID, err := meshid.ParseUserID(ghost.ID); err != nil {
@@ -55,7 +55,7 @@ func (c MeshtasticConnector) setDMNames(info *bridgev2.ChatInfo, ghost *bridgev2
 func (mc *MeshtasticClient) wrapChatInfo(user *bridgev2.User, channelID, channelKey string) *bridgev2.ChatInfo {
 	members := map[networkid.UserID]bridgev2.ChatMember{}
 	if user != nil {
-		nodeID := meshid.MXIDToNodeID(user.MXID)
+		nodeID := mc.senderNodeID(context.Background(), user.MXID)
 		members[meshid.MakeUserID(nodeID)] = bridgev2.ChatMember{
 			EventSender: bridgev2.EventSender{
 				Sender:      meshid.MakeUserID(nodeID),
@@ -64,15 +64,17 @@ func (mc *MeshtasticClient) wrapChatInfo(user *bridgev2.User, channelID, channel
 		}
 	}
 
-	topic := "⚠️ Unencrypted"
+	var topic *string
+	if chanDef, err := meshid.NewChannelDef(channelID, &channelKey); err == nil {
+		topic = ptr.Ptr(mc.main.channelTopic(context.Background(), mc.makePortalKey(channelID, &channelKey), chanDef))
+	}
 	if channelKey == "" {
-		topic = fmt.Sprintf("Shared Key: %s", channelKey)
 		channelID = fmt.Sprintf("%s 🔓", channelID)
 	}
 
 	info := &bridgev2.ChatInfo{
 		Name:  &channelID,
-		Topic: &topic,
+		Topic: topic,
 		Type:  ptr.Ptr(database.RoomTypeDefault),
 		Members: &bridgev2.ChatMemberList{
 			IsFull:    false,
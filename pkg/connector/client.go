@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sync"
 
 	"github.com/kabili207/matrix-meshtastic/pkg/mesh"
 	"github.com/kabili207/matrix-meshtastic/pkg/meshid"
@@ -21,13 +22,16 @@ type MeshtasticClient struct {
 	main       *MeshtasticConnector
 	UserLogin  *bridgev2.UserLogin
 	MeshClient *mesh.MeshtasticClient
+
+	splitLocks     map[string]*sync.Mutex
+	splitLocksLock sync.Mutex
 }
 
 var _ bridgev2.NetworkAPI = (*MeshtasticClient)(nil)
 var _ bridgev2.IdentifierResolvingNetworkAPI = (*MeshtasticClient)(nil)
 
 func (mc *MeshtasticClient) Connect(ctx context.Context) {
-	nodeID := meshid.MXIDToNodeID(mc.UserLogin.UserMXID)
+	nodeID := mc.UserLogin.Metadata.(*meshid.UserLoginMetadata).NodeID
 	nodeInfo, err := mc.main.meshDB.MeshNodeInfo.GetByNodeID(ctx, nodeID)
 	if err != nil {
 		mc.UserLogin.BridgeState.Send(status.BridgeState{
@@ -81,6 +85,7 @@ func (mc *MeshtasticClient) Connect(ctx context.Context) {
 		}
 	}
 	mc.MeshClient.AddEventHandler(mc.handleMeshEvent)
+	mc.joinConfiguredChannels(ctx)
 }
 
 func (mc *MeshtasticClient) Disconnect() {
@@ -170,7 +175,7 @@ func (c *MeshtasticClient) ResolveIdentifier(ctx context.Context, identifier str
 	if err != nil {
 		return nil, fmt.Errorf("failed to get ghost: %w", err)
 	}
-	myNode := meshid.MXIDToNodeID(c.UserLogin.UserMXID)
+	myNode := c.UserLogin.Metadata.(*meshid.UserLoginMetadata).NodeID
 
 	return &bridgev2.ResolveIdentifierResponse{
 		Ghost:  ghost,
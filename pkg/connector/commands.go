@@ -1,14 +1,22 @@
 package connector
 
 import (
+	"bytes"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/kabili207/matrix-meshtastic/pkg/mesh"
 	"github.com/kabili207/matrix-meshtastic/pkg/meshid"
+	"github.com/skip2/go-qrcode"
+	"go.mau.fi/util/ptr"
+	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/bridgev2/commands"
 	"maunium.net/go/mautrix/bridgev2/matrix"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
 
@@ -22,13 +30,70 @@ var cmdJoinChannel = &commands.FullHandler{
 	Name: "join-channel",
 	Help: commands.HelpMeta{
 		Section:     HelpSectionChannels,
-		Description: "Joins a Meshtastic channel with the supplied encryption key",
+		Description: "Joins a Meshtastic channel with the supplied encryption key. Use `AA==` as the key for unencrypted channels",
 		Args:        "<_channel name_> <_channel key_>",
 	},
 	RequiresLogin:  true,
 	RequiresPortal: false,
 }
 
+var cmdJoinURL = &commands.FullHandler{
+	Func: fnJoinURL,
+	Name: "join-url",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionChannels,
+		Description: "Joins every channel in a Meshtastic channel URL",
+		Args:        "<_URL_>",
+	},
+	RequiresLogin:  true,
+	RequiresPortal: false,
+}
+
+var cmdChannelURL = &commands.FullHandler{
+	Func: fnChannelURL,
+	Name: "channel-url",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionChannels,
+		Description: "Sends you the Meshtastic URL and QR code for the channel of the current portal",
+	},
+	RequiresLogin:  true,
+	RequiresPortal: true,
+}
+
+var cmdLeaveChannel = &commands.FullHandler{
+	Func: fnLeaveChannel,
+	Name: "leave-channel",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionChannels,
+		Description: "Leaves the Meshtastic channel of the current portal",
+	},
+	RequiresLogin:  true,
+	RequiresPortal: true,
+}
+
+var cmdChannels = &commands.FullHandler{
+	Func: fnChannels,
+	Name: "channels",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionChannels,
+		Description: "Lists the Meshtastic channels the bridge is listening to",
+	},
+	RequiresLogin:  true,
+	RequiresPortal: false,
+}
+
+var cmdRekeyChannel = &commands.FullHandler{
+	Func: fnRekeyChannel,
+	Name: "rekey-channel",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionChannels,
+		Description: "Moves the current portal and its history to a new channel key",
+		Args:        "<_channel key_>",
+	},
+	RequiresLogin:  true,
+	RequiresPortal: true,
+}
+
 var cmdUpdateNames = &commands.FullHandler{
 	Func: fnUpdateNames,
 	Name: "update-names",
@@ -66,6 +131,169 @@ var cmdTraceroute = &commands.FullHandler{
 	RequiresPortal: false,
 }
 
+var cmdRangeTest = &commands.FullHandler{
+	Func:    fnRangeTest,
+	Name:    "range-test",
+	Aliases: []string{"rt"},
+	Help: commands.HelpMeta{
+		Section:     HelpSectionNode,
+		Description: "Starts or stops sending range test packets, or shows the results received on a channel",
+		Args:        "<start|stop|summary|export> <_channel name_> [_interval_]",
+	},
+	RequiresLogin:  true,
+	RequiresPortal: false,
+}
+
+var cmdPortalSetting = &commands.FullHandler{
+	Func: fnPortalSetting,
+	Name: "portal-setting",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionChannels,
+		Description: "Shows or changes a setting for the current portal",
+		Args:        "[_setting_] [_value_]",
+	},
+	RequiresLogin:      true,
+	RequiresPortal:     true,
+	RequiresEventLevel: event.StatePowerLevels,
+}
+
+var cmdTrustKey = &commands.FullHandler{
+	Func: fnTrustKey,
+	Name: "trust-key",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionNode,
+		Description: "Trusts the new public key of a Meshtastic node after a key change (bridge admins only), or shows its key history",
+		Args:        "<_node ID_>",
+	},
+	RequiresLogin:  true,
+	RequiresPortal: false,
+}
+
+var cmdVerify = &commands.FullHandler{
+	Func: fnVerify,
+	Name: "verify",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionNode,
+		Description: "Verifies the public key of a Meshtastic node using the key verification exchange",
+		Args:        "[_node ID_] | number <_number_> | confirm | cancel",
+	},
+	RequiresLogin:  true,
+	RequiresPortal: false,
+}
+
+var cmdExportIdentity = &commands.FullHandler{
+	Func: fnExportIdentity,
+	Name: "export-identity",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionNode,
+		Description: "Sends you the node ID and keys of your Meshtastic node, so they can be used on another device",
+		Args:        "[base64|meshtastic]",
+	},
+	RequiresLogin: true,
+}
+
+var cmdImportKeyPair = &commands.FullHandler{
+	Func: fnImportKeyPair,
+	Name: "import-keypair",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionNode,
+		Description: "Replaces the keys of your Meshtastic node with an existing private key",
+		Args:        "<_private key_>",
+	},
+	RequiresLogin: true,
+}
+
+var cmdIdentity = &commands.FullHandler{
+	Func: fnIdentity,
+	Name: "identity",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionNode,
+		Description: "Lists your Meshtastic identities, or chooses which one speaks in the current portal",
+		Args:        "[_node ID_]",
+	},
+	RequiresLogin: true,
+}
+
+var cmdLicensed = &commands.FullHandler{
+	Func: fnLicensed,
+	Name: "licensed",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionNode,
+		Description: "Shows or sets the amateur radio callsign of your node. Licensed nodes identify with their callsign and never send encrypted packets",
+		Args:        "[_callsign_ | off]",
+	},
+	RequiresLogin: true,
+}
+
+var cmdDMEncryption = &commands.FullHandler{
+	Func: fnDMEncryption,
+	Name: "dm-encryption",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionNode,
+		Description: "Shows or sets how your direct messages are encrypted when the recipient's public key isn't known",
+		Args:        "[require_pki | prefer_pki | allow_psk | default]",
+	},
+	RequiresLogin: true,
+}
+
+var cmdMaxPositionPrecision = &commands.FullHandler{
+	Func: fnMaxPositionPrecision,
+	Name: "max-position-precision",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionNode,
+		Description: "Shows or sets the most bits of precision locations you send may have, where 32 is exact",
+		Args:        "[_0-32_ | default]",
+	},
+	RequiresLogin: true,
+}
+
+var cmdRotateKEK = &commands.FullHandler{
+	Func: fnRotateKEK,
+	Name: "rotate-kek",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAdmin,
+		Description: "Re-encrypts the private keys of managed nodes with the current key-encryption key",
+	},
+	RequiresAdmin: true,
+}
+
+var cmdTrack = &commands.FullHandler{
+	Func: fnTrack,
+	Name: "track",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionNode,
+		Description: "Summarizes the positions reported by a Meshtastic node and attaches its path as a GPX file",
+		Args:        "<_node ID_> [_since_]",
+	},
+	RequiresLogin:  true,
+	RequiresPortal: false,
+}
+
+var cmdShareLocation = &commands.FullHandler{
+	Func: fnShareLocation,
+	Name: "share-location",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionNode,
+		Description: "Shows or changes whether the positions of a Meshtastic node are bridged to portals that have locations turned on",
+		Args:        "<_node ID_> [on|off]",
+	},
+	RequiresLogin:  true,
+	RequiresPortal: false,
+}
+
+var cmdWaypoint = &commands.FullHandler{
+	Func:    fnWaypoint,
+	Name:    "waypoint",
+	Aliases: []string{"wp"},
+	Help: commands.HelpMeta{
+		Section:     HelpSectionChannels,
+		Description: "Creates, edits, deletes, locks or lists your waypoints on the current channel",
+		Args:        "<add|edit|delete|lock|unlock|list> [_arguments_]",
+	},
+	RequiresLogin:  true,
+	RequiresPortal: false,
+}
+
 func fnJoinChannel(ce *commands.Event) {
 
 	if len(ce.Args) != 2 {
@@ -76,13 +304,8 @@ func fnJoinChannel(ce *commands.Event) {
 	name := ce.Args[0]
 	key := ce.Args[1]
 
-	if login := ce.User.GetDefaultLogin(); login == nil {
-		ce.Reply("Login not found")
-	} else if !login.Client.IsLoggedIn() {
-		ce.Reply("Not logged in")
-	} else if client, ok := login.Client.(*MeshtasticClient); !ok {
-		ce.Log.Error().Msg("Unable to cast MeshtasticClient")
-		ce.Reply("Failed to get Meshtastic client (how?!)")
+	if client := getCommandClient(ce); client == nil {
+		return
 	} else if chanDef, err := meshid.NewChannelDef(name, &key); err != nil {
 		ce.Log.Error().Msg("Failed to create channel definition")
 		ce.Reply("Failed to join channel: %v", err)
@@ -94,7 +317,222 @@ func fnJoinChannel(ce *commands.Event) {
 		ce.Reply("Failed to join channel: %v", err)
 	} else {
 		ce.Reply("Successfully joined channel, the portal should be created momentarily")
+		warnChannelHashCollisions(ce, client, chanDef)
+	}
+}
+
+// getCommandClient returns the client of the login a command acts as, replying with the reason if there isn't one
+func getCommandClient(ce *commands.Event) *MeshtasticClient {
+	login := getCommandLogin(ce)
+	if login == nil {
+		ce.Reply("Login not found")
+		return nil
+	} else if !login.Client.IsLoggedIn() {
+		ce.Reply("Not logged in")
+		return nil
+	}
+	client, ok := login.Client.(*MeshtasticClient)
+	if !ok {
+		ce.Log.Error().Msg("Unable to cast MeshtasticClient")
+		ce.Reply("Failed to get Meshtastic client (how?!)")
+		return nil
+	}
+	return client
+}
+
+// warnChannelHashCollisions tells the user when a channel they joined shares its hash with other channels
+func warnChannelHashCollisions(ce *commands.Event, client *MeshtasticClient, chanDef meshid.ChannelDef) {
+	collisions := client.MeshClient.ChannelHashCollisions(chanDef)
+	if len(collisions) == 0 {
+		return
+	}
+	names := make([]string, len(collisions))
+	for i, other := range collisions {
+		names[i] = other.GetName()
+	}
+	ce.Reply("⚠️ %s has the same channel hash as %s. Packets on these channels will be told apart by trying each key, "+
+		"which costs a little more processing and may rarely put a message in the wrong portal", chanDef.GetName(), strings.Join(names, ", "))
+}
+
+func fnJoinURL(ce *commands.Event) {
+	if len(ce.Args) != 1 {
+		ce.Reply("**Usage:** `$cmdprefix join-url <url>`")
+		return
+	}
+	channels, err := mesh.ParseChannelURL(ce.Args[0])
+	if err != nil {
+		ce.Reply("Invalid channel URL: %v", err)
+		return
+	}
+	client := getCommandClient(ce)
+	if client == nil {
+		return
+	}
+
+	var joined []string
+	for _, chanDef := range channels {
+		if err = client.MeshClient.AddChannelDef(chanDef); err != nil {
+			ce.Log.Err(err).Str("channel", chanDef.GetName()).Msg("Failed to add channel to client")
+			ce.Reply("Failed to join channel %s: %v", chanDef.GetName(), err)
+		} else if err = client.joinChannel(chanDef.GetName(), chanDef.GetKeyString()); err != nil {
+			ce.Log.Err(err).Str("channel", chanDef.GetName()).Msg("Failed to join channel")
+			ce.Reply("Failed to join channel %s: %v", chanDef.GetName(), err)
+		} else {
+			joined = append(joined, chanDef.GetName())
+			warnChannelHashCollisions(ce, client, chanDef)
+		}
+	}
+	if len(joined) > 0 {
+		ce.Reply("Successfully joined %s, the portals should be created momentarily", strings.Join(joined, ", "))
+	}
+}
+
+func fnChannelURL(ce *commands.Event) {
+	conn, ok := ce.Bridge.Network.(*MeshtasticConnector)
+	if !ok {
+		ce.Log.Error().Msg("Unable to cast Meshtastic connector")
+		ce.Reply("Failed to get Meshtastic connector")
+		return
+	}
+	chanDef, err := meshid.ChannelDefFromPortalID(ce.Portal.ID)
+	if err != nil {
+		ce.Reply("This portal isn't a Meshtastic channel")
+		return
+	}
+	channelURL, err := mesh.MakeChannelURL(chanDef)
+	if err != nil {
+		ce.Log.Err(err).Msg("Failed to create channel URL")
+		ce.Reply("Failed to create channel URL: %v", err)
+		return
+	}
+	png, err := qrcode.Encode(channelURL, qrcode.Medium, 512)
+	if err != nil {
+		ce.Log.Err(err).Msg("Failed to render channel QR code")
+		ce.Reply("Failed to render QR code: %v", err)
+		return
+	}
+
+	// The URL contains the channel key, so it's only sent to the requester
+	roomID, err := ce.User.GetManagementRoom(ce.Ctx)
+	if err != nil {
+		ce.Log.Err(err).Msg("Failed to get management room")
+		ce.Reply("Failed to get your management room: %v", err)
+		return
+	}
+	// Nor in plaintext, unless the key is one anyone can derive anyway
+	if !meshid.IsPublicChannel(chanDef) {
+		if encrypted, err := isRoomEncrypted(ce, roomID); err != nil {
+			ce.Log.Err(err).Msg("Failed to check management room encryption")
+			ce.Reply("Failed to check if your management room is encrypted: %v", err)
+			return
+		} else if !encrypted {
+			ce.Reply("Your management room isn't encrypted. Enable encryption in it before exporting the key of a channel")
+			return
+		}
+	}
+	conn.sendNoticeToRoom(ce.Ctx, roomID, fmt.Sprintf("Scan the QR code with the Meshtastic app, or open this URL on a device with it installed:\n\n%s", channelURL))
+	if roomID != ce.RoomID {
+		ce.Reply("The URL of %s was sent to your management room", chanDef.GetName())
+	}
+	if err = conn.sendFileToRoom(ce.Ctx, roomID, png, fmt.Sprintf("%s.png", chanDef.GetName()), "image/png"); err != nil {
+		ce.Log.Err(err).Msg("Failed to upload channel QR code")
+		ce.Reply("Failed to upload QR code: %v", err)
+	}
+}
+
+func fnLeaveChannel(ce *commands.Event) {
+	conn, ok := ce.Bridge.Network.(*MeshtasticConnector)
+	if !ok {
+		ce.Log.Error().Msg("Unable to cast Meshtastic connector")
+		ce.Reply("Failed to get Meshtastic connector")
+		return
+	}
+	chanDef, err := meshid.ChannelDefFromPortalID(ce.Portal.ID)
+	if err != nil {
+		ce.Reply("This portal isn't a Meshtastic channel")
+		return
+	}
+	if err = conn.leaveChannel(ce.Ctx, ce.User, ce.Portal, chanDef); err != nil {
+		ce.Log.Err(err).Msg("Failed to leave channel")
+		ce.Reply("Failed to leave channel: %v", err)
+		return
+	}
+	ce.Log.Info().Str("channel", chanDef.GetName()).Msg("Left channel")
+	ce.Reply("Leaving %s. The portal will be deleted if nobody else is using it", chanDef.GetName())
+}
+
+func fnChannels(ce *commands.Event) {
+	client := getCommandClient(ce)
+	if client == nil {
+		return
+	}
+	channels := client.MeshClient.GetChannels()
+	if len(channels) == 0 {
+		ce.Reply("The bridge isn't listening to any channels")
+		return
+	}
+	var sb strings.Builder
+	sb.WriteString("| Channel | Key fingerprint | Hash | Portal |\n|---|---|---|---|\n")
+	for _, chanDef := range channels {
+		hash := strconv.FormatUint(uint64(mesh.ChannelHash(chanDef)), 10)
+		portalLink := "-"
+		key := chanDef.GetKeyString()
+		if portal, err := ce.Bridge.GetExistingPortalByKey(ce.Ctx, client.makePortalKey(chanDef.GetName(), &key)); err != nil {
+			ce.Log.Err(err).Str("channel", chanDef.GetName()).Msg("Failed to get channel portal")
+		} else if portal != nil && portal.MXID != "" {
+			portalLink = portal.MXID.URI().MatrixToURL()
+		}
+		fmt.Fprintf(&sb, "| %s | `%s` | %s | %s |\n", chanDef.GetName(), meshid.KeyFingerprint(chanDef.GetKeyBytes()), hash, portalLink)
+	}
+	ce.Reply(sb.String())
+}
+
+func fnRekeyChannel(ce *commands.Event) {
+	if len(ce.Args) != 1 {
+		ce.Reply("**Usage:** `$cmdprefix rekey-channel <channel_key>`")
+		return
+	}
+	// Don't leave the new key sitting in the room history
+	ce.Redact()
+
+	oldDef, err := meshid.ChannelDefFromPortalID(ce.Portal.ID)
+	if err != nil {
+		ce.Reply("This portal isn't a Meshtastic channel")
+		return
+	}
+	// Rekeying changes the portal for everyone in it, so it's limited to admins when the portal is shared
+	if !ce.User.Permissions.Admin {
+		logins, err := ce.Bridge.GetUserLoginsInPortal(ce.Ctx, ce.Portal.PortalKey)
+		if err != nil {
+			ce.Log.Err(err).Msg("Failed to get logins in portal")
+			ce.Reply("Failed to rekey channel: %v", err)
+			return
+		}
+		for _, l := range logins {
+			if l.UserMXID != ce.User.MXID {
+				ce.Reply("Only bridge admins can rekey a channel shared with other users")
+				return
+			}
+		}
+	}
+	client := getCommandClient(ce)
+	if client == nil {
+		return
+	}
+	newDef, err := client.rekeyChannel(ce.Ctx, ce.Portal, oldDef, ce.Args[0])
+	if err != nil {
+		ce.Log.Err(err).Msg("Failed to rekey channel")
+		ce.Reply("Failed to rekey channel: %v", err)
+		return
 	}
+	ce.Log.Info().
+		Str("channel", newDef.GetName()).
+		Str("old_key_fingerprint", meshid.KeyFingerprint(oldDef.GetKeyBytes())).
+		Str("new_key_fingerprint", meshid.KeyFingerprint(newDef.GetKeyBytes())).
+		Msg("Rekeyed channel")
+	ce.Reply("Moved %s to the key with fingerprint `%s`. Share the new key with the other members of the channel, "+
+		"for example with `$cmdprefix channel-url`", newDef.GetName(), meshid.KeyFingerprint(newDef.GetKeyBytes()))
+	warnChannelHashCollisions(ce, client, newDef)
 }
 
 func fnUpdateNames(ce *commands.Event) {
@@ -110,7 +548,7 @@ func fnUpdateNames(ce *commands.Event) {
 	_, _ = longName, shortName
 
 	userMXID := ce.User.MXID
-	nodeID := meshid.MXIDToNodeID(userMXID)
+	nodeID := getCommandNodeID(ce)
 
 	if len([]byte(longName)) > 39 {
 		ce.Reply("Long name must be less than 40 bytes")
@@ -130,7 +568,7 @@ func fnUpdateNames(ce *commands.Event) {
 func fnNodeInfo(ce *commands.Event) {
 
 	userMXID := ce.User.MXID
-	fromNode := meshid.MXIDToNodeID(userMXID)
+	fromNode := getCommandNodeID(ce)
 	isMeshNode := false
 
 	if len(ce.Args) > 0 {
@@ -150,10 +588,12 @@ func fnNodeInfo(ce *commands.Event) {
 		}
 	}
 
-	nodeID := meshid.MXIDToNodeID(userMXID)
+	nodeID := fromNode
 	if gid, ok := ce.Bridge.Matrix.ParseGhostMXID(userMXID); ok {
 		nodeID, _ = meshid.ParseUserID(gid)
 		isMeshNode = true
+	} else if conn, ok := ce.Bridge.Network.(*MeshtasticConnector); ok && userMXID != ce.User.MXID {
+		nodeID = conn.getUserNodeID(ce.Ctx, userMXID)
 	}
 
 	// Just so it's marked as used for now
@@ -179,41 +619,40 @@ func fnNodeInfo(ce *commands.Event) {
 		if len(nodeInfo.PublicKey) > 0 {
 			pubKey = fmt.Sprintf("`%s`", base64.StdEncoding.EncodeToString(nodeInfo.PublicKey))
 		}
+		if len(nodeInfo.PendingPublicKey) > 0 {
+			pubKey += fmt.Sprintf("\n**Pending Key:** `%s` (not trusted)", base64.StdEncoding.EncodeToString(nodeInfo.PendingPublicKey))
+		}
 		ce.Reply("**Node ID:** %s\n**Long Name:** %s\n**Short Name:** %s\n**Public Key:** %s", nodeID, longName, shortName, pubKey)
 	}
 
 }
 
+// parseNodeArg parses a node given either as a node ID or the Matrix ID of its ghost
+func parseNodeArg(ce *commands.Event, arg string) (meshid.NodeID, bool) {
+	if nodeID, err := meshid.ParseNodeID(arg); err == nil {
+		return nodeID, nodeID != 0
+	}
+	mtxID := id.UserID(arg)
+	if _, _, err := mtxID.ParseAndValidateRelaxed(); err == nil {
+		if gid, ok := ce.Bridge.Matrix.ParseGhostMXID(mtxID); ok {
+			if nodeID, err := meshid.ParseUserID(gid); err == nil {
+				return nodeID, nodeID != 0
+			}
+		}
+	}
+	return 0, false
+}
+
 func fnTraceroute(ce *commands.Event) {
 	if len(ce.Args) < 1 {
 		ce.Reply("**Usage:** `$cmdprefix traceroute <node_id>`")
 		return
 	}
 
-	userMXID := ce.User.MXID
-	fromNode := meshid.MXIDToNodeID(userMXID)
-
-	// Parse the target node ID (same format as info command)
-	var targetNode meshid.NodeID
-	isMeshNode := false
-
-	if parsedID, err := meshid.ParseNodeID(ce.Args[0]); err == nil {
-		targetNode = parsedID
-		isMeshNode = true
-	} else {
-		// Try parsing as a Matrix user ID
-		mtxID := id.UserID(ce.Args[0])
-		if _, _, err := mtxID.ParseAndValidateRelaxed(); err == nil {
-			if gid, ok := ce.Bridge.Matrix.ParseGhostMXID(mtxID); ok {
-				if nodeID, err := meshid.ParseUserID(gid); err == nil {
-					targetNode = nodeID
-					isMeshNode = true
-				}
-			}
-		}
-	}
+	fromNode := getCommandNodeID(ce)
 
-	if !isMeshNode || targetNode == 0 {
+	targetNode, ok := parseNodeArg(ce, ce.Args[0])
+	if !ok {
 		ce.Reply("Invalid node ID: %s", ce.Args[0])
 		return
 	}
@@ -275,3 +714,927 @@ func fnTraceroute(ce *commands.Event) {
 
 	ce.Reply("Traceroute request sent to %s. Waiting for response...", targetNode)
 }
+
+func fnRangeTest(ce *commands.Event) {
+	if len(ce.Args) < 2 {
+		ce.Reply("**Usage:** `$cmdprefix range-test <start|stop|summary|export> <channel_name> [interval]`")
+		return
+	}
+
+	action := strings.ToLower(ce.Args[0])
+	channelName := ce.Args[1]
+	fromNode := getCommandNodeID(ce)
+
+	conn, ok := ce.Bridge.Network.(*MeshtasticConnector)
+	if !ok {
+		ce.Log.Error().Msg("Unable to cast Meshtastic connector")
+		ce.Reply("Failed to get Meshtastic connector")
+		return
+	}
+
+	switch action {
+	case "start":
+		if len(ce.Args) < 3 {
+			ce.Reply("**Usage:** `$cmdprefix range-test start <channel_name> <interval>`")
+			return
+		}
+		interval, err := time.ParseDuration(ce.Args[2])
+		if err != nil {
+			// Firmware and the apps express the interval in seconds
+			secs, err2 := strconv.Atoi(ce.Args[2])
+			if err2 != nil {
+				ce.Reply("Invalid interval: %s", ce.Args[2])
+				return
+			}
+			interval = time.Duration(secs) * time.Second
+		}
+		channel := conn.meshClient.GetChannelDef(channelName)
+		if channel == nil {
+			ce.Reply("Channel %s has not been joined", channelName)
+			return
+		}
+		if _, err := conn.startRangeTest(fromNode, channel, interval, ce.RoomID); err != nil {
+			ce.Log.Err(err).Msg("Failed to start range test")
+			ce.Reply("Failed to start range test: %v", err)
+			return
+		}
+		ce.Reply("Range test started on %s, sending every %s", channelName, interval)
+	case "stop":
+		session := conn.rangeTestTracker.Stop(fromNode, channelName)
+		if session == nil {
+			ce.Reply("No range test is running on %s", channelName)
+			return
+		}
+		results, err := conn.getRangeTestResults(ce.Ctx, fromNode, channelName)
+		if err != nil {
+			ce.Log.Err(err).Msg("Failed to fetch range test results")
+			ce.Reply("Range test stopped, but the results could not be fetched: %v", err)
+			return
+		}
+		conn.sendNoticeToRoom(ce.Ctx, session.RoomID, conn.formatRangeTestSummary(channelName, session, results))
+		if session.RoomID != ce.RoomID {
+			ce.Reply("Range test stopped, results were posted to the room it was started from")
+		}
+	case "summary":
+		results, err := conn.getRangeTestResults(ce.Ctx, fromNode, channelName)
+		if err != nil {
+			ce.Log.Err(err).Msg("Failed to fetch range test results")
+			ce.Reply("Failed to fetch range test results: %v", err)
+			return
+		}
+		ce.Reply(conn.formatRangeTestSummary(channelName, conn.rangeTestTracker.Get(fromNode, channelName), results))
+	case "export":
+		results, err := conn.getRangeTestResults(ce.Ctx, fromNode, channelName)
+		if err != nil {
+			ce.Log.Err(err).Msg("Failed to fetch range test results")
+			ce.Reply("Failed to fetch range test results: %v", err)
+			return
+		}
+		data, err := rangeTestCSV(results)
+		if err != nil {
+			ce.Log.Err(err).Msg("Failed to render range test CSV")
+			ce.Reply("Failed to export range test results: %v", err)
+			return
+		}
+		fileName := fmt.Sprintf("rangetest-%s-%s.csv", channelName, time.Now().UTC().Format("20060102-150405"))
+		if err := conn.sendFileToRoom(ce.Ctx, ce.RoomID, data, fileName, "text/csv"); err != nil {
+			ce.Log.Err(err).Msg("Failed to upload range test CSV")
+			ce.Reply("Failed to export range test results: %v", err)
+		}
+	default:
+		ce.Reply("**Usage:** `$cmdprefix range-test <start|stop|summary|export> <channel_name> [interval]`")
+	}
+}
+
+func fnPortalSetting(ce *commands.Event) {
+	meta := getPortalMetadata(ce.Portal)
+
+	if len(ce.Args) == 0 {
+		var sb strings.Builder
+		sb.WriteString("**Portal settings:**\n")
+		for _, s := range portalSettings {
+			sb.WriteString(fmt.Sprintf("* `%s`: %s (%s)\n", s.Name, s.Get(meta), s.Description))
+		}
+		ce.Reply(sb.String())
+		return
+	}
+
+	setting := getPortalSetting(ce.Args[0])
+	if setting == nil {
+		ce.Reply("Unknown setting: %s", ce.Args[0])
+		return
+	}
+
+	if len(ce.Args) == 1 {
+		ce.Reply("`%s` is currently set to `%s`. Possible values: %s", setting.Name, setting.Get(meta), strings.Join(setting.Values, ", "))
+		return
+	}
+
+	if err := setting.Set(meta, strings.Join(ce.Args[1:], " ")); err != nil {
+		ce.Reply("Invalid value for `%s`: %v", setting.Name, err)
+	} else if err := ce.Portal.Save(ce.Ctx); err != nil {
+		ce.Log.Err(err).Msg("Failed to save portal settings")
+		ce.Reply("Failed to save portal settings: %v", err)
+	} else {
+		ce.Reply("`%s` set to `%s`", setting.Name, setting.Get(meta))
+	}
+}
+
+func fnTrustKey(ce *commands.Event) {
+	if len(ce.Args) < 1 {
+		ce.Reply("**Usage:** `$cmdprefix trust-key <node_id>`")
+		return
+	}
+	nodeID, ok := parseNodeArg(ce, ce.Args[0])
+	if !ok {
+		ce.Reply("Invalid node ID: %s", ce.Args[0])
+		return
+	}
+	conn, ok := ce.Bridge.Network.(*MeshtasticConnector)
+	if !ok {
+		ce.Log.Error().Msg("Unable to cast Meshtastic connector")
+		ce.Reply("Failed to get Meshtastic connector")
+		return
+	}
+
+	nodeInfo, err := conn.meshDB.MeshNodeInfo.GetByNodeID(ce.Ctx, nodeID)
+	if err != nil {
+		ce.Log.Err(err).Msg("Unable to search for node info")
+		ce.Reply("Failed to fetch node info: %v", err)
+		return
+	} else if nodeInfo == nil || len(nodeInfo.PublicKey) == 0 {
+		ce.Reply("No public key is known for %s", nodeID)
+		return
+	}
+
+	if len(nodeInfo.PendingPublicKey) == 0 {
+		history, err := conn.meshDB.KeyHistory.GetByNodeID(ce.Ctx, nodeID)
+		if err != nil {
+			ce.Log.Err(err).Msg("Failed to fetch key history")
+			ce.Reply("Failed to fetch key history: %v", err)
+			return
+		}
+		var sb strings.Builder
+		sb.WriteString(fmt.Sprintf("No key change is pending for %s\n\n**Key history:**\n", conn.getNodeDisplayName(nodeID)))
+		for _, k := range history {
+			sb.WriteString(fmt.Sprintf("* `%s` first seen %s", base64.StdEncoding.EncodeToString(k.PublicKey), k.FirstSeen.UTC().Format(time.RFC1123)))
+			if k.TrustedBy != "" {
+				sb.WriteString(fmt.Sprintf(", trusted by %s", k.TrustedBy))
+			} else if k.TrustedAt != nil {
+				sb.WriteString(", trusted on first use")
+			}
+			if bytes.Equal(k.PublicKey, nodeInfo.PublicKey) {
+				sb.WriteString(" (pinned)")
+			}
+			sb.WriteString("\n")
+		}
+		ce.Reply(sb.String())
+		return
+	}
+
+	// The pinned key is shared by everyone on the bridge, so only admins may accept a change
+	if !ce.User.Permissions.Admin {
+		ce.Reply("%s has a pending key change, which only bridge administrators can trust", conn.getNodeDisplayName(nodeID))
+		return
+	}
+	newKey := base64.StdEncoding.EncodeToString(nodeInfo.PendingPublicKey)
+	if err := conn.trustPendingKey(ce.Ctx, nodeInfo, ce.User.MXID); err != nil {
+		ce.Log.Err(err).Msg("Failed to trust key")
+		ce.Reply("Failed to trust key: %v", err)
+		return
+	}
+	conn.notifyDMPortals(ce.Ctx, nodeID, fmt.Sprintf("%s trusted the new public key of %s: `%s`", ce.User.MXID, conn.getNodeDisplayName(nodeID), newKey))
+	ce.Reply("Trusted the new public key of %s: `%s`", conn.getNodeDisplayName(nodeID), newKey)
+}
+
+const verifyUsage = "**Usage:**\n" +
+	"* `$cmdprefix verify [node_id]` - start verifying the key of a node\n" +
+	"* `$cmdprefix verify number <number>` - enter the security number shown on the node\n" +
+	"* `$cmdprefix verify confirm` - confirm the verification codes match\n" +
+	"* `$cmdprefix verify cancel` - abandon the verification\n\n" +
+	"In a DM portal, the node defaults to the other side of the conversation"
+
+// verificationNodes determines the managed and remote nodes a verify command applies to,
+// using the DM portal it was sent in when no node is given
+func verificationNodes(ce *commands.Event, args []string) (synthNode, remoteNode meshid.NodeID, ok bool) {
+	if len(args) > 0 {
+		remoteNode, ok = parseNodeArg(ce, args[0])
+		if !ok {
+			ce.Reply("Invalid node ID: %s", args[0])
+			return 0, 0, false
+		}
+		return getCommandNodeID(ce), remoteNode, true
+	}
+	if ce.Portal != nil {
+		if remoteNode, synthNode, err := meshid.ParseDMPortalID(ce.Portal.ID); err == nil {
+			return synthNode, remoteNode, true
+		}
+	}
+	ce.Reply(verifyUsage)
+	return 0, 0, false
+}
+
+func fnVerify(ce *commands.Event) {
+	conn, ok := ce.Bridge.Network.(*MeshtasticConnector)
+	if !ok {
+		ce.Log.Error().Msg("Unable to cast Meshtastic connector")
+		ce.Reply("Failed to get Meshtastic connector")
+		return
+	}
+
+	action := ""
+	if len(ce.Args) > 0 {
+		action = strings.ToLower(ce.Args[0])
+	}
+
+	switch action {
+	case "number":
+		if len(ce.Args) < 2 {
+			ce.Reply("**Usage:** `$cmdprefix verify number <number>`")
+			return
+		}
+		// Devices display the number split in two, so allow it to be entered the same way
+		number, err := strconv.ParseUint(strings.Join(ce.Args[1:], ""), 10, 32)
+		if err != nil || number == 0 || number > 999999 {
+			ce.Reply("Invalid security number: %s", strings.Join(ce.Args[1:], " "))
+			return
+		}
+		synthNode, remoteNode, ok := verificationNodes(ce, nil)
+		if !ok {
+			return
+		}
+		code, err := conn.meshClient.SubmitSecurityNumber(synthNode, remoteNode, uint32(number))
+		if err != nil {
+			ce.Reply("Failed to verify security number: %v", err)
+			return
+		}
+		ce.Reply("🔐 Compare this verification code with the one shown on %s: **%s**\n\n"+
+			"If they match, confirm it with `$cmdprefix verify confirm`. Otherwise, cancel with `$cmdprefix verify cancel`",
+			conn.getNodeDisplayName(remoteNode), code)
+
+	case "confirm":
+		synthNode, remoteNode, ok := verificationNodes(ce, ce.Args[1:])
+		if !ok {
+			return
+		}
+		if err := conn.meshClient.FinishKeyVerification(synthNode, remoteNode, true); err != nil {
+			ce.Reply("Failed to confirm verification: %v", err)
+			return
+		}
+		if err := conn.saveKeyVerification(ce.Ctx, synthNode, remoteNode, ce.User.MXID); err != nil {
+			ce.Log.Err(err).Msg("Failed to save key verification")
+			ce.Reply("Failed to save key verification: %v", err)
+			return
+		}
+		ce.Reply("✅ The key of %s is now verified", conn.getNodeDisplayName(remoteNode))
+
+	case "cancel":
+		synthNode, remoteNode, ok := verificationNodes(ce, ce.Args[1:])
+		if !ok {
+			return
+		}
+		if err := conn.meshClient.FinishKeyVerification(synthNode, remoteNode, false); err != nil {
+			ce.Reply("Failed to cancel verification: %v", err)
+			return
+		}
+		ce.Reply("Key verification with %s cancelled", conn.getNodeDisplayName(remoteNode))
+
+	default:
+		synthNode, remoteNode, ok := verificationNodes(ce, ce.Args)
+		if !ok {
+			return
+		} else if !conn.IsManagedNode(synthNode) {
+			ce.Reply("%s is not managed by this bridge", synthNode)
+			return
+		}
+		if err := conn.ensureKeyTrusted(ce.Ctx, remoteNode); err != nil {
+			ce.Reply("Unable to verify %s: %v", remoteNode, err)
+			return
+		} else if pubKey, err := conn.getGhostPublicKey(ce.Ctx, remoteNode); err != nil || len(pubKey) == 0 {
+			ce.Reply("No public key is known for %s", conn.getNodeDisplayName(remoteNode))
+			return
+		}
+		if err := conn.meshClient.StartKeyVerification(synthNode, remoteNode); err != nil {
+			ce.Log.Err(err).Msg("Failed to start key verification")
+			ce.Reply("Failed to start key verification: %v", err)
+			return
+		}
+		ce.Reply("🔐 Key verification request sent to %s. Once it responds, enter the security number shown on it with `$cmdprefix verify number <number>`",
+			conn.getNodeDisplayName(remoteNode))
+	}
+}
+
+func fnExportIdentity(ce *commands.Event) {
+	meshtasticFormat := false
+	if len(ce.Args) > 0 {
+		switch strings.ToLower(ce.Args[0]) {
+		case "base64":
+		case "meshtastic":
+			meshtasticFormat = true
+		default:
+			ce.Reply("**Usage:** `$cmdprefix export-identity [base64|meshtastic]`")
+			return
+		}
+	}
+	conn, ok := ce.Bridge.Network.(*MeshtasticConnector)
+	if !ok {
+		ce.Log.Error().Msg("Unable to cast Meshtastic connector")
+		ce.Reply("Failed to get Meshtastic connector")
+		return
+	}
+
+	nodeID := getCommandNodeID(ce)
+	if _, err := conn.getGhostPrivateKey(ce.Ctx, nodeID); err != nil {
+		ce.Log.Err(err).Msg("Failed to get private key")
+		ce.Reply("Failed to get the keys of your node: %v", err)
+		return
+	}
+	nodeInfo, err := conn.meshDB.MeshNodeInfo.GetByNodeID(ce.Ctx, nodeID)
+	if err != nil || nodeInfo == nil {
+		ce.Log.Err(err).Msg("Failed to get node info")
+		ce.Reply("Failed to get the keys of your node: %v", err)
+		return
+	}
+
+	// The private key should never be posted in a room shared with other users
+	roomID, err := ce.User.GetManagementRoom(ce.Ctx)
+	if err != nil {
+		ce.Log.Err(err).Msg("Failed to get management room")
+		ce.Reply("Failed to get your management room: %v", err)
+		return
+	}
+	// Nor in plaintext, where the homeserver can read it
+	if encrypted, err := isRoomEncrypted(ce, roomID); err != nil {
+		ce.Log.Err(err).Msg("Failed to check management room encryption")
+		ce.Reply("Failed to check if your management room is encrypted: %v", err)
+		return
+	} else if !encrypted {
+		ce.Reply("Your management room isn't encrypted. Enable encryption in it before exporting the keys of your node")
+		return
+	}
+	conn.sendNoticeToRoom(ce.Ctx, roomID, formatIdentity(nodeInfo, meshtasticFormat))
+	if roomID != ce.RoomID {
+		ce.Reply("The identity of your node was sent to your management room")
+	}
+}
+
+// isRoomEncrypted checks whether the bridge has seen encryption being enabled in a room
+func isRoomEncrypted(ce *commands.Event, roomID id.RoomID) (bool, error) {
+	conn, ok := ce.Bridge.Matrix.(*matrix.Connector)
+	if !ok {
+		return false, errors.New("unable to cast Matrix connector")
+	}
+	return conn.StateStore.IsEncrypted(ce.Ctx, roomID)
+}
+
+func fnImportKeyPair(ce *commands.Event) {
+	if len(ce.Args) != 1 {
+		ce.Reply("**Usage:** `$cmdprefix import-keypair <private_key>`")
+		return
+	}
+	// Don't leave the private key sitting in the room history
+	ce.Redact()
+
+	privateKey, err := parsePrivateKey(ce.Args[0])
+	if err != nil {
+		ce.Reply("Invalid private key: %v", err)
+		return
+	}
+	conn, ok := ce.Bridge.Network.(*MeshtasticConnector)
+	if !ok {
+		ce.Log.Error().Msg("Unable to cast Meshtastic connector")
+		ce.Reply("Failed to get Meshtastic connector")
+		return
+	}
+
+	nodeID := getCommandNodeID(ce)
+	if err = conn.importKeyPair(ce.Ctx, nodeID, privateKey); err != nil {
+		ce.Log.Err(err).Msg("Failed to import key pair")
+		ce.Reply("Failed to import key pair: %v", err)
+		return
+	}
+	ce.Log.Info().Stringer("node_id", nodeID).Msg("Imported key pair")
+	ce.Reply("Imported the key pair of %s and announced the new public key to the mesh.\n\n"+
+		"⚠️ Stop using this key on any other device. Nodes that see the same public key used by two nodes "+
+		"will flag it as compromised, and either device may be able to read direct messages meant for the other. "+
+		"Nodes that already pinned your old key will need to accept the new one before they can message you", nodeID)
+}
+
+func fnIdentity(ce *commands.Event) {
+	if len(ce.Args) == 0 {
+		current := getCommandLogin(ce)
+		var sb strings.Builder
+		sb.WriteString("Your Meshtastic identities:\n\n")
+		for _, login := range ce.User.GetUserLogins() {
+			fmt.Fprintf(&sb, "* `%s` %s (%s)", loginNodeID(login, ce.User.MXID), login.RemoteProfile.Name, login.RemoteName)
+			if current != nil && login.ID == current.ID {
+				sb.WriteString(" ✅")
+			}
+			sb.WriteString("\n")
+		}
+		if ce.Portal != nil {
+			sb.WriteString("\nThe checked identity speaks in this portal. Choose another with `$cmdprefix identity <node_id>`")
+		} else {
+			sb.WriteString("\nThe checked identity is used outside of portals. Use `$cmdprefix identity <node_id>` in a portal to choose which identity speaks there")
+		}
+		ce.Reply(sb.String())
+		return
+	}
+
+	if ce.Portal == nil {
+		ce.Reply("An identity can only be chosen in a portal")
+		return
+	} else if ce.Portal.Receiver != "" {
+		ce.Reply("This portal belongs to a single identity, so another one can't be chosen")
+		return
+	}
+	nodeID, ok := parseNodeArg(ce, ce.Args[0])
+	if !ok {
+		ce.Reply("Invalid node ID: %s", ce.Args[0])
+		return
+	}
+	var login *bridgev2.UserLogin
+	for _, l := range ce.User.GetUserLogins() {
+		if loginNodeID(l, ce.User.MXID) == nodeID {
+			login = l
+			break
+		}
+	}
+	if login == nil {
+		ce.Reply("%s is not one of your identities", nodeID)
+		return
+	}
+
+	login.MarkInPortal(ce.Ctx, ce.Portal)
+	if err := login.MarkAsPreferredIn(ce.Ctx, ce.Portal); err != nil {
+		ce.Log.Err(err).Msg("Failed to mark login as preferred")
+		ce.Reply("Failed to choose identity: %v", err)
+		return
+	}
+	if ghost, err := ce.Bridge.GetGhostByID(ce.Ctx, meshid.MakeUserID(nodeID)); err != nil {
+		ce.Log.Err(err).Msg("Failed to get ghost of identity")
+	} else if err = ghost.Intent.EnsureJoined(ce.Ctx, ce.Portal.MXID); err != nil {
+		ce.Log.Err(err).Msg("Failed to join ghost of identity to portal")
+	}
+	ce.Log.Info().Stringer("node_id", nodeID).Msg("Chose identity for portal")
+	ce.Reply("Messages you send in this portal will now come from %s", nodeID)
+}
+
+func fnLicensed(ce *commands.Event) {
+	login := getCommandLogin(ce)
+	if login == nil {
+		ce.Reply("You're not logged in")
+		return
+	}
+	meta := login.Metadata.(*meshid.UserLoginMetadata)
+	if len(ce.Args) == 0 {
+		if meta.Callsign == "" {
+			ce.Reply("Licensed mode is off for %s. Turn it on with `$cmdprefix licensed <callsign>`", meta.NodeID)
+		} else {
+			ce.Reply("Licensed mode is on for %s with the callsign `%s`", meta.NodeID, meta.Callsign)
+		}
+		return
+	} else if len(ce.Args) != 1 {
+		ce.Reply("**Usage:** `$cmdprefix licensed [callsign | off]`")
+		return
+	}
+
+	callsign := ""
+	if !strings.EqualFold(ce.Args[0], "off") {
+		var err error
+		if callsign, err = parseCallsign(ce.Args[0]); err != nil {
+			ce.Reply("%v", err)
+			return
+		}
+	}
+	conn := ce.Bridge.Network.(*MeshtasticConnector)
+	err := conn.setLicensed(ce.Ctx, login, callsign)
+	if errors.Is(err, mesh.ErrLicensedEncryption) {
+		ce.Reply("Licensed mode is on for %s with the callsign `%s`, but the primary channel is encrypted, "+
+			"so your node info and direct messages can't be sent", meta.NodeID, callsign)
+		return
+	} else if err != nil {
+		ce.Log.Err(err).Msg("Failed to update licensed mode")
+		ce.Reply("Failed to update licensed mode: %v", err)
+		return
+	}
+	if callsign == "" {
+		ce.Reply("Licensed mode is now off for %s", meta.NodeID)
+	} else {
+		ce.Reply("Licensed mode is now on for %s with the callsign `%s`. Your messages will end with station "+
+			"identification, and encrypted channels and PKI direct messages can no longer be used", meta.NodeID, callsign)
+	}
+}
+
+func fnDMEncryption(ce *commands.Event) {
+	login := getCommandLogin(ce)
+	if login == nil {
+		ce.Reply("You're not logged in")
+		return
+	}
+	conn := ce.Bridge.Network.(*MeshtasticConnector)
+	meta := login.Metadata.(*meshid.UserLoginMetadata)
+	if len(ce.Args) == 0 {
+		policy := conn.getDMEncryption(meta.NodeID)
+		if meta.DMEncryption == "" {
+			ce.Reply("Direct messages from %s use the bridge default, `%s`", meta.NodeID, policy)
+		} else {
+			ce.Reply("Direct messages from %s use `%s`", meta.NodeID, policy)
+		}
+		return
+	}
+
+	policy := strings.ToLower(ce.Args[0])
+	if policy == "default" {
+		policy = ""
+	} else if !meshid.IsValidDMEncryption(policy) {
+		ce.Reply("**Usage:** `$cmdprefix dm-encryption [require_pki | prefer_pki | allow_psk | default]`")
+		return
+	}
+	meta.DMEncryption = policy
+	if err := login.Save(ce.Ctx); err != nil {
+		ce.Log.Err(err).Msg("Failed to save DM encryption policy")
+		ce.Reply("Failed to save DM encryption policy: %v", err)
+		return
+	}
+	if err := conn.updateDMTopics(ce.Ctx, login); err != nil {
+		ce.Log.Err(err).Msg("Failed to update DM portal topics")
+	}
+	ce.Reply("Direct messages from %s now use `%s`", meta.NodeID, conn.getDMEncryption(meta.NodeID))
+}
+
+func fnMaxPositionPrecision(ce *commands.Event) {
+	login := getCommandLogin(ce)
+	if login == nil {
+		ce.Reply("You're not logged in")
+		return
+	}
+	meta := login.Metadata.(*meshid.UserLoginMetadata)
+	if len(ce.Args) == 0 {
+		if meta.MaxPositionPrecision == nil {
+			ce.Reply("Locations sent from %s aren't limited beyond the channel settings", meta.NodeID)
+		} else {
+			ce.Reply("Locations sent from %s are limited to %d bits, which is %s", meta.NodeID,
+				*meta.MaxPositionPrecision, formatPrecision(*meta.MaxPositionPrecision))
+		}
+		return
+	}
+
+	limit, err := parsePrecisionLimit(ce.Args[0])
+	if err != nil {
+		ce.Reply("%v", err)
+		return
+	}
+	meta.MaxPositionPrecision = limit
+	if err = login.Save(ce.Ctx); err != nil {
+		ce.Log.Err(err).Msg("Failed to save position precision")
+		ce.Reply("Failed to save position precision: %v", err)
+	} else if limit == nil {
+		ce.Reply("Locations sent from %s are now only limited by the channel settings", meta.NodeID)
+	} else if *limit == 0 {
+		ce.Reply("Locations will no longer be sent from %s", meta.NodeID)
+	} else {
+		ce.Reply("Locations sent from %s are now limited to %d bits, which is %s", meta.NodeID, *limit, formatPrecision(*limit))
+	}
+}
+
+func fnRotateKEK(ce *commands.Event) {
+	conn, ok := ce.Bridge.Network.(*MeshtasticConnector)
+	if !ok {
+		ce.Log.Error().Msg("Unable to cast Meshtastic connector")
+		ce.Reply("Failed to get Meshtastic connector")
+		return
+	}
+	count, err := conn.meshDB.MeshNodeInfo.EncryptPrivateKeys(ce.Ctx, true)
+	if err != nil {
+		ce.Log.Err(err).Msg("Failed to rotate key-encryption key")
+		ce.Reply("Failed to re-encrypt private keys: %v", err)
+		return
+	}
+	ce.Log.Info().Int("count", count).Msg("Re-encrypted private keys with the current key-encryption key")
+	ce.Reply("Re-encrypted %d private keys with the current key-encryption key. "+
+		"Once the config is no longer needed for a rollback, `previous_key_encryption_keys` can be cleared", count)
+}
+
+func fnTrack(ce *commands.Event) {
+	if len(ce.Args) < 1 {
+		ce.Reply("**Usage:** `$cmdprefix track <node_id> [since]`")
+		return
+	}
+	nodeID, ok := parseNodeArg(ce, ce.Args[0])
+	if !ok {
+		ce.Reply("Invalid node ID: %s", ce.Args[0])
+		return
+	}
+	since := time.Now().Add(-trackDefaultWindow)
+	if len(ce.Args) > 1 {
+		window, err := parseDuration(ce.Args[1])
+		if err != nil || window <= 0 {
+			ce.Reply("Invalid time period: %s. Use a duration such as `12h` or `7d`", ce.Args[1])
+			return
+		}
+		since = time.Now().Add(-window)
+	}
+
+	conn, ok := ce.Bridge.Network.(*MeshtasticConnector)
+	if !ok {
+		ce.Log.Error().Msg("Unable to cast Meshtastic connector")
+		ce.Reply("Failed to get Meshtastic connector")
+		return
+	}
+	if !conn.Config.PositionHistory.Enabled {
+		ce.Reply("Position history is disabled on this bridge")
+		return
+	}
+	if canSee, err := conn.canSeeNode(ce.Ctx, ce.User, nodeID); err != nil {
+		ce.Log.Err(err).Msg("Failed to check if the node is visible to the user")
+		ce.Reply("Failed to fetch positions: %v", err)
+		return
+	} else if !canSee {
+		ce.Reply("You can only see the tracks of nodes in your portals")
+		return
+	}
+
+	positions, err := conn.meshDB.Position.GetByNodeSince(ce.Ctx, nodeID, since)
+	if err != nil {
+		ce.Log.Err(err).Msg("Failed to fetch positions")
+		ce.Reply("Failed to fetch positions: %v", err)
+		return
+	}
+	ce.Reply(conn.formatTrackSummary(nodeID, since, positions))
+	if len(positions) == 0 {
+		return
+	}
+	data, err := trackGPX(conn.getNodeDisplayName(nodeID), positions)
+	if err != nil {
+		ce.Log.Err(err).Msg("Failed to render track GPX")
+		ce.Reply("Failed to export track: %v", err)
+		return
+	}
+	fileName := fmt.Sprintf("track-%s-%s.gpx", nodeID, time.Now().UTC().Format("20060102-150405"))
+	if err := conn.sendFileToRoom(ce.Ctx, ce.RoomID, data, fileName, "application/gpx+xml"); err != nil {
+		ce.Log.Err(err).Msg("Failed to upload track GPX")
+		ce.Reply("Failed to export track: %v", err)
+	}
+}
+
+func fnShareLocation(ce *commands.Event) {
+	if len(ce.Args) < 1 || len(ce.Args) > 2 {
+		ce.Reply("**Usage:** `$cmdprefix share-location <node_id> [on|off]`")
+		return
+	}
+	nodeID, ok := parseNodeArg(ce, ce.Args[0])
+	if !ok {
+		ce.Reply("Invalid node ID: %s", ce.Args[0])
+		return
+	}
+	conn, ok := ce.Bridge.Network.(*MeshtasticConnector)
+	if !ok {
+		ce.Log.Error().Msg("Unable to cast Meshtastic connector")
+		ce.Reply("Failed to get Meshtastic connector")
+		return
+	}
+	ghost, err := conn.bridge.GetExistingGhostByID(ce.Ctx, meshid.MakeUserID(nodeID))
+	if err != nil {
+		ce.Log.Err(err).Msg("Failed to get ghost")
+		ce.Reply("Failed to get node: %v", err)
+		return
+	} else if ghost == nil {
+		ce.Reply("%s hasn't been seen by the bridge", nodeID)
+		return
+	}
+	if len(ce.Args) == 1 {
+		ce.Reply("Location sharing is %s for %s", formatOnOff(sharesLocation(ghost)), conn.getNodeDisplayName(nodeID))
+		return
+	}
+	// Nodes of other people can only be opted in by admins, who are trusted to have their consent
+	if meta, ok := ghost.Metadata.(*meshid.GhostMetadata); !ce.User.Permissions.Admin && (!ok || meta.UserMXID != ce.User.MXID) {
+		ce.Reply("You can only change location sharing for your own nodes")
+		return
+	}
+	share, err := parseOnOff(ce.Args[1])
+	if err != nil {
+		ce.Reply("Invalid value: %v", err)
+		return
+	}
+	if err = conn.setShareLocation(ce.Ctx, ghost, share); err != nil {
+		ce.Log.Err(err).Msg("Failed to save location sharing")
+		ce.Reply("Failed to save location sharing: %v", err)
+		return
+	}
+	ce.Reply("Location sharing is now %s for %s", formatOnOff(share), conn.getNodeDisplayName(nodeID))
+}
+
+const waypointUsage = "**Usage:**\n" +
+	"* `$cmdprefix waypoint add [geo:uri] <name> [description] [icon] [expires]`\n" +
+	"* `$cmdprefix waypoint edit <id> <name|description|icon|expires|location> [value]`\n" +
+	"* `$cmdprefix waypoint delete <id>`\n" +
+	"* `$cmdprefix waypoint lock <id>` / `$cmdprefix waypoint unlock <id>`\n" +
+	"* `$cmdprefix waypoint list`\n\n" +
+	"Reply to a shared location to use it as the position, or pass a `geo:` URI. " +
+	"Arguments with spaces must be quoted. Expiry is a duration such as `12h` or `3d`, or `never`"
+
+func fnWaypoint(ce *commands.Event) {
+	args := splitQuotedArgs(ce.RawArgs)
+	if len(args) == 0 {
+		ce.Reply(waypointUsage)
+		return
+	}
+
+	conn, ok := ce.Bridge.Network.(*MeshtasticConnector)
+	if !ok {
+		ce.Log.Error().Msg("Unable to cast Meshtastic connector")
+		ce.Reply("Failed to get Meshtastic connector")
+		return
+	}
+	fromNode := getCommandNodeID(ce)
+	action := strings.ToLower(args[0])
+	args = args[1:]
+
+	if action == "list" {
+		waypoints, err := conn.meshDB.Waypoint.GetByNodeID(ce.Ctx, fromNode)
+		if err != nil {
+			ce.Log.Err(err).Msg("Failed to get waypoints")
+			ce.Reply("Failed to get waypoints: %v", err)
+			return
+		} else if len(waypoints) == 0 {
+			ce.Reply("You haven't set any waypoints")
+			return
+		}
+		var sb strings.Builder
+		sb.WriteString("**Your waypoints:**\n")
+		for _, w := range waypoints {
+			geo := meshid.GeoURI{Latitude: w.Latitude, Longitude: w.Longitude}
+			sb.WriteString(fmt.Sprintf("* `%d` %s %s (%s)", w.WaypointID, waypointIcon(w), w.Name, geo.String()))
+			if w.Expires != nil {
+				sb.WriteString(fmt.Sprintf(", expires %s", w.Expires.UTC().Format(time.RFC1123)))
+			}
+			if w.LockedTo != nil {
+				sb.WriteString(", locked")
+			}
+			sb.WriteString("\n")
+		}
+		ce.Reply(sb.String())
+		return
+	}
+
+	if ce.Portal == nil {
+		ce.Reply("Waypoints can only be managed from a channel portal")
+		return
+	}
+	channelName, channelKey, err := meshid.ParsePortalID(ce.Portal.ID)
+	if err != nil {
+		ce.Reply("Waypoints can only be managed from a channel portal")
+		return
+	}
+
+	// Gets the position from a geo: URI argument, or from the location being replied to
+	getLocation := func() (*meshid.GeoURI, error) {
+		if len(args) > 0 && strings.HasPrefix(strings.ToLower(args[0]), "geo:") {
+			geo, err := meshid.ParseGeoURI(args[0])
+			args = args[1:]
+			return geo, err
+		} else if ce.ReplyTo != "" {
+			return conn.getEventLocation(ce.Ctx, ce.RoomID, ce.ReplyTo)
+		}
+		return nil, fmt.Errorf("reply to a shared location or include a geo: URI")
+	}
+
+	var waypoint mesh.Waypoint
+	switch action {
+	case "add", "create":
+		geo, err := getLocation()
+		if err != nil {
+			ce.Reply("Unable to get the waypoint position: %v", err)
+			return
+		} else if len(args) == 0 {
+			ce.Reply(waypointUsage)
+			return
+		}
+		waypointID, err := conn.newWaypointID(ce.Ctx)
+		if err != nil {
+			ce.Log.Err(err).Msg("Failed to generate waypoint ID")
+			ce.Reply("Failed to create waypoint: %v", err)
+			return
+		}
+		waypoint = mesh.Waypoint{
+			ID:        waypointID,
+			Name:      args[0],
+			Latitude:  geo.Latitude,
+			Longitude: geo.Longitude,
+		}
+		if len(args) > 1 {
+			waypoint.Description = args[1]
+		}
+		if len(args) > 2 {
+			if waypoint.Icon, err = parseWaypointIcon(args[2]); err != nil {
+				ce.Reply("Invalid icon: %v", err)
+				return
+			}
+		}
+		if len(args) > 3 {
+			if waypoint.Expires, err = parseWaypointExpiry(args[3]); err != nil {
+				ce.Reply("%v", err)
+				return
+			}
+		}
+
+	case "edit", "delete", "remove", "lock", "unlock":
+		if len(args) == 0 {
+			ce.Reply(waypointUsage)
+			return
+		}
+		waypointID, err := strconv.ParseUint(args[0], 10, 32)
+		if err != nil {
+			ce.Reply("Invalid waypoint ID: %s", args[0])
+			return
+		}
+		args = args[1:]
+		existing, err := conn.meshDB.Waypoint.GetByWaypointID(ce.Ctx, uint32(waypointID))
+		if err != nil {
+			ce.Log.Err(err).Msg("Failed to get waypoint")
+			ce.Reply("Failed to get waypoint: %v", err)
+			return
+		} else if existing == nil {
+			ce.Reply("Waypoint `%d` doesn't exist", waypointID)
+			return
+		} else if !canEditWaypoint(existing, fromNode) {
+			ce.Reply("Waypoint `%d` is locked to %s", waypointID, conn.getNodeDisplayName(*existing.LockedTo))
+			return
+		}
+		waypoint = toMeshWaypoint(existing)
+
+		switch action {
+		case "delete", "remove":
+			// Nodes delete waypoints whose expiry has passed
+			waypoint.Expires = ptr.Ptr(time.Unix(1, 0))
+		case "lock":
+			waypoint.LockedTo = &fromNode
+		case "unlock":
+			waypoint.LockedTo = nil
+		case "edit":
+			if len(args) == 0 {
+				ce.Reply(waypointUsage)
+				return
+			}
+			field := strings.ToLower(args[0])
+			args = args[1:]
+			if field == "location" || field == "position" {
+				geo, err := getLocation()
+				if err != nil {
+					ce.Reply("Unable to get the waypoint position: %v", err)
+					return
+				}
+				waypoint.Latitude = geo.Latitude
+				waypoint.Longitude = geo.Longitude
+				break
+			} else if len(args) == 0 && field != "description" && field != "icon" {
+				ce.Reply(waypointUsage)
+				return
+			}
+			value := strings.Join(args, " ")
+			switch field {
+			case "name":
+				waypoint.Name = value
+			case "description":
+				waypoint.Description = value
+			case "icon":
+				waypoint.Icon = 0
+				if value != "" {
+					if waypoint.Icon, err = parseWaypointIcon(value); err != nil {
+						ce.Reply("Invalid icon: %v", err)
+						return
+					}
+				}
+			case "expires", "expiry":
+				if waypoint.Expires, err = parseWaypointExpiry(value); err != nil {
+					ce.Reply("%v", err)
+					return
+				}
+			default:
+				ce.Reply("Unknown waypoint field: %s", field)
+				return
+			}
+		}
+
+	default:
+		ce.Reply(waypointUsage)
+		return
+	}
+
+	if err := conn.sendWaypoint(fromNode, channelName, channelKey, waypoint); err != nil {
+		ce.Log.Err(err).Msg("Failed to send waypoint")
+		ce.Reply("Failed to send waypoint: %v", err)
+		return
+	}
+	switch action {
+	case "delete", "remove":
+		ce.Reply("Waypoint `%d` deleted", waypoint.ID)
+	case "lock":
+		ce.Reply("Waypoint `%d` locked", waypoint.ID)
+	case "unlock":
+		ce.Reply("Waypoint `%d` unlocked", waypoint.ID)
+	default:
+		ce.Reply("Waypoint `%d` sent", waypoint.ID)
+	}
+}
@@ -2,25 +2,47 @@ package connector
 
 import (
 	_ "embed"
+	"encoding/base64"
 	"fmt"
+	"os"
+	"strings"
 
+	"github.com/kabili207/matrix-meshtastic/pkg/connector/meshdb"
 	"github.com/kabili207/matrix-meshtastic/pkg/meshid"
 	"go.mau.fi/util/configupgrade"
+	"go.mau.fi/util/random"
+	"maunium.net/go/mautrix/id"
 )
 
 //go:embed example-config.yml
 var ExampleConfig string
 
 type Config struct {
-	LongName            string        `yaml:"long_name"`
-	ShortName           string        `yaml:"short_name"`
-	HopLimit            uint32        `yaml:"hop_limit"`
-	PrimaryChannel      ChannelConfig `yaml:"primary_channel"`
-	UDP                 bool          `yaml:"udp"`
-	Mqtt                MqttConfig    `yaml:"mqtt"`
-	InactivityThreshold int           `yaml:"inactivity_threshold_days"`
+	LongName            string           `yaml:"long_name"`
+	ShortName           string           `yaml:"short_name"`
+	HopLimit            uint32           `yaml:"hop_limit"`
+	PrimaryChannel      ChannelConfig    `yaml:"primary_channel"`
+	Channels            []BridgedChannel `yaml:"channels"`
+	ShowChannelKeys     bool             `yaml:"show_channel_keys"`
+	LicensedMode        bool             `yaml:"licensed_mode"`
+	DMEncryption        string           `yaml:"dm_encryption"`
+	DMKeyTimeout        int              `yaml:"dm_key_timeout_seconds"`
+	UDP                 bool             `yaml:"udp"`
+	Mqtt                MqttConfig       `yaml:"mqtt"`
+	InactivityThreshold int              `yaml:"inactivity_threshold_days"`
+	CompressText        bool             `yaml:"compress_text"`
+	MessageSplitting    SplitConfig      `yaml:"message_splitting"`
+	MessageReassembly   ReassemblyConfig `yaml:"message_reassembly"`
+	Waypoints           WaypointConfig   `yaml:"waypoints"`
+	PositionHistory     PositionConfig   `yaml:"position_history"`
+
+	KeyEncryptionKey          string   `yaml:"key_encryption_key"`
+	PreviousKeyEncryptionKeys []string `yaml:"previous_key_encryption_keys"`
 }
 
+// The environment variable that overrides the key_encryption_key config option
+const kekEnvVar = "MESHTASTIC_KEY_ENCRYPTION_KEY"
+
 type MqttConfig struct {
 	Enabled   bool   `yaml:"enabled"`
 	Uri       string `yaml:"server"`
@@ -29,11 +51,55 @@ type MqttConfig struct {
 	RootTopic string `yaml:"root_topic"`
 }
 
+type SplitConfig struct {
+	Enabled      bool `yaml:"enabled"`
+	Numbered     bool `yaml:"numbered"`
+	DelaySeconds int  `yaml:"delay_seconds"`
+	MaxParts     int  `yaml:"max_parts"`
+}
+
+type ReassemblyConfig struct {
+	Enabled        bool `yaml:"enabled"`
+	TimeoutSeconds int  `yaml:"timeout_seconds"`
+}
+
+type WaypointConfig struct {
+	ExpiredAction      string `yaml:"expired_action"`
+	InactiveAuthorDays int    `yaml:"inactive_author_days"`
+	ExpiryWarningHours int    `yaml:"expiry_warning_hours"`
+}
+
+type PositionConfig struct {
+	Enabled       bool `yaml:"enabled"`
+	RetentionDays int  `yaml:"retention_days"`
+	MaxPerNode    int  `yaml:"max_per_node"`
+}
+
 type ChannelConfig struct {
 	Name string `yaml:"name"`
 	Key  string `yaml:"key"`
 }
 
+// BridgedChannel is a channel the bridge carries regardless of which portals exist
+type BridgedChannel struct {
+	ChannelConfig    `yaml:",inline"`
+	AutoCreatePortal bool      `yaml:"auto_create_portal"`
+	Uplink           *bool     `yaml:"uplink"`
+	Downlink         *bool     `yaml:"downlink"`
+	Precision        *uint32   `yaml:"position_precision"`
+	Space            id.RoomID `yaml:"space"`
+}
+
+// UplinkEnabled checks if packets from the mesh are bridged to Matrix
+func (bc *BridgedChannel) UplinkEnabled() bool {
+	return bc.Uplink == nil || *bc.Uplink
+}
+
+// DownlinkEnabled checks if messages from Matrix are sent to the mesh
+func (bc *BridgedChannel) DownlinkEnabled() bool {
+	return bc.Downlink == nil || *bc.Downlink
+}
+
 func upgradeConfig(helper configupgrade.Helper) {
 	helper.Copy(configupgrade.Str, "long_name")
 	helper.Copy(configupgrade.Str, "short_name")
@@ -41,12 +107,99 @@ func upgradeConfig(helper configupgrade.Helper) {
 	helper.Copy(configupgrade.Bool, "udp")
 	helper.Copy(configupgrade.Str, "primary_channel", "name")
 	helper.Copy(configupgrade.Str, "primary_channel", "key")
+	helper.Copy(configupgrade.List, "channels")
+	helper.Copy(configupgrade.Bool, "show_channel_keys")
+	helper.Copy(configupgrade.Bool, "licensed_mode")
+	helper.Copy(configupgrade.Str, "dm_encryption")
+	helper.Copy(configupgrade.Int, "dm_key_timeout_seconds")
 	helper.Copy(configupgrade.Bool, "mqtt", "enabled")
 	helper.Copy(configupgrade.Str, "mqtt", "server")
 	helper.Copy(configupgrade.Str, "mqtt", "username")
 	helper.Copy(configupgrade.Str, "mqtt", "password")
 	helper.Copy(configupgrade.Str, "mqtt", "root_topic")
 	helper.Copy(configupgrade.Int, "inactivity_threshold_days")
+	helper.Copy(configupgrade.Bool, "compress_text")
+	helper.Copy(configupgrade.Bool, "message_splitting", "enabled")
+	helper.Copy(configupgrade.Bool, "message_splitting", "numbered")
+	helper.Copy(configupgrade.Int, "message_splitting", "delay_seconds")
+	helper.Copy(configupgrade.Int, "message_splitting", "max_parts")
+	helper.Copy(configupgrade.Bool, "message_reassembly", "enabled")
+	helper.Copy(configupgrade.Int, "message_reassembly", "timeout_seconds")
+	helper.Copy(configupgrade.Str, "waypoints", "expired_action")
+	helper.Copy(configupgrade.Int, "waypoints", "inactive_author_days")
+	helper.Copy(configupgrade.Int, "waypoints", "expiry_warning_hours")
+	helper.Copy(configupgrade.Bool, "position_history", "enabled")
+	helper.Copy(configupgrade.Int, "position_history", "retention_days")
+	helper.Copy(configupgrade.Int, "position_history", "max_per_node")
+	// A key is only generated when asked for, as new configs do. If the key is missing from an
+	// existing config, it stays empty so the bridge refuses to start instead of replacing a lost key
+	if secret, ok := helper.Get(configupgrade.Str, "key_encryption_key"); ok && secret == "generate" {
+		helper.Set(configupgrade.Str, base64.StdEncoding.EncodeToString(random.Bytes(meshdb.KEKLength)), "key_encryption_key")
+	} else if !ok {
+		helper.Set(configupgrade.Str, "", "key_encryption_key")
+	} else {
+		helper.Copy(configupgrade.Str, "key_encryption_key")
+	}
+	helper.Copy(configupgrade.List, "previous_key_encryption_keys")
+}
+
+func parseKEK(name, value string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(key) != meshdb.KEKLength {
+		return nil, fmt.Errorf("%s must be %d random bytes encoded as base64, such as the output of `openssl rand -base64 %d`", name, meshdb.KEKLength, meshdb.KEKLength)
+	}
+	return key, nil
+}
+
+// getKeyEncryptionKeys returns the key used to encrypt the private keys of managed nodes,
+// along with the keys that were used previously
+func (c *Config) getKeyEncryptionKeys() (current []byte, previous [][]byte, err error) {
+	name, value := "key_encryption_key", c.KeyEncryptionKey
+	if env := os.Getenv(kekEnvVar); env != "" {
+		name, value = kekEnvVar, env
+	}
+	if value == "" || value == "generate" {
+		return nil, nil, fmt.Errorf("a key-encryption key is required to protect the private keys of managed nodes. "+
+			"Set key_encryption_key in the config or the %s environment variable. If no private keys have been "+
+			"encrypted yet, key_encryption_key can be set to generate to create a new one", kekEnvVar)
+	}
+	if current, err = parseKEK(name, value); err != nil {
+		return nil, nil, err
+	}
+	for _, p := range c.PreviousKeyEncryptionKeys {
+		key, err := parseKEK("previous_key_encryption_keys", p)
+		if err != nil {
+			return nil, nil, err
+		}
+		previous = append(previous, key)
+	}
+	return current, previous, nil
+}
+
+func (c *Config) validateChannels() error {
+	seen := map[string]bool{}
+	for i, ch := range c.Channels {
+		if ch.Name == "" {
+			return fmt.Errorf("channels[%d].name is required", i)
+		} else if len([]byte(ch.Name)) > 11 {
+			return fmt.Errorf("channels[%d].name must be at most 11 bytes", i)
+		}
+		chanDef, err := meshid.NewChannelDef(ch.Name, &ch.Key)
+		if err != nil {
+			return fmt.Errorf("channels[%d].key is invalid: %w", i, err)
+		}
+		if ch.Precision != nil && *ch.Precision > 32 {
+			return fmt.Errorf("channels[%d].position_precision must be between 0 and 32", i)
+		}
+		if ch.Space != "" && !strings.HasPrefix(string(ch.Space), "!") {
+			return fmt.Errorf("channels[%d].space must be a room ID", i)
+		}
+		if seen[channelConfigKey(chanDef)] {
+			return fmt.Errorf("channel %s is listed more than once in channels", ch.Name)
+		}
+		seen[channelConfigKey(chanDef)] = true
+	}
+	return nil
 }
 
 func (mc *MeshtasticConnector) GetConfig() (example string, data any, upgrader configupgrade.Upgrader) {
@@ -66,6 +219,33 @@ func (c *MeshtasticConnector) ValidateConfig() error {
 	if c.Config.HopLimit >= meshid.MAX_HOPS {
 		return fmt.Errorf("hop_limit must be less than %d", meshid.MAX_HOPS)
 	}
+	if c.Config.MessageSplitting.Enabled && c.Config.MessageSplitting.MaxParts < 2 {
+		return fmt.Errorf("message_splitting.max_parts must be at least 2")
+	}
+	if c.Config.MessageSplitting.DelaySeconds < 0 {
+		return fmt.Errorf("message_splitting.delay_seconds must not be negative")
+	}
+	if c.Config.MessageReassembly.Enabled && c.Config.MessageReassembly.TimeoutSeconds <= 0 {
+		return fmt.Errorf("message_reassembly.timeout_seconds must be greater than 0")
+	}
+	if c.Config.Waypoints.ExpiredAction != "redact" && c.Config.Waypoints.ExpiredAction != "notice" {
+		return fmt.Errorf("waypoints.expired_action must be either redact or notice")
+	}
+	if c.Config.PositionHistory.RetentionDays < 0 || c.Config.PositionHistory.MaxPerNode < 0 {
+		return fmt.Errorf("position_history limits must not be negative")
+	}
+	if !meshid.IsValidDMEncryption(c.Config.DMEncryption) {
+		return fmt.Errorf("dm_encryption must be require_pki, prefer_pki or allow_psk")
+	}
+	if c.Config.DMKeyTimeout <= 0 {
+		return fmt.Errorf("dm_key_timeout_seconds must be greater than 0")
+	}
+	if err := c.Config.validateChannels(); err != nil {
+		return err
+	}
+	if _, _, err := c.Config.getKeyEncryptionKeys(); err != nil {
+		return err
+	}
 	if !c.Config.UDP && !c.Config.Mqtt.Enabled {
 		return fmt.Errorf("at least one connection method must be enabled")
 	}
@@ -4,7 +4,11 @@ import (
 	"context"
 	_ "embed"
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"log/slog"
+	"sync"
+	"time"
 
 	"github.com/kabili207/matrix-meshtastic/pkg/connector/meshdb"
 	"github.com/kabili207/matrix-meshtastic/pkg/mesh"
@@ -19,16 +23,29 @@ import (
 )
 
 type MeshtasticConnector struct {
-	log              zerolog.Logger
-	bridge           *bridgev2.Bridge
-	Config           Config
-	meshDB           *meshdb.Database
-	baseNodeID       meshid.NodeID
-	meshClient       *mesh.MeshtasticClient
-	MsgConv          *msgconv.MessageConverter
-	managedNodeCache map[meshid.NodeID]bool
-	bgTaskCanceller  context.CancelFunc
+	log               zerolog.Logger
+	bridge            *bridgev2.Bridge
+	Config            Config
+	meshDB            *meshdb.Database
+	baseNodeID        meshid.NodeID
+	meshClient        *mesh.MeshtasticClient
+	MsgConv           *msgconv.MessageConverter
+	managedNodeCache  map[meshid.NodeID]bool
+	managedNodeLock   sync.RWMutex
+	bgTaskCanceller   context.CancelFunc
 	tracerouteTracker *TracerouteTracker
+	rangeTestTracker  *RangeTestTracker
+	lastPositions     map[meshid.NodeID]lastPosition
+	lastPositionSweep time.Time
+	positionLock      sync.RWMutex
+	beacons           map[beaconKey]*liveBeacon
+	beaconLock        sync.Mutex
+	channelConfigs    map[string]*BridgedChannel
+	keyWaiters        map[meshid.NodeID][]chan struct{}
+	keyWaiterLock     sync.Mutex
+	preciseLocations  preciseLocationConfirmations
+	channelActivity   channelActivity
+	reassembler       *MessageReassembler
 }
 
 var _ bridgev2.NetworkConnector = (*MeshtasticConnector)(nil)
@@ -39,6 +56,12 @@ func NewMeshtasticConnector(log zerolog.Logger) *MeshtasticConnector {
 		log:               log.With().Str("component", "network-connector").Logger(),
 		managedNodeCache:  map[meshid.NodeID]bool{},
 		tracerouteTracker: NewTracerouteTracker(),
+		rangeTestTracker:  NewRangeTestTracker(),
+		lastPositions:     map[meshid.NodeID]lastPosition{},
+		beacons:           map[beaconKey]*liveBeacon{},
+		keyWaiters:        map[meshid.NodeID][]chan struct{}{},
+		preciseLocations:  preciseLocationConfirmations{pending: map[string]time.Time{}},
+		channelActivity:   channelActivity{lastHeard: map[string]map[meshid.NodeID]time.Time{}, started: time.Now()},
 	}
 }
 
@@ -46,6 +69,7 @@ func (c *MeshtasticConnector) Init(bridge *bridgev2.Bridge) {
 	c.meshDB = meshdb.New(bridge.DB.Database, bridge.Log.With().Str("db_section", "meshtastic").Logger())
 	c.bridge = bridge
 	c.MsgConv = msgconv.New(bridge, c.meshDB)
+	c.MsgConv.UserNodeID = c.getUserNodeID
 	c.log = c.bridge.Log
 	if c.managedNodeCache == nil {
 		c.managedNodeCache = map[meshid.NodeID]bool{}
@@ -53,8 +77,17 @@ func (c *MeshtasticConnector) Init(bridge *bridgev2.Bridge) {
 	if c.tracerouteTracker == nil {
 		c.tracerouteTracker = NewTracerouteTracker()
 	}
+	if c.rangeTestTracker == nil {
+		c.rangeTestTracker = NewRangeTestTracker()
+	}
+	if c.lastPositions == nil {
+		c.lastPositions = map[meshid.NodeID]lastPosition{}
+	}
+	if c.beacons == nil {
+		c.beacons = map[beaconKey]*liveBeacon{}
+	}
 
-	c.bridge.Commands.(*commands.Processor).AddHandlers(cmdJoinChannel, cmdUpdateNames, cmdNodeInfo, cmdTraceroute)
+	c.bridge.Commands.(*commands.Processor).AddHandlers(cmdJoinChannel, cmdJoinURL, cmdChannelURL, cmdLeaveChannel, cmdChannels, cmdRekeyChannel, cmdUpdateNames, cmdNodeInfo, cmdTraceroute, cmdRangeTest, cmdPortalSetting, cmdShareLocation, cmdWaypoint, cmdTrack, cmdTrustKey, cmdVerify, cmdExportIdentity, cmdImportKeyPair, cmdIdentity, cmdLicensed, cmdDMEncryption, cmdMaxPositionPrecision, cmdRotateKEK)
 
 	slogger := slog.New(slogzerolog.Option{Level: slog.LevelInfo, Logger: &c.log}.NewZerologHandler())
 	slog.SetDefault(slogger)
@@ -86,12 +119,15 @@ func (c *MeshtasticConnector) GetBaseNodeID() meshid.NodeID {
 }
 
 func (c *MeshtasticConnector) IsManagedNode(nodeID meshid.NodeID) bool {
-	if v, ok := c.managedNodeCache[nodeID]; ok {
+	c.managedNodeLock.RLock()
+	v, ok := c.managedNodeCache[nodeID]
+	c.managedNodeLock.RUnlock()
+	if ok {
 		return v
 	}
 	baseNode := c.GetBaseNodeID()
 	if nodeID == baseNode {
-		c.managedNodeCache[nodeID] = true
+		c.cacheManagedNode(nodeID, true)
 		return true
 	}
 	ctx := context.Background()
@@ -100,16 +136,29 @@ func (c *MeshtasticConnector) IsManagedNode(nodeID meshid.NodeID) bool {
 		return false
 	}
 	if ghost == nil {
-		c.managedNodeCache[nodeID] = false
+		c.cacheManagedNode(nodeID, false)
 		return false
 	}
 	meta, ok := ghost.Metadata.(*meshid.GhostMetadata)
 	isManaged := ok && meta.UserMXID != ""
-	c.managedNodeCache[nodeID] = isManaged
+	c.cacheManagedNode(nodeID, isManaged)
 
 	return isManaged
 }
 
+func (c *MeshtasticConnector) cacheManagedNode(nodeID meshid.NodeID, isManaged bool) {
+	c.managedNodeLock.Lock()
+	defer c.managedNodeLock.Unlock()
+	c.managedNodeCache[nodeID] = isManaged
+}
+
+// forgetManagedNode removes a node from the managed node cache, so it's looked up again when next needed
+func (c *MeshtasticConnector) forgetManagedNode(nodeID meshid.NodeID) {
+	c.managedNodeLock.Lock()
+	defer c.managedNodeLock.Unlock()
+	delete(c.managedNodeCache, nodeID)
+}
+
 func (tc *MeshtasticConnector) GetCapabilities() *bridgev2.NetworkGeneralCapabilities {
 	return &bridgev2.NetworkGeneralCapabilities{
 		DisappearingMessages: false,
@@ -145,6 +194,21 @@ func (c *MeshtasticConnector) Start(ctx context.Context) error {
 
 	c.meshDB.Upgrade(ctx)
 
+	current, previous, err := c.Config.getKeyEncryptionKeys()
+	if err != nil {
+		return err
+	} else if err = c.meshDB.Keys.SetKeys(current, previous...); err != nil {
+		return err
+	}
+	if count, err := c.meshDB.MeshNodeInfo.EncryptPrivateKeys(ctx, false); errors.Is(err, meshdb.ErrUnknownKEK) {
+		return fmt.Errorf("the stored private keys were encrypted with a different key-encryption key. Restore the "+
+			"original key_encryption_key, or list it in previous_key_encryption_keys and run rotate-kek: %w", err)
+	} else if err != nil {
+		return fmt.Errorf("failed to encrypt stored private keys: %w", err)
+	} else if count > 0 {
+		c.log.Info().Int("count", count).Msg("Encrypted private keys that were stored in plain text")
+	}
+
 	c.meshClient = mesh.NewMeshtasticClient(c.GetBaseNodeID(), c.log.With().Logger())
 	c.meshClient.SetHopLimit(c.Config.HopLimit)
 
@@ -155,10 +219,16 @@ func (c *MeshtasticConnector) Start(ctx context.Context) error {
 		c.meshClient.AddMQTTHandler(c.Config.Mqtt.Uri, c.Config.Mqtt.Username, c.Config.Mqtt.Password, c.Config.Mqtt.RootTopic)
 	}
 	c.meshClient.SetIsManagedNodeHandler(c.IsManagedNode)
+	c.meshClient.SetCallsignHandler(c.getCallsign)
 	c.meshClient.SetOnDisconnectHandler(c.onMeshDisconnected)
 	c.meshClient.SetOnConnectHandler(c.onMeshConnected)
 	c.meshClient.AddEventHandler(c.handleGlobalMeshEvent)
 	c.meshClient.SetPrimaryChannel(c.Config.PrimaryChannel.Name, c.Config.PrimaryChannel.Key)
+	c.loadConfiguredChannels()
+	if c.Config.MessageReassembly.Enabled {
+		timeout := time.Duration(c.Config.MessageReassembly.TimeoutSeconds) * time.Second
+		c.reassembler = NewMessageReassembler(timeout, handleReassembledMessage)
+	}
 	c.meshClient.SetPrivateKeyRequestHandler(func(nodeID meshid.NodeID) (key *string) {
 		raw, err := c.getGhostPrivateKey(context.Background(), nodeID)
 		if err != nil || len(raw) == 0 {
@@ -199,6 +269,11 @@ func (c *MeshtasticConnector) Stop(ctx context.Context) error {
 		c.bgTaskCanceller()
 	}
 
+	c.rangeTestTracker.StopAll()
+	if c.reassembler != nil {
+		c.reassembler.Flush()
+	}
+
 	if c.meshClient != nil {
 		c.meshClient.Disconnect()
 	}
@@ -206,13 +281,14 @@ func (c *MeshtasticConnector) Stop(ctx context.Context) error {
 }
 
 func (c *MeshtasticConnector) LoadUserLogin(ctx context.Context, login *bridgev2.UserLogin) error {
-	login.Client = &MeshtasticClient{
+	client := &MeshtasticClient{
 		UserLogin:  login,
 		MeshClient: c.meshClient,
 		log:        c.log.With().Str("user_id", string(login.ID)).Logger(),
 		bridge:     c.bridge,
 		main:       c,
 	}
+	login.Client = client
 	return nil
 }
 
@@ -251,4 +327,8 @@ func (c *MeshtasticConnector) onMeshConnected(isReconnect bool) {
 	c.bgTaskCanceller = cancelFunc
 	c.RunNodeInfoTask(bgContext)
 	c.RunInactiveCleanupTask(bgContext)
+	c.RunWaypointCleanupTask(bgContext)
+	c.RunPositionPruneTask(bgContext)
+	c.RunMessageAliasPruneTask(bgContext)
+	c.RunChannelTopicTask(bgContext)
 }
@@ -0,0 +1,125 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/kabili207/matrix-meshtastic/pkg/meshid"
+	"go.mau.fi/util/ptr"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/simplevent"
+)
+
+var errNoPublicKey = errors.New("the public key of this node isn't known, and direct messages require PKI. " +
+	"The node was asked for its key, try again once it has replied")
+
+// getDMEncryption returns the DM encryption policy of a managed node
+func (c *MeshtasticConnector) getDMEncryption(nodeID meshid.NodeID) string {
+	if meta := c.getManagedNodeMeta(nodeID); meta != nil && meta.DMEncryption != "" {
+		return meta.DMEncryption
+	}
+	return c.Config.DMEncryption
+}
+
+func dmEncryptionLabel(policy string) string {
+	switch policy {
+	case meshid.DMEncryptionRequirePKI:
+		return "🔒 PKI required"
+	case meshid.DMEncryptionPreferPKI:
+		return "PKI preferred"
+	default:
+		return "⚠️ Channel key allowed"
+	}
+}
+
+// waitForPublicKey asks a node for its node info, then waits until its public key arrives
+func (c *MeshtasticConnector) waitForPublicKey(ctx context.Context, fromNode, targetNode meshid.NodeID) ([]byte, error) {
+	ch := make(chan struct{})
+	c.keyWaiterLock.Lock()
+	c.keyWaiters[targetNode] = append(c.keyWaiters[targetNode], ch)
+	c.keyWaiterLock.Unlock()
+	defer func() {
+		c.keyWaiterLock.Lock()
+		c.keyWaiters[targetNode] = slices.DeleteFunc(c.keyWaiters[targetNode], func(w chan struct{}) bool { return w == ch })
+		if len(c.keyWaiters[targetNode]) == 0 {
+			delete(c.keyWaiters, targetNode)
+		}
+		c.keyWaiterLock.Unlock()
+	}()
+
+	c.sendNodeInfo(fromNode, targetNode, true)
+	select {
+	case <-ch:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(time.Duration(c.Config.DMKeyTimeout) * time.Second):
+		return nil, fmt.Errorf("%s didn't send its public key in time", targetNode)
+	}
+	return c.getGhostPublicKey(ctx, targetNode)
+}
+
+// notifyPublicKey wakes up the messages waiting for the public key of a node
+func (c *MeshtasticConnector) notifyPublicKey(nodeID meshid.NodeID) {
+	c.keyWaiterLock.Lock()
+	defer c.keyWaiterLock.Unlock()
+	for _, ch := range c.keyWaiters[nodeID] {
+		close(ch)
+	}
+	delete(c.keyWaiters, nodeID)
+}
+
+// useDMEncryption decides whether a direct message is sent with PKI, following the DM encryption
+// policy of the sender. Since messages in a portal are handled in order, later messages wait too
+func (c *MeshtasticConnector) useDMEncryption(ctx context.Context, fromNode, targetNode meshid.NodeID) (usePKI bool, err error) {
+	if c.getCallsign(fromNode) != "" {
+		// Licensed operators can't use PKI, which sendBytes enforces for the channel key as well
+		return false, nil
+	}
+	if pubKey, err := c.getGhostPublicKey(ctx, targetNode); err == nil && len(pubKey) > 0 {
+		return true, nil
+	}
+	policy := c.getDMEncryption(fromNode)
+	if policy == meshid.DMEncryptionAllowPSK {
+		return false, nil
+	}
+	pubKey, err := c.waitForPublicKey(ctx, fromNode, targetNode)
+	if err == nil && len(pubKey) > 0 {
+		return true, nil
+	} else if policy == meshid.DMEncryptionPreferPKI {
+		c.log.Debug().AnErr("error", err).Stringer("node_id", targetNode).Msg("Public key didn't arrive, falling back to the channel key")
+		return false, nil
+	}
+	return false, errNoPublicKey
+}
+
+// updateDMTopics updates the topics of the DM portals of a login, after its DM encryption policy changed
+func (c *MeshtasticConnector) updateDMTopics(ctx context.Context, login *bridgev2.UserLogin) error {
+	portals, err := c.bridge.GetAllPortalsWithMXID(ctx)
+	if err != nil {
+		return err
+	}
+	for _, p := range portals {
+		if p.RoomType != database.RoomTypeDM || p.Receiver != login.ID {
+			continue
+		}
+		remoteNode, synthNode, err := meshid.ParseDMPortalID(p.ID)
+		if err != nil {
+			continue
+		}
+		login.QueueRemoteEvent(&simplevent.ChatInfoChange{
+			EventMeta: simplevent.EventMeta{
+				Type:      bridgev2.RemoteEventChatInfoChange,
+				PortalKey: p.PortalKey,
+				Timestamp: time.Now(),
+			},
+			ChatInfoChange: &bridgev2.ChatInfoChange{
+				ChatInfo: &bridgev2.ChatInfo{Topic: ptr.Ptr(c.dmTopic(ctx, synthNode, remoteNode))},
+			},
+		})
+	}
+	return nil
+}
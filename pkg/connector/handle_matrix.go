@@ -42,17 +42,20 @@ func (c *MeshtasticClient) HandleMatrixMessage(ctx context.Context, msg *bridgev
 		return nil, nil
 	}
 
-	fromNode := meshid.MXIDToNodeID(msg.Event.Sender)
+	fromNode := c.senderNodeID(ctx, msg.Event.Sender)
+	callsign := c.main.getCallsign(fromNode)
 	channel := c.main.meshClient.GetPrimaryChannel()
 	messIDSender := ""
 	targetNode := meshid.BROADCAST_ID
 	usePKI := false
+	var chanCfg *BridgedChannel
 
 	switch msg.Portal.Portal.RoomType {
 	case database.RoomTypeDefault:
 		channel, err = meshid.ChannelDefFromPortalID(msg.Portal.ID)
 		if err == nil {
 			messIDSender = channel.GetName()
+			chanCfg = c.main.getChannelConfig(channel)
 		}
 	case database.RoomTypeDM:
 		targetNode, _, err = meshid.ParseDMPortalID(msg.Portal.ID)
@@ -63,9 +66,6 @@ func (c *MeshtasticClient) HandleMatrixMessage(ctx context.Context, msg *bridgev
 				}
 			}
 			messIDSender = targetNode.String()
-			if pubKey, err := c.main.getGhostPublicKey(ctx, targetNode); err == nil && len(pubKey) > 0 {
-				usePKI = true
-			}
 		}
 	default:
 		err = fmt.Errorf("unsupported room type: %s", msg.Portal.Portal.RoomType)
@@ -78,6 +78,27 @@ func (c *MeshtasticClient) HandleMatrixMessage(ctx context.Context, msg *bridgev
 			Msg("Failed to parse portal ID, ignoring message")
 		return nil, nil
 	}
+	if chanCfg != nil && !chanCfg.DownlinkEnabled() {
+		return nil, bridgev2.WrapErrorInStatus(errDownlinkDisabled).WithErrorAsMessage().WithIsCertain(true).WithSendNotice(true)
+	}
+	if msg.Portal.Portal.RoomType == database.RoomTypeDefault {
+		if callsign != "" && len(channel.GetKeyBytes()) > 0 {
+			err = errLicensedEncryptedChannel
+		} else {
+			err = c.main.checkUnencryptedSender(ctx, channel, fromNode)
+		}
+		if err != nil {
+			return nil, bridgev2.WrapErrorInStatus(err).WithErrorAsMessage().WithIsCertain(true).WithSendNotice(true)
+		}
+	}
+	if msg.Portal.Portal.RoomType == database.RoomTypeDM {
+		if err = c.main.ensureKeyTrusted(ctx, targetNode); err != nil {
+			return nil, bridgev2.WrapErrorInStatus(err).WithErrorAsMessage().WithIsCertain(true).WithSendNotice(true)
+		}
+		if usePKI, err = c.main.useDMEncryption(ctx, fromNode, targetNode); err != nil {
+			return nil, bridgev2.WrapErrorInStatus(err).WithErrorAsMessage().WithIsCertain(true).WithSendNotice(true)
+		}
+	}
 
 	packetId, geouri, err := uint32(0), (*meshid.GeoURI)(nil), nil
 	switch msg.Content.MsgType {
@@ -87,14 +108,19 @@ func (c *MeshtasticClient) HandleMatrixMessage(ctx context.Context, msg *bridgev
 		if msg.ReplyTo != nil {
 			_, replyID, _ = meshid.ParseMessageID(msg.ReplyTo.ID)
 		}
-		packetId, err = c.MeshClient.SendMessage(fromNode, targetNode, channel, content, replyID, usePKI)
+		compress := getPortalMetadata(msg.Portal).ShouldCompressText(c.main.Config.CompressText)
+		packetId, err = c.sendTextMessage(ctx, fromNode, targetNode, channel, content, replyID, usePKI, compress, msg.Event.RoomID, messIDSender)
 	case event.MsgLocation:
 		geouri, err = meshid.ParseGeoURI(msg.Content.GeoURI)
 		if err != nil {
 			return nil, bridgev2.WrapErrorInStatus(err).WithErrorAsMessage().WithIsCertain(true).WithSendNotice(true)
 		}
+		var precision uint32
+		if precision, err = c.checkLocationPrecision(msg, chanCfg, channel, fromNode, geouri); err != nil {
+			return nil, bridgev2.WrapErrorInStatus(err).WithErrorAsMessage().WithIsCertain(true).WithSendNotice(true)
+		}
 		ts := time.UnixMilli(msg.Event.Timestamp)
-		packetId, err = c.MeshClient.SendPosition(fromNode, targetNode, *geouri, &ts)
+		packetId, err = c.MeshClient.SendPosition(fromNode, targetNode, channel, *geouri, &ts, precision, usePKI)
 
 	default:
 		return nil, bridgev2.ErrUnsupportedMessageType
@@ -139,7 +165,7 @@ func (c *MeshtasticClient) postMessageSave(mxid id.UserID, roomId id.RoomID) fun
 		}
 
 		if !ghost.NameSet {
-			nodeID := meshid.MXIDToNodeID(mxid)
+			nodeID, _ := meshid.ParseUserID(m.SenderID)
 			longName, shortName := nodeID.GetDefaultNodeNames()
 			if strings.TrimSpace(u.Displayname) != "" {
 				longName = TruncateString(strings.TrimSpace(u.Displayname), 39)
@@ -200,6 +226,8 @@ func (c *MeshtasticConnector) UpdateGhostMeshNames(ctx context.Context, userID n
 	if err := nodeInfo.SetAll(ctx); err != nil {
 		return err
 	}
+	// The node may have been cached as unmanaged before the ghost was linked to the Matrix user
+	c.forgetManagedNode(nodeID)
 
 	return c.meshClient.SendNodeInfo(nodeID, meshid.BROADCAST_ID, longName, shortName, false, nodeInfo.PublicKey)
 }
@@ -227,6 +255,9 @@ func (c *MeshtasticConnector) updateDMPortalInfo(ctx context.Context, ghost *bri
 	for _, p := range portals {
 		ci := &bridgev2.ChatInfo{}
 		c.setDMNames(ci, ghost)
+		if remoteNode, synthNode, err := meshid.ParseDMPortalID(p.ID); err == nil {
+			ci.Topic = ptr.Ptr(c.dmTopic(ctx, synthNode, remoteNode))
+		}
 		loginsInPortal, err := p.Bridge.GetUserLoginsInPortal(ctx, p.PortalKey)
 		if err != nil {
 			c.log.Err(err).Str("node", string(ghost.ID)).Msg("Failed to get user logins in portal")
@@ -253,6 +284,8 @@ func (c *MeshtasticConnector) updateDMPortalInfo(ctx context.Context, ghost *bri
 func (c *MeshtasticConnector) getGhostPublicKey(ctx context.Context, nodeID meshid.NodeID) ([]byte, error) {
 	if nodeInfo, err := c.meshDB.MeshNodeInfo.GetByNodeID(ctx, nodeID); err != nil {
 		return nil, err
+	} else if nodeInfo == nil {
+		return nil, errors.New("unknown node")
 	} else if len(nodeInfo.PublicKey) > 0 {
 		return nodeInfo.PublicKey, nil
 	} else if nodeInfo.IsManaged {
@@ -289,13 +322,13 @@ func (c *MeshtasticConnector) getGhostPrivateKey(ctx context.Context, nodeID mes
 		if err != nil {
 			return nil, err
 		}
-		return pub, nil
+		return priv, nil
 	}
 	return nil, errors.New("no private key found")
 }
 
 func (c *MeshtasticClient) PreHandleMatrixReaction(ctx context.Context, msg *bridgev2.MatrixReaction) (bridgev2.MatrixReactionPreResponse, error) {
-	fromNode := meshid.MXIDToNodeID(msg.Event.Sender)
+	fromNode := c.senderNodeID(ctx, msg.Event.Sender)
 	return bridgev2.MatrixReactionPreResponse{
 		SenderID: meshid.MakeUserID(fromNode),
 		EmojiID:  networkid.EmojiID(msg.Content.RelatesTo.Key),
@@ -318,10 +351,15 @@ func (c *MeshtasticClient) HandleMatrixReaction(ctx context.Context, msg *bridge
 	switch msg.Portal.Portal.RoomType {
 	case database.RoomTypeDefault:
 		channel, err = meshid.ChannelDefFromPortalID(msg.Portal.ID)
+		if err == nil {
+			if cfg := c.main.getChannelConfig(channel); cfg != nil && !cfg.DownlinkEnabled() {
+				err = errDownlinkDisabled
+			}
+		}
 	case database.RoomTypeDM:
 		targetNode, _, err = meshid.ParseDMPortalID(msg.Portal.ID)
-		if pubKey, err := c.main.getGhostPublicKey(ctx, targetNode); err == nil && len(pubKey) > 0 {
-			usePKI = true
+		if err == nil {
+			err = c.main.ensureKeyTrusted(ctx, targetNode)
 		}
 	default:
 		err = fmt.Errorf("unsupported room type: %s", msg.Portal.Portal.RoomType)
@@ -335,6 +373,19 @@ func (c *MeshtasticClient) HandleMatrixReaction(ctx context.Context, msg *bridge
 	if err != nil {
 		return nil, err
 	}
+	callsign := c.main.getCallsign(fromNode)
+	if msg.Portal.Portal.RoomType == database.RoomTypeDefault {
+		if callsign != "" && len(channel.GetKeyBytes()) > 0 {
+			return nil, errLicensedEncryptedChannel
+		} else if err = c.main.checkUnencryptedSender(ctx, channel, fromNode); err != nil {
+			return nil, err
+		}
+	}
+	if msg.Portal.Portal.RoomType == database.RoomTypeDM {
+		if usePKI, err = c.main.useDMEncryption(ctx, fromNode, targetNode); err != nil {
+			return nil, err
+		}
+	}
 	_, err = c.MeshClient.SendReaction(fromNode, targetNode, channel, packetID, pre.Emoji, usePKI)
 	return &database.Reaction{}, err
 }
@@ -343,7 +394,7 @@ func (c *MeshtasticClient) UpdateLastSeenDate(ctx context.Context, sender id.Use
 	if c.bridge.IsGhostMXID(sender) {
 		return
 	}
-	nodeID := meshid.MXIDToNodeID(sender)
+	nodeID := c.senderNodeID(ctx, sender)
 	uid := meshid.MakeUserID(nodeID)
 	_, err := c.bridge.GetGhostByID(ctx, uid)
 	if err != nil {
@@ -6,6 +6,7 @@ import (
 	"html"
 	"regexp"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -27,6 +28,7 @@ var (
 
 // Handles events that are more general to the connector
 func (c *MeshtasticConnector) handleGlobalMeshEvent(rawEvt any) {
+	c.recordChannelActivity(rawEvt)
 
 	switch evt := rawEvt.(type) {
 	case *mesh.MeshNodeInfoEvent:
@@ -39,6 +41,10 @@ func (c *MeshtasticConnector) handleGlobalMeshEvent(rawEvt any) {
 		c.handleMeshWaypoint(evt)
 	case *mesh.MeshTracerouteEvent:
 		c.handleMeshTraceroute(evt)
+	case *mesh.MeshRangeTestEvent:
+		c.handleMeshRangeTest(evt)
+	case *mesh.MeshKeyVerificationEvent:
+		c.handleMeshKeyVerification(evt)
 	case *mesh.MeshEvent:
 		c.handleUnknownPacket(evt)
 	}
@@ -52,6 +58,10 @@ func (c *MeshtasticClient) handleMeshEvent(rawEvt any) {
 		c.handleMeshMessage(evt)
 	case *mesh.MeshReactionEvent:
 		c.handleMeshReaction(evt)
+	case *mesh.MeshAlertEvent:
+		c.handleMeshAlert(&meshAlert{MeshEvent: evt.MeshEvent, Message: evt.Message, IsDM: evt.IsDM})
+	case *mesh.MeshDetectionSensorEvent:
+		c.handleMeshAlert(&meshAlert{MeshEvent: evt.MeshEvent, Message: evt.Message, IsSensor: true})
 	}
 }
 
@@ -67,11 +77,24 @@ func (c *MeshtasticConnector) handleMeshLocation(evt *mesh.MeshLocationEvent) {
 		Logger()
 	log.Info().
 		Float32("latitude", evt.Location.Latitude).
-		Float32("longitude", evt.Location.Latitude).
+		Float32("longitude", evt.Location.Longitude).
 		Msg("Location update received")
 
-	c.getRemoteGhost(context.Background(), meshid.MakeUserID(evt.From), true)
-	c.meshDB.MeshNodeInfo.SetLastSeen(context.Background(), evt.From, evt.IsNeighbor)
+	ctx := log.WithContext(context.Background())
+	c.setLastPosition(evt.From, evt.Location)
+	ghost, err := c.getRemoteGhost(ctx, meshid.MakeUserID(evt.From), true)
+	if err != nil {
+		log.Err(err).Msg("Failed to get ghost")
+	}
+	c.meshDB.MeshNodeInfo.SetLastSeen(ctx, evt.From, evt.IsNeighbor)
+	if c.Config.PositionHistory.Enabled && ghost != nil && sharesLocation(ghost) {
+		if err := c.recordPosition(ctx, evt); err != nil {
+			log.Err(err).Msg("Failed to record position")
+		}
+	}
+	if err := c.bridgeLocation(ctx, evt, ghost); err != nil {
+		log.Err(err).Msg("Failed to bridge location to Matrix")
+	}
 }
 
 func (c *MeshtasticClient) joinChannel(channelName string, channelKey string) error {
@@ -94,7 +117,12 @@ func (c *MeshtasticClient) joinChannel(channelName string, channelKey string) er
 
 	chatInfo := c.wrapChatInfo(user, channelName, channelKey)
 	// Create the room using portal
-	return portal.CreateMatrixRoom(ctx, user.GetDefaultLogin(), chatInfo)
+	if err = portal.CreateMatrixRoom(ctx, login, chatInfo); err != nil {
+		return err
+	}
+	// The room may already exist through another identity, which means this one isn't in it yet
+	login.MarkInPortal(ctx, portal)
+	return nil
 
 }
 
@@ -102,6 +130,8 @@ func (c *MeshtasticClient) handleMeshMessage(evt *mesh.MeshMessageEvent) {
 	meta, ok := c.UserLogin.Metadata.(*meshid.UserLoginMetadata)
 	if evt.IsDM && (!ok || meta.NodeID != evt.To) {
 		return
+	} else if !evt.IsDM && !c.main.isUplinkEnabled(evt.ChannelName, evt.ChannelKey) {
+		return
 	}
 
 	ctx := context.Background()
@@ -144,12 +174,48 @@ func (c *MeshtasticClient) handleMeshMessage(evt *mesh.MeshMessageEvent) {
 		}
 	}
 
+	c.main.meshDB.MeshNodeInfo.SetLastSeen(ctx, evt.From, evt.IsNeighbor)
+
+	if c.main.reassembler != nil && c.main.reassembler.Add(c, evt, messIDSender) {
+		return
+	}
+	c.queueMeshMessage(&reassembledMessage{Message: evt}, portalKey, messIDSender, roomType)
+}
+
+// handleReassembledMessage queues a message that was combined from multiple parts
+func handleReassembledMessage(c *MeshtasticClient, msg *reassembledMessage) {
+	evt := msg.Message
+	if evt.IsDM {
+		c.queueMeshMessage(msg, c.makeDMPortalKey(evt.From, evt.To), evt.From.String(), database.RoomTypeDM)
+	} else {
+		c.queueMeshMessage(msg, c.makePortalKey(evt.ChannelName, evt.ChannelKey), evt.ChannelName, database.RoomTypeDefault)
+	}
+}
+
+func (c *MeshtasticClient) queueMeshMessage(msg *reassembledMessage, portalKey networkid.PortalKey, messIDSender string, roomType database.RoomType) {
+	evt := msg.Message
+	messageID := meshid.MakeMessageID(messIDSender, evt.PacketId)
+
+	if len(msg.AliasPacketIDs) > 0 {
+		aliasIDs := make([]networkid.MessageID, len(msg.AliasPacketIDs))
+		for i, packetID := range msg.AliasPacketIDs {
+			aliasIDs[i] = meshid.MakeMessageID(messIDSender, packetID)
+		}
+		if err := c.main.storeMessageAliases(context.Background(), messageID, aliasIDs); err != nil {
+			c.log.Err(err).Str("message_id", string(messageID)).Msg("Failed to store message part aliases")
+		}
+	}
+
 	mess := simplevent.Message[*mesh.MeshMessageEvent]{
 		EventMeta: simplevent.EventMeta{
 			Type: bridgev2.RemoteEventMessage,
 			LogContext: func(c zerolog.Context) zerolog.Context {
 				c = c.Stringer("sender_id", evt.From)
 				c = c.Uint32("message_ts", uint32(evt.Timestamp))
+				if msg.TotalParts > 0 {
+					c = c.Int("total_parts", msg.TotalParts)
+					c = c.Ints("missing_parts", msg.MissingParts)
+				}
 				return c
 			},
 			PortalKey:    portalKey,
@@ -161,12 +227,40 @@ func (c *MeshtasticClient) handleMeshMessage(evt *mesh.MeshMessageEvent) {
 			},
 		},
 		Data:               evt,
-		ID:                 meshid.MakeMessageID(messIDSender, evt.PacketId),
+		ID:                 messageID,
 		ConvertMessageFunc: c.convertMessageEvent,
 	}
+	if len(msg.MissingParts) > 0 {
+		mess.ConvertMessageFunc = func(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, data *mesh.MeshMessageEvent) (*bridgev2.ConvertedMessage, error) {
+			m, err := c.convertMessageEvent(ctx, portal, intent, data)
+			if err != nil {
+				return nil, err
+			}
+			m.Parts = append(m.Parts, &bridgev2.ConvertedMessagePart{
+				ID:   "missing",
+				Type: event.EventMessage,
+				Content: &event.MessageEventContent{
+					MsgType: event.MsgNotice,
+					Body:    formatMissingParts(msg.MissingParts, msg.TotalParts),
+				},
+			})
+			return m, nil
+		}
+	}
 
 	c.bridge.QueueRemoteEvent(c.UserLogin, &mess)
-	c.main.meshDB.MeshNodeInfo.SetLastSeen(ctx, evt.From, evt.IsNeighbor)
+}
+
+func formatMissingParts(missing []int, total int) string {
+	parts := make([]string, len(missing))
+	for i, idx := range missing {
+		parts[i] = strconv.Itoa(idx)
+	}
+	noun := "Part"
+	if len(missing) > 1 {
+		noun = "Parts"
+	}
+	return fmt.Sprintf("⚠️ %s %s of %d never arrived", noun, strings.Join(parts, ", "), total)
 }
 
 func (c *MeshtasticClient) convertMessageEvent(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, data *mesh.MeshMessageEvent) (*bridgev2.ConvertedMessage, error) {
@@ -237,18 +331,12 @@ func (c *MeshtasticClient) convertMessageEvent(ctx context.Context, portal *brid
 	}
 
 	if strings.Contains(mess, mesh.BellCharacter) {
-		if portal.RoomType == database.RoomTypeDM {
-			user := c.bridge.GetCachedUserLoginByID(portal.Receiver)
-			userTag := user.UserMXID.String()
-
-			mess = strings.ReplaceAll(mess, mesh.BellCharacter, userTag)
-			formatted = strings.ReplaceAll(data.Message, mesh.BellCharacter, fmt.Sprintf(`<a href="%s">%s</a>`, user.UserMXID.URI().MatrixToURL(), html.EscapeString(userTag)))
-			mentions.UserIDs = append(mentions.UserIDs, user.UserMXID)
-		} else {
-			mess = strings.ReplaceAll(mess, mesh.BellCharacter, portal.MXID.String())
-			formatted = strings.ReplaceAll(data.Message, mesh.BellCharacter, fmt.Sprintf(`<a href="%s">%s</a>`, portal.MXID.URI().MatrixToURL(), html.EscapeString("@room")))
-			mentions.Room = true
+		if formatted == "" {
+			formatted = html.EscapeString(mess)
 		}
+		bodyTag, htmlTag := c.highlightTarget(portal, mentions)
+		mess = strings.ReplaceAll(mess, mesh.BellCharacter, bodyTag)
+		formatted = strings.ReplaceAll(formatted, mesh.BellCharacter, htmlTag)
 	}
 
 	content := &event.MessageEventContent{
@@ -274,12 +362,135 @@ func (c *MeshtasticClient) convertMessageEvent(ctx context.Context, portal *brid
 			messIDSender = data.ChannelName
 		}
 		m.ReplyTo = &networkid.MessageOptionalPartID{
-			MessageID: meshid.MakeMessageID(messIDSender, data.ReplyId),
+			MessageID: c.main.resolveMessageID(ctx, meshid.MakeMessageID(messIDSender, data.ReplyId)),
 		}
 	}
 	return m, nil
 }
 
+// highlightTarget returns the plain and HTML mentions used to ping everyone in a portal,
+// adding the mentioned users or room to the supplied mentions
+func (c *MeshtasticClient) highlightTarget(portal *bridgev2.Portal, mentions *event.Mentions) (bodyTag, htmlTag string) {
+	if portal.RoomType == database.RoomTypeDM {
+		user := c.bridge.GetCachedUserLoginByID(portal.Receiver)
+		userTag := user.UserMXID.String()
+		mentions.UserIDs = append(mentions.UserIDs, user.UserMXID)
+		return userTag, fmt.Sprintf(`<a href="%s">%s</a>`, user.UserMXID.URI().MatrixToURL(), html.EscapeString(userTag))
+	}
+	mentions.Room = true
+	return portal.MXID.String(), fmt.Sprintf(`<a href="%s">%s</a>`, portal.MXID.URI().MatrixToURL(), html.EscapeString("@room"))
+}
+
+// meshAlert is the common form of alert and detection sensor packets
+type meshAlert struct {
+	mesh.MeshEvent
+	Message  string
+	IsDM     bool
+	IsSensor bool
+}
+
+func (c *MeshtasticClient) handleMeshAlert(evt *meshAlert) {
+	meta, ok := c.UserLogin.Metadata.(*meshid.UserLoginMetadata)
+	if evt.IsDM && (!ok || meta.NodeID != evt.To) {
+		return
+	} else if !evt.IsDM && !c.main.isUplinkEnabled(evt.ChannelName, evt.ChannelKey) {
+		return
+	}
+
+	ctx := context.Background()
+
+	c.main.getRemoteGhost(ctx, meshid.MakeUserID(evt.From), true)
+
+	var portalKey networkid.PortalKey
+	var messIDSender = ""
+
+	roomType := database.RoomTypeDefault
+	if evt.IsDM {
+		portalKey = c.makeDMPortalKey(evt.From, evt.To)
+		messIDSender = evt.From.String()
+		roomType = database.RoomTypeDM
+		if evt.WantAck {
+			c.MeshClient.SendAck(evt.To, evt.From, evt.PacketId)
+		}
+	} else {
+		portalKey = c.makePortalKey(evt.ChannelName, evt.ChannelKey)
+		messIDSender = evt.ChannelName
+		if evt.WantAck {
+			c.MeshClient.SendAck(c.main.GetBaseNodeID(), evt.From, evt.PacketId)
+		}
+
+		logins, err := c.bridge.GetUserLoginsInPortal(ctx, portalKey)
+		if err != nil || !slices.ContainsFunc(logins, func(l *bridgev2.UserLogin) bool { return l.ID == c.UserLogin.ID }) {
+			return
+		}
+	}
+
+	mess := simplevent.Message[*meshAlert]{
+		EventMeta: simplevent.EventMeta{
+			Type: bridgev2.RemoteEventMessage,
+			LogContext: func(c zerolog.Context) zerolog.Context {
+				c = c.Stringer("sender_id", evt.From)
+				c = c.Uint32("message_ts", uint32(evt.Timestamp))
+				c = c.Bool("is_sensor", evt.IsSensor)
+				return c
+			},
+			PortalKey:    portalKey,
+			CreatePortal: true,
+			Sender:       c.makeEventSender(evt.From),
+			Timestamp:    time.Unix(int64(evt.Timestamp), 0),
+			PreHandleFunc: func(ctx context.Context, p *bridgev2.Portal) {
+				p.RoomType = roomType
+			},
+		},
+		Data:               evt,
+		ID:                 meshid.MakeMessageID(messIDSender, evt.PacketId),
+		ConvertMessageFunc: c.convertAlertEvent,
+	}
+
+	c.bridge.QueueRemoteEvent(c.UserLogin, &mess)
+	c.main.meshDB.MeshNodeInfo.SetLastSeen(ctx, evt.From, evt.IsNeighbor)
+}
+
+func (c *MeshtasticClient) convertAlertEvent(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, data *meshAlert) (*bridgev2.ConvertedMessage, error) {
+	prefix := "🚨 Alert"
+	if data.IsSensor {
+		prefix = "📟 Detection sensor"
+	}
+	mentions := &event.Mentions{}
+	mess := fmt.Sprintf("%s: %s", prefix, data.Message)
+	formatted := fmt.Sprintf("<strong>%s:</strong> %s", html.EscapeString(prefix), html.EscapeString(data.Message))
+
+	// Sensors and alert buzzers commonly include the bell character to trigger the buzzer on
+	// receiving devices, so we treat it the same as we would in a normal text message, unless
+	// highlighting alerts has been turned off for the portal
+	hasBell := strings.Contains(mess, mesh.BellCharacter)
+	if !getPortalMetadata(portal).ShouldHighlightAlerts() {
+		mess = strings.ReplaceAll(mess, mesh.BellCharacter, "")
+		formatted = strings.ReplaceAll(formatted, mesh.BellCharacter, "")
+	} else if hasBell {
+		bodyTag, htmlTag := c.highlightTarget(portal, mentions)
+		mess = strings.ReplaceAll(mess, mesh.BellCharacter, bodyTag)
+		formatted = strings.ReplaceAll(formatted, mesh.BellCharacter, htmlTag)
+	} else {
+		bodyTag, htmlTag := c.highlightTarget(portal, mentions)
+		mess = fmt.Sprintf("%s %s", mess, bodyTag)
+		formatted = fmt.Sprintf("%s %s", formatted, htmlTag)
+	}
+
+	return &bridgev2.ConvertedMessage{
+		Parts: []*bridgev2.ConvertedMessagePart{{
+			Type: event.EventMessage,
+			Content: &event.MessageEventContent{
+				MsgType:       event.MsgNotice,
+				Body:          mess,
+				Format:        event.FormatHTML,
+				FormattedBody: formatted,
+				Mentions:      mentions,
+			},
+		}},
+	}, nil
+}
+
 func (c *MeshtasticConnector) getRemoteGhost(ctx context.Context, ghostID networkid.UserID, requestInfoIfNew bool) (*bridgev2.Ghost, error) {
 	if !requestInfoIfNew {
 		return c.bridge.GetGhostByID(ctx, ghostID)
@@ -339,13 +550,13 @@ func (c *MeshtasticConnector) handleMeshNodeInfo(evt *mesh.MeshNodeInfoEvent) {
 		mn.NodeID = evt.From
 	}
 	needUpdate := false
-	if mn.UserID != evt.UserID || mn.LongName != evt.LongName || mn.ShortName != evt.ShortName || !slices.Equal(mn.PublicKey, evt.PublicKey) {
+	if mn.UserID != evt.UserID || mn.LongName != evt.LongName || mn.ShortName != evt.ShortName {
 		needUpdate = true
 		mn.UserID = evt.UserID
 		mn.LongName = evt.LongName
 		mn.ShortName = evt.ShortName
-		mn.PublicKey = evt.PublicKey
 	}
+	keyStatus := pinPublicKey(mn, evt.PublicKey)
 	mn.Role = evt.Role
 	mn.IsDirect = evt.IsNeighbor
 	mn.IsLicensed = evt.IsLicensed
@@ -358,6 +569,13 @@ func (c *MeshtasticConnector) handleMeshNodeInfo(evt *mesh.MeshNodeInfoEvent) {
 			Str("long_name", evt.LongName).
 			Str("short_name", evt.ShortName).
 			Msg("Failed to update node db")
+	} else if keyStatus != keyUnchanged {
+		c.recordPublicKey(ctx, evt.From, evt.PublicKey, keyStatus == keyPinned)
+		if keyStatus == keyPending {
+			c.notifyKeyChange(ctx, mn)
+		} else {
+			c.notifyPublicKey(evt.From)
+		}
 	}
 
 	if evt.LongName == "" {
@@ -504,6 +722,8 @@ func (c *MeshtasticClient) handleMeshReaction(evt *mesh.MeshReactionEvent) {
 	meta, ok := c.UserLogin.Metadata.(*meshid.UserLoginMetadata)
 	if evt.IsDM && (!ok || meta.NodeID != evt.To) {
 		return
+	} else if !evt.IsDM && !c.main.isUplinkEnabled(evt.ChannelName, evt.ChannelKey) {
+		return
 	}
 
 	c.main.getRemoteGhost(context.Background(), meshid.MakeUserID(evt.From), true)
@@ -557,7 +777,7 @@ func (c *MeshtasticClient) handleMeshReaction(evt *mesh.MeshReactionEvent) {
 		},
 		EmojiID:       networkid.EmojiID(evt.Emoji),
 		Emoji:         evt.Emoji,
-		TargetMessage: meshid.MakeMessageID(messIDSender, evt.ReplyId),
+		TargetMessage: c.main.resolveMessageID(context.Background(), meshid.MakeMessageID(messIDSender, evt.ReplyId)),
 	}
 
 	c.main.meshDB.MeshNodeInfo.SetLastSeen(context.Background(), evt.From, evt.IsNeighbor)
@@ -569,44 +789,68 @@ func (c *MeshtasticConnector) handleMeshWaypoint(evt *mesh.MeshWaypointEvent) {
 	log := c.log.With().
 		Str("action", "waypoint_update").
 		Stringer("node_id", evt.From).
+		Uint32("waypoint_id", evt.WaypointID).
 		Logger()
 	log.Info().
 		Float32("latitude", evt.Latitude).
-		Float32("longitude", evt.Latitude).
+		Float32("longitude", evt.Longitude).
 		Str("name", evt.Name).
 		Str("description", evt.Description).
 		Str("icon", evt.Icon).
-		//Stringer("locked_to", evt.LockedTo).
-		//Time("expires", *evt.Expires).
+		Bool("is_delete", evt.IsDelete).
 		Msg("Waypoint received")
 
-	ctx := context.Background()
+	ctx := log.WithContext(context.Background())
 	c.meshDB.MeshNodeInfo.SetLastSeen(ctx, evt.From, evt.IsNeighbor)
+	isBroadcast := evt.To == meshid.BROADCAST_ID || evt.To == meshid.BROADCAST_ID_NO_LORA
+	if isBroadcast && !c.isUplinkEnabled(evt.ChannelName, evt.ChannelKey) {
+		return
+	}
+	waypoint, err := c.meshDB.Waypoint.GetByWaypointID(ctx, evt.WaypointID)
+	if err != nil {
+		log.Err(err).Msg("Error checking for existing waypoint")
+		return
+	}
 	if evt.IsDelete {
+		if waypoint == nil {
+			return
+		}
+		if err := c.redactWaypoint(ctx, waypoint, "Waypoint deleted"); err != nil {
+			log.Err(err).Msg("Failed to redact waypoint message")
+		}
 		if err := c.meshDB.Waypoint.DeleteByID(ctx, evt.WaypointID); err != nil {
 			log.Err(err).Msg("Error deleting waypoint")
 		}
-	} else if waypoint, err := c.meshDB.Waypoint.GetByWaypointID(ctx, evt.WaypointID); err != nil {
-		log.Err(err).Msg("Error checking for existing waypoint")
+		return
 	} else if waypoint != nil && waypoint.LockedTo != nil && *waypoint.LockedTo != evt.From {
-		log.Err(err).Msgf("This waypoint is locked to another node")
-	} else {
-		if waypoint == nil {
-			waypoint = c.meshDB.Waypoint.New()
-			waypoint.WaypointID = evt.WaypointID
-		}
-		waypoint.Name = evt.Name
-		waypoint.Description = evt.Description
-		waypoint.Icon = evt.Icon
-		waypoint.Expires = evt.Expires
-		waypoint.Latitude = evt.Latitude
-		waypoint.Longitude = evt.Longitude
-		waypoint.UpdatedBy = evt.From
-		waypoint.UpdatedDate = ptr.Ptr(time.Unix(int64(evt.Timestamp), 0))
-		waypoint.LockedTo = evt.LockedTo
-		if err := waypoint.SetAll(ctx); err != nil {
-			log.Err(err).Msg("Error saving waypoint")
+		log.Warn().Stringer("locked_to", *waypoint.LockedTo).Msg("This waypoint is locked to another node")
+		return
+	}
+
+	if waypoint == nil {
+		waypoint = c.meshDB.Waypoint.New()
+		waypoint.WaypointID = evt.WaypointID
+	}
+	waypoint.Name = evt.Name
+	waypoint.Description = evt.Description
+	waypoint.Icon = evt.Icon
+	waypoint.Expires = evt.Expires
+	waypoint.Latitude = evt.Latitude
+	waypoint.Longitude = evt.Longitude
+	waypoint.UpdatedBy = evt.From
+	waypoint.UpdatedDate = ptr.Ptr(time.Unix(int64(evt.Timestamp), 0))
+	waypoint.LockedTo = evt.LockedTo
+
+	var portal *bridgev2.Portal
+	if waypoint.EventMXID == "" {
+		if portal, err = c.getWaypointPortal(ctx, evt); err != nil {
+			log.Err(err).Msg("Failed to get portal for waypoint")
 		}
 	}
-	// TODO: Possibly drop an m.location event in associated channel?
+	if err := c.postWaypoint(ctx, waypoint, portal); err != nil {
+		log.Err(err).Msg("Failed to post waypoint to Matrix")
+	}
+	if err := waypoint.SetAll(ctx); err != nil {
+		log.Err(err).Msg("Error saving waypoint")
+	}
 }
@@ -0,0 +1,192 @@
+package connector
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/kabili207/matrix-meshtastic/pkg/connector/meshdb"
+	"github.com/kabili207/matrix-meshtastic/pkg/meshid"
+	"github.com/meshnet-gophers/meshtastic-go/radio"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/commands"
+	"maunium.net/go/mautrix/id"
+)
+
+// The prefix the Meshtastic CLI uses for binary config values such as security.private_key
+const meshtasticKeyPrefix = "base64:"
+
+// Node numbers below this are reserved by the firmware
+const minNodeID meshid.NodeID = 4
+
+type nodeIDClaim int
+
+const (
+	nodeIDAvailable nodeIDClaim = iota
+	// The node has been seen on the mesh, so its private key is needed to claim it
+	nodeIDNeedsProof
+)
+
+// loginNodeID returns the node ID of a login. Without a login, such as for users bridged
+// through a relay, the node ID is derived from the MXID
+func loginNodeID(login *bridgev2.UserLogin, mxid id.UserID) meshid.NodeID {
+	if login != nil {
+		if meta, ok := login.Metadata.(*meshid.UserLoginMetadata); ok && meta.NodeID != 0 {
+			return meta.NodeID
+		}
+	}
+	return meshid.MXIDToNodeID(mxid)
+}
+
+// getLoginNodeID returns the node ID of the default login of a Matrix user
+func getLoginNodeID(user *bridgev2.User) meshid.NodeID {
+	return loginNodeID(user.GetDefaultLogin(), user.MXID)
+}
+
+// getCommandLogin returns the login a command acts as. In a portal, that's the identity
+// chosen to speak there, otherwise it's the default login of the user
+func getCommandLogin(ce *commands.Event) *bridgev2.UserLogin {
+	if ce.Portal != nil {
+		if login, _, err := ce.Portal.FindPreferredLogin(ce.Ctx, ce.User, false); err == nil && login != nil {
+			return login
+		}
+	}
+	return ce.User.GetDefaultLogin()
+}
+
+// getCommandNodeID returns the node ID a command sends from
+func getCommandNodeID(ce *commands.Event) meshid.NodeID {
+	return loginNodeID(getCommandLogin(ce), ce.User.MXID)
+}
+
+// senderNodeID returns the node a Matrix user sends from through this login. The owner of the
+// login uses its node, while other users bridged through it as a relay use their own
+func (c *MeshtasticClient) senderNodeID(ctx context.Context, sender id.UserID) meshid.NodeID {
+	if sender == c.UserLogin.UserMXID {
+		return loginNodeID(c.UserLogin, sender)
+	}
+	return c.main.getUserNodeID(ctx, sender)
+}
+
+// getManagedNodeMeta returns the login metadata of a managed node, or nil if no login uses the node
+func (c *MeshtasticConnector) getManagedNodeMeta(nodeID meshid.NodeID) *meshid.UserLoginMetadata {
+	login := c.bridge.GetCachedUserLoginByID(meshid.MakeUserLoginID(nodeID))
+	if login == nil {
+		return nil
+	}
+	meta, _ := login.Metadata.(*meshid.UserLoginMetadata)
+	return meta
+}
+
+// getUserNodeID looks up the node ID a Matrix user sends from
+func (c *MeshtasticConnector) getUserNodeID(ctx context.Context, mxid id.UserID) meshid.NodeID {
+	if user, err := c.bridge.GetExistingUserByMXID(ctx, mxid); err == nil && user != nil {
+		return getLoginNodeID(user)
+	}
+	return meshid.MXIDToNodeID(mxid)
+}
+
+// checkNodeIDClaim checks if a Matrix user can use a node ID, which must not belong to
+// another managed node. Nodes that have been seen on the mesh need proof of ownership
+func (c *MeshtasticConnector) checkNodeIDClaim(ctx context.Context, nodeID meshid.NodeID, mxid id.UserID) (nodeIDClaim, error) {
+	if nodeID < minNodeID || nodeID == meshid.BROADCAST_ID {
+		return 0, fmt.Errorf("%s is a reserved node ID", nodeID)
+	} else if nodeID == c.GetBaseNodeID() {
+		return 0, fmt.Errorf("%s is used by the bridge itself", nodeID)
+	}
+	ghost, err := c.bridge.GetExistingGhostByID(ctx, meshid.MakeUserID(nodeID))
+	if err != nil {
+		return 0, err
+	} else if ghost != nil {
+		if meta, ok := ghost.Metadata.(*meshid.GhostMetadata); ok && meta.UserMXID != "" {
+			if meta.UserMXID != mxid {
+				return 0, fmt.Errorf("%s is already used by another Matrix user", nodeID)
+			}
+			// Logging in again with the same node
+			return nodeIDAvailable, nil
+		}
+	}
+	nodeInfo, err := c.meshDB.MeshNodeInfo.GetByNodeID(ctx, nodeID)
+	if err != nil {
+		return 0, err
+	} else if nodeInfo == nil {
+		return nodeIDAvailable, nil
+	} else if nodeInfo.IsManaged {
+		return 0, fmt.Errorf("%s is already managed by this bridge", nodeID)
+	} else if len(nodeInfo.PublicKey) == 0 {
+		return 0, fmt.Errorf("%s has been seen on the mesh, but its public key isn't known, so it can't be claimed", nodeID)
+	}
+	return nodeIDNeedsProof, nil
+}
+
+// claimNodeID turns a node that was seen on the mesh into a managed node, after
+// checking the private key matches the public key it announced
+func (c *MeshtasticConnector) claimNodeID(ctx context.Context, nodeID meshid.NodeID, privateKey []byte) error {
+	publicKey, err := c.meshClient.PublicKeyFromPrivate(privateKey)
+	if err != nil {
+		return err
+	}
+	nodeInfo, err := c.meshDB.MeshNodeInfo.GetByNodeID(ctx, nodeID)
+	if err != nil {
+		return err
+	} else if nodeInfo == nil || !bytes.Equal(nodeInfo.PublicKey, publicKey) {
+		return fmt.Errorf("the private key does not belong to %s", nodeID)
+	}
+	nodeInfo.IsManaged = true
+	nodeInfo.PrivateKey = privateKey
+	nodeInfo.PendingPublicKey = nil
+	return nodeInfo.SetAll(ctx)
+}
+
+// parsePrivateKey parses a Curve25519 private key given either as plain base64
+// or as a Meshtastic key string
+func parsePrivateKey(raw string) ([]byte, error) {
+	key, err := radio.ParseKey(strings.TrimPrefix(strings.TrimSpace(raw), meshtasticKeyPrefix))
+	if err != nil {
+		return nil, errors.New("private key must be encoded as base64")
+	} else if len(key) != 32 {
+		return nil, fmt.Errorf("private key must be 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+// formatIdentity creates the message sent by the export-identity command
+func formatIdentity(nodeInfo *meshdb.MeshNodeInfo, meshtasticFormat bool) string {
+	privateKey := base64.StdEncoding.EncodeToString(nodeInfo.PrivateKey)
+	if meshtasticFormat {
+		privateKey = meshtasticKeyPrefix + privateKey
+	}
+	return fmt.Sprintf("**Node ID:** `%s`\n**Public key:** `%s`\n**Private key:** `%s`\n\n"+
+		"⚠️ Anyone with the private key can read your direct messages and impersonate your node. "+
+		"Store it somewhere safe and redact this message",
+		nodeInfo.NodeID, base64.StdEncoding.EncodeToString(nodeInfo.PublicKey), privateKey)
+}
+
+// importKeyPair replaces the keys of a managed node and announces the new public key to the mesh
+func (c *MeshtasticConnector) importKeyPair(ctx context.Context, nodeID meshid.NodeID, privateKey []byte) error {
+	publicKey, err := c.meshClient.PublicKeyFromPrivate(privateKey)
+	if err != nil {
+		return err
+	}
+	nodeInfo, err := c.meshDB.MeshNodeInfo.GetByNodeID(ctx, nodeID)
+	if err != nil {
+		return err
+	} else if nodeInfo == nil || !nodeInfo.IsManaged {
+		return fmt.Errorf("%s is not managed by this bridge", nodeID)
+	}
+	nodeInfo.PrivateKey = privateKey
+	nodeInfo.PublicKey = publicKey
+	nodeInfo.PendingPublicKey = nil
+	if err = nodeInfo.SetAll(ctx); err != nil {
+		return err
+	}
+	// The old keys no longer belong to this node, so the imported one becomes the only pinned key
+	if err = c.meshDB.KeyHistory.DeleteByNodeID(ctx, nodeID); err != nil {
+		return err
+	}
+	c.recordPublicKey(ctx, nodeID, publicKey, true)
+	return c.meshClient.SendNodeInfo(nodeID, meshid.BROADCAST_ID, nodeInfo.LongName, nodeInfo.ShortName, false, publicKey)
+}
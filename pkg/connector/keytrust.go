@@ -0,0 +1,120 @@
+package connector
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/kabili207/matrix-meshtastic/pkg/connector/meshdb"
+	"github.com/kabili207/matrix-meshtastic/pkg/meshid"
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/ptr"
+	"maunium.net/go/mautrix/id"
+)
+
+var errKeyNotTrusted = errors.New("the public key of this node has changed, direct messages are blocked until a bridge administrator trusts the new key with the trust-key command")
+
+type keyStatus int
+
+const (
+	keyUnchanged keyStatus = iota
+	// The node announced a key for the first time, which was pinned
+	keyPinned
+	// The node announced a key that differs from the pinned one
+	keyPending
+)
+
+// pinPublicKey applies trust-on-first-use pinning to a public key announced by a node. The first
+// key is pinned, while later changes are held as pending until a Matrix user trusts them
+func pinPublicKey(mn *meshdb.MeshNodeInfo, publicKey []byte) keyStatus {
+	if len(publicKey) == 0 {
+		// Never unpin a key just because a node stopped announcing it
+		return keyUnchanged
+	}
+	if len(mn.PublicKey) == 0 {
+		mn.PublicKey = publicKey
+		mn.PendingPublicKey = nil
+		return keyPinned
+	}
+	if bytes.Equal(mn.PublicKey, publicKey) {
+		// The node went back to the pinned key
+		mn.PendingPublicKey = nil
+		return keyUnchanged
+	}
+	if bytes.Equal(mn.PendingPublicKey, publicKey) {
+		return keyUnchanged
+	}
+	mn.PendingPublicKey = publicKey
+	return keyPending
+}
+
+// recordPublicKey adds a newly seen key to the key history of a node
+func (c *MeshtasticConnector) recordPublicKey(ctx context.Context, nodeID meshid.NodeID, publicKey []byte, trusted bool) {
+	entry := c.meshDB.KeyHistory.New()
+	entry.NodeID = nodeID
+	entry.PublicKey = publicKey
+	entry.FirstSeen = time.Now()
+	if trusted {
+		entry.TrustedAt = ptr.Ptr(entry.FirstSeen)
+	}
+	if err := entry.Insert(ctx); err != nil {
+		zerolog.Ctx(ctx).Err(err).Stringer("node_id", nodeID).Msg("Failed to record public key")
+	}
+}
+
+// ensureKeyTrusted returns an error if a node has announced a key change that hasn't been trusted yet
+func (c *MeshtasticConnector) ensureKeyTrusted(ctx context.Context, nodeID meshid.NodeID) error {
+	nodeInfo, err := c.meshDB.MeshNodeInfo.GetByNodeID(ctx, nodeID)
+	if err != nil {
+		return err
+	} else if nodeInfo != nil && len(nodeInfo.PendingPublicKey) > 0 {
+		return errKeyNotTrusted
+	}
+	return nil
+}
+
+// trustPendingKey replaces the pinned key of a node with its pending key
+func (c *MeshtasticConnector) trustPendingKey(ctx context.Context, mn *meshdb.MeshNodeInfo, trustedBy id.UserID) error {
+	if len(mn.PendingPublicKey) == 0 {
+		return errors.New("no key change is pending")
+	}
+	mn.PublicKey = mn.PendingPublicKey
+	mn.PendingPublicKey = nil
+	if err := mn.SetAll(ctx); err != nil {
+		return err
+	}
+	return c.meshDB.KeyHistory.SetTrusted(ctx, mn.NodeID, mn.PublicKey, trustedBy)
+}
+
+// notifyDMPortals sends a notice to every DM portal with a node
+func (c *MeshtasticConnector) notifyDMPortals(ctx context.Context, nodeID meshid.NodeID, message string) {
+	portals, err := c.bridge.GetDMPortalsWith(ctx, meshid.MakeUserID(nodeID))
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Stringer("node_id", nodeID).Msg("Unable to get DM portals")
+		return
+	}
+	for _, p := range portals {
+		if p.MXID != "" {
+			c.sendNoticeToRoom(ctx, p.MXID, message)
+		}
+	}
+}
+
+// notifyKeyChange warns the DM portals of a node that it announced a different public key
+func (c *MeshtasticConnector) notifyKeyChange(ctx context.Context, mn *meshdb.MeshNodeInfo) {
+	zerolog.Ctx(ctx).Warn().
+		Stringer("node_id", mn.NodeID).
+		Str("pinned_key", base64.StdEncoding.EncodeToString(mn.PublicKey)).
+		Str("pending_key", base64.StdEncoding.EncodeToString(mn.PendingPublicKey)).
+		Msg("Node announced a different public key")
+	c.notifyDMPortals(ctx, mn.NodeID, fmt.Sprintf(
+		"⚠️ **The public key of %s has changed.** This can happen if the node was reset, but may also mean someone is impersonating it. "+
+			"Direct messages to this node are blocked until a bridge administrator trusts the new key with `%s trust-key %s`\n\n"+
+			"**Pinned key:** `%s`\n**New key:** `%s`",
+		c.getNodeDisplayName(mn.NodeID), c.bridge.Config.CommandPrefix, mn.NodeID,
+		base64.StdEncoding.EncodeToString(mn.PublicKey), base64.StdEncoding.EncodeToString(mn.PendingPublicKey),
+	))
+}
@@ -0,0 +1,119 @@
+package connector
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/kabili207/matrix-meshtastic/pkg/mesh"
+	"github.com/kabili207/matrix-meshtastic/pkg/meshid"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/id"
+)
+
+// getDMPortal finds the DM portal between a managed node and a remote node, if it has a room
+func (c *MeshtasticConnector) getDMPortal(ctx context.Context, remoteNode, synthNode meshid.NodeID) (*bridgev2.Portal, error) {
+	portals, err := c.bridge.GetDMPortalsWith(ctx, meshid.MakeUserID(remoteNode))
+	if err != nil {
+		return nil, err
+	}
+	portalID := meshid.MakeDMPortalID(remoteNode, synthNode)
+	for _, p := range portals {
+		if p.ID == portalID && p.MXID != "" {
+			return p, nil
+		}
+	}
+	return nil, nil
+}
+
+// isKeyVerified checks if a managed node has verified the current public key of a remote node
+func (c *MeshtasticConnector) isKeyVerified(ctx context.Context, synthNode, remoteNode meshid.NodeID) (bool, error) {
+	verification, err := c.meshDB.KeyVerification.Get(ctx, synthNode, remoteNode)
+	if err != nil || verification == nil {
+		return false, err
+	}
+	nodeInfo, err := c.meshDB.MeshNodeInfo.GetByNodeID(ctx, remoteNode)
+	if err != nil || nodeInfo == nil {
+		return false, err
+	}
+	// A verification only applies to the key that was verified, so a key change voids it
+	return bytes.Equal(verification.PublicKey, nodeInfo.PublicKey) && len(nodeInfo.PendingPublicKey) == 0, nil
+}
+
+// dmTopic creates the topic of a DM portal, which includes whether the key of the remote node was verified
+// and how messages are encrypted when its key isn't known
+func (c *MeshtasticConnector) dmTopic(ctx context.Context, synthNode, remoteNode meshid.NodeID) string {
+	topic := fmt.Sprintf("Meshtastic node %s", remoteNode)
+	if verified, err := c.isKeyVerified(ctx, synthNode, remoteNode); err != nil {
+		c.log.Err(err).Stringer("node_id", remoteNode).Msg("Failed to check key verification")
+	} else if verified {
+		topic += " | 🔐 Key verified"
+	} else {
+		topic += " | Key not verified"
+	}
+	return topic + " | " + dmEncryptionLabel(c.getDMEncryption(synthNode))
+}
+
+// saveKeyVerification records that a Matrix user confirmed a key verification and updates the DM portal topic
+func (c *MeshtasticConnector) saveKeyVerification(ctx context.Context, synthNode, remoteNode meshid.NodeID, verifiedBy id.UserID) error {
+	nodeInfo, err := c.meshDB.MeshNodeInfo.GetByNodeID(ctx, remoteNode)
+	if err != nil {
+		return err
+	} else if nodeInfo == nil || len(nodeInfo.PublicKey) == 0 {
+		return fmt.Errorf("no public key is known for %s", remoteNode)
+	}
+	verification := c.meshDB.KeyVerification.New()
+	verification.LocalNodeID = synthNode
+	verification.RemoteNodeID = remoteNode
+	verification.PublicKey = nodeInfo.PublicKey
+	verification.VerifiedAt = time.Now()
+	verification.VerifiedBy = verifiedBy
+	if err = verification.Upsert(ctx); err != nil {
+		return err
+	}
+	if ghost, err := c.bridge.GetExistingGhostByID(ctx, meshid.MakeUserID(remoteNode)); err == nil && ghost != nil {
+		c.updateDMPortalInfo(ctx, ghost)
+	}
+	return nil
+}
+
+// handleMeshKeyVerification relays the progress of a key verification to the DM portal between the nodes
+func (c *MeshtasticConnector) handleMeshKeyVerification(evt *mesh.MeshKeyVerificationEvent) {
+	log := c.log.With().
+		Str("action", "key_verification").
+		Stringer("from", evt.From).
+		Stringer("to", evt.To).
+		Logger()
+	ctx := log.WithContext(context.Background())
+
+	portal, err := c.getDMPortal(ctx, evt.From, evt.To)
+	if err != nil {
+		log.Err(err).Msg("Failed to get DM portal")
+		return
+	} else if portal == nil {
+		log.Warn().Msg("No DM portal exists for key verification")
+		return
+	}
+
+	name := c.getNodeDisplayName(evt.From)
+	prefix := c.bridge.Config.CommandPrefix
+	var message string
+	switch evt.Stage {
+	case mesh.KeyVerificationNumberShown:
+		message = fmt.Sprintf("🔐 %s started a key verification. Give its user this security number to enter on their device: **%s**",
+			name, mesh.FormatSecurityNumber(evt.SecurityNumber))
+	case mesh.KeyVerificationAwaitingNumber:
+		message = fmt.Sprintf("🔐 %s accepted the key verification. Enter the security number shown on its device with `%s verify number <number>`",
+			name, prefix)
+	case mesh.KeyVerificationAwaitingConfirmation:
+		message = fmt.Sprintf("🔐 Compare this verification code with the one shown on %s: **%s**\n\n"+
+			"If they match, confirm it with `%s verify confirm`. Otherwise, cancel with `%s verify cancel`",
+			name, evt.Code, prefix, prefix)
+	case mesh.KeyVerificationFailed:
+		message = fmt.Sprintf("❌ Key verification with %s failed: %s", name, evt.Reason)
+	default:
+		return
+	}
+	c.sendNoticeToRoom(ctx, portal.MXID, message)
+}
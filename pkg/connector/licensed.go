@@ -0,0 +1,61 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/kabili207/matrix-meshtastic/pkg/meshid"
+	"maunium.net/go/mautrix/bridgev2"
+)
+
+// Amateur radio callsigns are a prefix of up to three characters containing a digit, followed by a suffix
+// ending in a letter, optionally with a portable prefix or suffix such as "VE3/" or "/P"
+var callsignPattern = regexp.MustCompile(`^(?:[A-Z0-9]{1,4}/)?[A-Z0-9]{0,2}[0-9][A-Z0-9]{0,3}[A-Z](?:/[A-Z0-9]{1,4})?$`)
+
+var errLicensedEncryptedChannel = errors.New("licensed amateur radio operators can't send to encrypted channels. " +
+	"Use an unencrypted channel or turn off licensed mode with `licensed off`")
+
+// parseCallsign normalizes a callsign and checks if it looks valid
+func parseCallsign(raw string) (string, error) {
+	callsign := strings.ToUpper(strings.TrimSpace(raw))
+	if len(callsign) < 3 || !callsignPattern.MatchString(callsign) {
+		return "", fmt.Errorf("%s doesn't look like an amateur radio callsign", raw)
+	}
+	return callsign, nil
+}
+
+// withStationID adds station identification to the end of a message, as required of licensed operators
+func withStationID(message, callsign string) string {
+	return message + " de " + callsign
+}
+
+// getCallsign returns the callsign of a managed node, or an empty string if the node isn't operated by a licensed operator
+func (c *MeshtasticConnector) getCallsign(nodeID meshid.NodeID) string {
+	if meta := c.getManagedNodeMeta(nodeID); meta != nil {
+		return meta.Callsign
+	}
+	return ""
+}
+
+// setLicensed turns licensed mode on or off for a login, then announces the updated node info
+func (c *MeshtasticConnector) setLicensed(ctx context.Context, login *bridgev2.UserLogin, callsign string) error {
+	meta := login.Metadata.(*meshid.UserLoginMetadata)
+	meta.Callsign = callsign
+	if err := login.Save(ctx); err != nil {
+		return err
+	}
+	nodeInfo, err := c.meshDB.MeshNodeInfo.GetByNodeID(ctx, meta.NodeID)
+	if err != nil {
+		return err
+	} else if nodeInfo == nil {
+		return fmt.Errorf("node info of %s is missing", meta.NodeID)
+	}
+	nodeInfo.IsLicensed = callsign != ""
+	if err = nodeInfo.SetAll(ctx); err != nil {
+		return err
+	}
+	return c.meshClient.SendNodeInfo(meta.NodeID, meshid.BROADCAST_ID, nodeInfo.LongName, nodeInfo.ShortName, false, nodeInfo.PublicKey)
+}
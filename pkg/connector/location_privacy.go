@@ -0,0 +1,108 @@
+package connector
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kabili207/matrix-meshtastic/pkg/mesh"
+	"github.com/kabili207/matrix-meshtastic/pkg/meshid"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	fullPrecision uint32 = 32
+	// Locations with more bits of precision than this need to be confirmed before they're sent
+	// to a public channel. This matches the medium precision of the Android app
+	maxPublicPrecision uint32 = 16
+	// How long a location that needs confirmation can be sent again to confirm it
+	preciseLocationConfirmTimeout = 5 * time.Minute
+)
+
+// preciseLocationConfirmations keeps track of precise locations that were refused on public channels,
+// so sending the same location again within the timeout confirms it
+type preciseLocationConfirmations struct {
+	pending map[string]time.Time
+	lock    sync.Mutex
+}
+
+func (p *preciseLocationConfirmations) confirm(portal *bridgev2.Portal, sender id.UserID, geoURI string) bool {
+	key := fmt.Sprintf("%s|%s|%s", portal.PortalKey, sender, geoURI)
+	now := time.Now()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for k, refusedAt := range p.pending {
+		if now.Sub(refusedAt) > preciseLocationConfirmTimeout {
+			delete(p.pending, k)
+		}
+	}
+	if _, ok := p.pending[key]; ok {
+		delete(p.pending, key)
+		return true
+	}
+	p.pending[key] = now
+	return false
+}
+
+func minPrecision(precision uint32, limit *uint32) uint32 {
+	if limit != nil && *limit < precision {
+		return *limit
+	}
+	return precision
+}
+
+// locationPrecision decides how many bits of precision a location sent from Matrix keeps. The
+// uncertainty of the location is limited by the channel settings and the ceiling of the sender
+func (c *MeshtasticClient) locationPrecision(portal *bridgev2.Portal, chanCfg *BridgedChannel, fromNode meshid.NodeID, geoURI *meshid.GeoURI) uint32 {
+	precision := fullPrecision
+	if geoURI.Uncertainty != nil {
+		precision = c.MeshClient.GetPrecisionBits(geoURI.Uncertainty)
+	}
+	if chanCfg != nil {
+		precision = minPrecision(precision, chanCfg.Precision)
+	}
+	if portal.RoomType != database.RoomTypeDM {
+		precision = minPrecision(precision, getPortalMetadata(portal).PositionPrecision)
+	}
+	if meta := c.main.getManagedNodeMeta(fromNode); meta != nil {
+		precision = minPrecision(precision, meta.MaxPositionPrecision)
+	}
+	return precision
+}
+
+// checkLocationPrecision returns the precision to send a location with, or an error if it can't be sent
+func (c *MeshtasticClient) checkLocationPrecision(msg *bridgev2.MatrixMessage, chanCfg *BridgedChannel, channel meshid.ChannelDef, fromNode meshid.NodeID, geoURI *meshid.GeoURI) (uint32, error) {
+	precision := c.locationPrecision(msg.Portal, chanCfg, fromNode, geoURI)
+	if precision == 0 {
+		return 0, fmt.Errorf("locations can't be sent here with the current precision settings")
+	}
+	if msg.Portal.RoomType != database.RoomTypeDM && meshid.IsPublicChannel(channel) && precision > maxPublicPrecision &&
+		!c.main.preciseLocations.confirm(msg.Portal, msg.Event.Sender, msg.Content.GeoURI) {
+		return 0, fmt.Errorf("anyone can read this channel, and the location is precise to %s. Send the same location "+
+			"again within %d minutes to confirm, or set a lower precision with the max-position-precision command",
+			formatPrecision(precision), int(preciseLocationConfirmTimeout.Minutes()))
+	}
+	return precision, nil
+}
+
+// formatPrecision describes the accuracy of a number of bits of precision
+func formatPrecision(precision uint32) string {
+	// The precision map of the apps doesn't cover every number of bits
+	switch {
+	case precision == 0:
+		return "no location at all"
+	case precision == 1:
+		return "about half the globe"
+	case precision >= fullPrecision:
+		return "the exact spot"
+	case precision > 24:
+		return "less than a meter"
+	}
+	meters := mesh.GetPositionPrecisionInMeters(precision)
+	if meters >= 1000 {
+		return fmt.Sprintf("about %.1f km", float64(meters)/1000)
+	}
+	return fmt.Sprintf("about %d m", meters)
+}
@@ -0,0 +1,230 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/kabili207/matrix-meshtastic/pkg/mesh"
+	"github.com/kabili207/matrix-meshtastic/pkg/meshid"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	// Live location sharing (MSC3672) events, using the unstable types clients currently understand
+	eventTypeBeaconInfo = event.Type{Type: "org.matrix.msc3672.beacon_info", Class: event.StateEventType}
+	eventTypeBeacon     = event.Type{Type: "org.matrix.msc3672.beacon", Class: event.MessageEventType}
+)
+
+// How long a live location beacon stays active without being renewed. Nodes broadcast
+// their position every few hours by default, so a day allows for a few missed updates
+const beaconTimeout = 24 * time.Hour
+
+type beaconInfoContent struct {
+	Description string        `json:"description,omitempty"`
+	Live        bool          `json:"live"`
+	Timeout     int64         `json:"timeout"`
+	Timestamp   int64         `json:"org.matrix.msc3488.ts"`
+	Asset       locationAsset `json:"org.matrix.msc3488.asset"`
+}
+
+type locationAsset struct {
+	Type string `json:"type"`
+}
+
+type beaconContent struct {
+	RelatesTo event.RelatesTo `json:"m.relates_to"`
+	Location  beaconLocation  `json:"org.matrix.msc3488.location"`
+	Timestamp int64           `json:"org.matrix.msc3488.ts"`
+}
+
+type beaconLocation struct {
+	URI string `json:"uri"`
+}
+
+type beaconKey struct {
+	RoomID id.RoomID
+	NodeID meshid.NodeID
+}
+
+// liveBeacon is a beacon_info state event that location updates are being sent for
+type liveBeacon struct {
+	EventID id.EventID
+	Expires time.Time
+}
+
+// getChannelPortal finds the shared portal of a channel, if one exists and has a room
+func (c *MeshtasticConnector) getChannelPortal(ctx context.Context, channelName string, channelKey *string) (*bridgev2.Portal, error) {
+	if c.bridge.Config.SplitPortals {
+		// There isn't a single portal for the channel
+		return nil, nil
+	}
+	key := networkid.PortalKey{ID: meshid.MakePortalID(channelName, channelKey)}
+	portal, err := c.bridge.GetExistingPortalByKey(ctx, key)
+	if err != nil || portal == nil || portal.MXID == "" {
+		return nil, err
+	}
+	return portal, nil
+}
+
+// sharesLocation checks if a node has opted in to having its positions bridged
+func sharesLocation(ghost *bridgev2.Ghost) bool {
+	meta, ok := ghost.Metadata.(*meshid.GhostMetadata)
+	return ok && meta.ShareLocation
+}
+
+// setShareLocation changes whether the positions of a node are bridged to Matrix
+func (c *MeshtasticConnector) setShareLocation(ctx context.Context, ghost *bridgev2.Ghost, share bool) error {
+	meta, ok := ghost.Metadata.(*meshid.GhostMetadata)
+	if !ok {
+		meta = &meshid.GhostMetadata{}
+		ghost.Metadata = meta
+	}
+	meta.ShareLocation = share
+	return c.bridge.DB.Ghost.Update(ctx, ghost.Ghost)
+}
+
+// getChannelPortals finds the portals of a channel that have a room. With split portals,
+// every login has its own portal for the channel
+func (c *MeshtasticConnector) getChannelPortals(ctx context.Context, channelName string, channelKey *string) ([]*bridgev2.Portal, error) {
+	portalID := meshid.MakePortalID(channelName, channelKey)
+	keys := []networkid.PortalKey{{ID: portalID}}
+	if c.bridge.Config.SplitPortals {
+		keys = keys[:0]
+		for _, login := range c.bridge.GetAllCachedUserLogins() {
+			keys = append(keys, networkid.PortalKey{ID: portalID, Receiver: login.ID})
+		}
+	}
+	var portals []*bridgev2.Portal
+	for _, key := range keys {
+		portal, err := c.bridge.GetExistingPortalByKey(ctx, key)
+		if err != nil {
+			return nil, err
+		} else if portal != nil && portal.MXID != "" {
+			portals = append(portals, portal)
+		}
+	}
+	return portals, nil
+}
+
+// bridgeLocation posts a position update to the portals of the channel it was received on,
+// in the form chosen by each portal's location setting
+func (c *MeshtasticConnector) bridgeLocation(ctx context.Context, evt *mesh.MeshLocationEvent, ghost *bridgev2.Ghost) error {
+	if ghost == nil || (evt.To != meshid.BROADCAST_ID && evt.To != meshid.BROADCAST_ID_NO_LORA) {
+		return nil
+	} else if !c.isUplinkEnabled(evt.ChannelName, evt.ChannelKey) {
+		return nil
+	}
+	portals, err := c.getChannelPortals(ctx, evt.ChannelName, evt.ChannelKey)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, portal := range portals {
+		if err := c.bridgeLocationToPortal(ctx, evt, ghost, portal); err != nil {
+			errs = append(errs, fmt.Errorf("failed to bridge location to %s: %w", portal.MXID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// bridgeLocationToPortal posts a position update to one portal of the channel
+func (c *MeshtasticConnector) bridgeLocationToPortal(ctx context.Context, evt *mesh.MeshLocationEvent, ghost *bridgev2.Ghost, portal *bridgev2.Portal) error {
+	mode := getPortalMetadata(portal).GetLocationMode()
+	if !sharesLocation(ghost) {
+		mode = meshid.LocationModeOff
+	}
+	if mode != meshid.LocationModeBeacon {
+		// Stop any beacon left over from before the setting was changed
+		if err := c.stopBeacon(ctx, portal, ghost, evt.From); err != nil {
+			return err
+		}
+	}
+	if mode == meshid.LocationModeOff {
+		return nil
+	}
+
+	if err := ghost.Intent.EnsureJoined(ctx, portal.MXID); err != nil {
+		return err
+	}
+	ts := time.Now()
+	if evt.Timestamp != 0 {
+		ts = time.Unix(int64(evt.Timestamp), 0)
+	}
+	if mode == meshid.LocationModeMessage {
+		content := &event.MessageEventContent{
+			MsgType: event.MsgLocation,
+			Body:    fmt.Sprintf("Location of %s", ghost.Name),
+			GeoURI:  evt.Location.String(),
+		}
+		_, err := ghost.Intent.SendMessage(ctx, portal.MXID, event.EventMessage, &event.Content{Parsed: content}, &bridgev2.MatrixSendExtra{Timestamp: ts})
+		return err
+	}
+
+	beaconID, err := c.getOrStartBeacon(ctx, portal, ghost, evt.From, ts)
+	if err != nil {
+		return err
+	}
+	content := &beaconContent{
+		RelatesTo: event.RelatesTo{Type: event.RelReference, EventID: beaconID},
+		Location:  beaconLocation{URI: evt.Location.String()},
+		Timestamp: ts.UnixMilli(),
+	}
+	_, err = ghost.Intent.SendMessage(ctx, portal.MXID, eventTypeBeacon, &event.Content{Parsed: content}, &bridgev2.MatrixSendExtra{Timestamp: ts})
+	return err
+}
+
+// getOrStartBeacon returns the active beacon of a node in a room, sending a new
+// beacon_info state event if there isn't one or it has timed out
+func (c *MeshtasticConnector) getOrStartBeacon(ctx context.Context, portal *bridgev2.Portal, ghost *bridgev2.Ghost, nodeID meshid.NodeID, ts time.Time) (id.EventID, error) {
+	key := beaconKey{RoomID: portal.MXID, NodeID: nodeID}
+	c.beaconLock.Lock()
+	defer c.beaconLock.Unlock()
+	if b, ok := c.beacons[key]; ok && time.Now().Before(b.Expires) {
+		return b.EventID, nil
+	}
+	content := &beaconInfoContent{
+		Description: ghost.Name,
+		Live:        true,
+		Timeout:     beaconTimeout.Milliseconds(),
+		Timestamp:   ts.UnixMilli(),
+		Asset:       locationAsset{Type: "m.self"},
+	}
+	resp, err := ghost.Intent.SendState(ctx, portal.MXID, eventTypeBeaconInfo, ghost.Intent.GetMXID().String(), &event.Content{Parsed: content}, ts)
+	if err != nil {
+		return "", err
+	}
+	c.beacons[key] = &liveBeacon{
+		EventID: resp.EventID,
+		Expires: ts.Add(beaconTimeout),
+	}
+	return resp.EventID, nil
+}
+
+// stopBeacon ends the live location sharing of a node in a room, if it's active
+func (c *MeshtasticConnector) stopBeacon(ctx context.Context, portal *bridgev2.Portal, ghost *bridgev2.Ghost, nodeID meshid.NodeID) error {
+	key := beaconKey{RoomID: portal.MXID, NodeID: nodeID}
+	c.beaconLock.Lock()
+	defer c.beaconLock.Unlock()
+	b, ok := c.beacons[key]
+	if !ok {
+		return nil
+	}
+	delete(c.beacons, key)
+	if time.Now().After(b.Expires) {
+		return nil
+	}
+	content := &beaconInfoContent{
+		Description: ghost.Name,
+		Live:        false,
+		Timeout:     beaconTimeout.Milliseconds(),
+		Timestamp:   time.Now().UnixMilli(),
+		Asset:       locationAsset{Type: "m.self"},
+	}
+	_, err := ghost.Intent.SendState(ctx, portal.MXID, eventTypeBeaconInfo, ghost.Intent.GetMXID().String(), &event.Content{Parsed: content}, time.Time{})
+	return err
+}
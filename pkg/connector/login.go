@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 
 	// Added time for createWelcomeRoomAndSendIntro call
 
@@ -22,6 +23,7 @@ import (
 const (
 	LoginFlowIDUsernamePassword = "user-pass"
 	LoginStepIDUsernamePassword = "user-pass-input"
+	LoginStepIDClaimNode        = "claim-node"
 	LoginStepIDComplete         = "complete"
 
 	LoginInputFieldTypeMqttTopic bridgev2.LoginInputFieldType = "mqtt-topic"
@@ -29,6 +31,11 @@ const (
 	LoginFieldRootTopic = "root-topic"
 	LoginFieldLongName  = "long-name"
 	LoginFieldShortName = "short-name"
+	LoginFieldNodeID    = "node-id"
+	LoginFieldPrivKey   = "private-key"
+
+	// Entered as the node ID to use the one derived from the Matrix ID
+	loginNodeIDAuto = "auto"
 )
 
 // MeshtasticLogin represents an ongoing username/password login attempt.
@@ -36,6 +43,11 @@ type MeshtasticLogin struct {
 	User *bridgev2.User
 	Main *MeshtasticConnector // Needs access to the connector for LoadUserLogin
 	Log  zerolog.Logger
+
+	// Set while waiting for the private key of a node that was seen on the mesh
+	nodeID    meshid.NodeID
+	longName  string
+	shortName string
 }
 
 // Ensure MeshtasticLogin implements the required interface
@@ -94,6 +106,21 @@ func (sl *MeshtasticLogin) Start(ctx context.Context) (*bridgev2.LoginStep, erro
 						return s, nil
 					},
 				},
+				{
+					Type:        bridgev2.LoginInputFieldTypeUsername,
+					ID:          LoginFieldNodeID,
+					Name:        "Node ID",
+					Description: fmt.Sprintf("A node ID such as !1234abcd, or %q to use %s, which is derived from your Matrix ID", loginNodeIDAuto, meshid.MXIDToNodeID(sl.User.MXID)),
+					Validate: func(s string) (string, error) {
+						s = strings.ToLower(strings.TrimSpace(s))
+						if s == "" || s == loginNodeIDAuto {
+							return loginNodeIDAuto, nil
+						} else if _, err := meshid.ParseNodeID(s); err != nil {
+							return s, fmt.Errorf("must be a node ID or %q", loginNodeIDAuto)
+						}
+						return s, nil
+					},
+				},
 			},
 		},
 	}, nil
@@ -101,6 +128,18 @@ func (sl *MeshtasticLogin) Start(ctx context.Context) (*bridgev2.LoginStep, erro
 
 // SubmitUserInput implements bridgev2.LoginProcessUserInput
 func (sl *MeshtasticLogin) SubmitUserInput(ctx context.Context, input map[string]string) (*bridgev2.LoginStep, error) {
+	if sl.nodeID != 0 {
+		// The node ID belongs to a node seen on the mesh, so this step proves it's theirs
+		privateKey, err := parsePrivateKey(input[LoginFieldPrivKey])
+		if err != nil {
+			return nil, err
+		} else if err = sl.Main.claimNodeID(ctx, sl.nodeID, privateKey); err != nil {
+			return nil, err
+		}
+		sl.Log.Info().Stringer("node_id", sl.nodeID).Msg("Claimed node seen on the mesh")
+		return sl.finishLogin(ctx, sl.nodeID, sl.longName, sl.shortName)
+	}
+
 	long_name := input[LoginFieldLongName]
 	short_name := input[LoginFieldShortName]
 
@@ -109,7 +148,37 @@ func (sl *MeshtasticLogin) SubmitUserInput(ctx context.Context, input map[string
 	}
 
 	userNodeId := meshid.MXIDToNodeID(sl.User.MXID)
+	if custom := input[LoginFieldNodeID]; custom != "" && custom != loginNodeIDAuto {
+		var err error
+		if userNodeId, err = meshid.ParseNodeID(custom); err != nil {
+			return nil, err
+		}
+	}
+
+	claim, err := sl.Main.checkNodeIDClaim(ctx, userNodeId, sl.User.MXID)
+	if err != nil {
+		return nil, err
+	} else if claim == nodeIDNeedsProof {
+		sl.nodeID, sl.longName, sl.shortName = userNodeId, long_name, short_name
+		return &bridgev2.LoginStep{
+			Type:   bridgev2.LoginStepTypeUserInput,
+			StepID: LoginStepIDClaimNode,
+			Instructions: fmt.Sprintf("%s has already been seen on the mesh. To prove it's yours, enter its private key, "+
+				"which can be found in the security settings of the Meshtastic app. Otherwise, start over with a different node ID", userNodeId),
+			UserInputParams: &bridgev2.LoginUserInputParams{
+				Fields: []bridgev2.LoginInputDataField{{
+					Type: bridgev2.LoginInputFieldTypePassword,
+					ID:   LoginFieldPrivKey,
+					Name: "Private key",
+				}},
+			},
+		}, nil
+	}
+	return sl.finishLogin(ctx, userNodeId, long_name, short_name)
+}
 
+// finishLogin creates the user login once the node ID has been settled
+func (sl *MeshtasticLogin) finishLogin(ctx context.Context, userNodeId meshid.NodeID, long_name, short_name string) (*bridgev2.LoginStep, error) {
 	if err := sl.Main.UpdateGhostMeshNames(ctx, meshid.MakeUserID(userNodeId), sl.User.MXID, long_name, short_name); err != nil {
 		sl.Log.Err(err).Msg("Failed to create user login entry")
 		return nil, fmt.Errorf("failed to create user login: %w", err)
@@ -10,20 +10,47 @@ import (
 
 type Database struct {
 	*dbutil.Database
-	MeshNodeInfo *MeshNodeInfoQuery
-	Waypoint     *WaypointQuery
+	// Encrypts the private keys of managed nodes. SetKeys must be called before node info is used
+	Keys            *KeyWrapper
+	MeshNodeInfo    *MeshNodeInfoQuery
+	Waypoint        *WaypointQuery
+	RangeTest       *RangeTestQuery
+	MessageAlias    *MessageAliasQuery
+	Position        *PositionQuery
+	KeyHistory      *KeyHistoryQuery
+	KeyVerification *KeyVerificationQuery
 }
 
 func New(db *dbutil.Database, log zerolog.Logger) *Database {
 	db = db.Child("meshtastic_version", upgrades.Table, dbutil.ZeroLogger(log))
+	keys := &KeyWrapper{}
 	return &Database{
 		Database: db,
+		Keys:     keys,
 		MeshNodeInfo: &MeshNodeInfoQuery{
-			QueryHelper: dbutil.MakeQueryHelper(db, newMeshNodeInfo),
+			QueryHelper: dbutil.MakeQueryHelper(db, func(qh *dbutil.QueryHelper[*MeshNodeInfo]) *MeshNodeInfo {
+				return newMeshNodeInfo(qh, keys)
+			}),
+			keys: keys,
 		},
 		Waypoint: &WaypointQuery{
 			QueryHelper: dbutil.MakeQueryHelper(db, newWaypoint),
 		},
+		RangeTest: &RangeTestQuery{
+			QueryHelper: dbutil.MakeQueryHelper(db, newRangeTestResult),
+		},
+		MessageAlias: &MessageAliasQuery{
+			QueryHelper: dbutil.MakeQueryHelper(db, newMessageAlias),
+		},
+		Position: &PositionQuery{
+			QueryHelper: dbutil.MakeQueryHelper(db, newPosition),
+		},
+		KeyHistory: &KeyHistoryQuery{
+			QueryHelper: dbutil.MakeQueryHelper(db, newKeyHistoryEntry),
+		},
+		KeyVerification: &KeyVerificationQuery{
+			QueryHelper: dbutil.MakeQueryHelper(db, newKeyVerification),
+		},
 	}
 }
 
@@ -0,0 +1,91 @@
+package meshdb
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/kabili207/matrix-meshtastic/pkg/meshid"
+	"go.mau.fi/util/dbutil"
+	"go.mau.fi/util/ptr"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	getKeyHistorySelect         = "SELECT node_id, public_key, first_seen, trusted_at, trusted_by FROM mesh_key_history "
+	getKeyHistoryByNodeQuery    = getKeyHistorySelect + "WHERE node_id=$1 ORDER BY first_seen"
+	setKeyHistoryTrustedQuery   = "UPDATE mesh_key_history SET trusted_at=$3, trusted_by=$4 WHERE node_id=$1 AND public_key=$2"
+	deleteKeyHistoryByNodeQuery = "DELETE FROM mesh_key_history WHERE node_id=$1"
+
+	insertKeyHistoryQuery = `
+		INSERT INTO mesh_key_history (node_id, public_key, first_seen, trusted_at, trusted_by)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (node_id, public_key) DO NOTHING
+	`
+)
+
+type KeyHistoryQuery struct {
+	*dbutil.QueryHelper[*KeyHistoryEntry]
+}
+
+// KeyHistoryEntry is a public key that was announced by a node
+type KeyHistoryEntry struct {
+	qh *dbutil.QueryHelper[*KeyHistoryEntry]
+
+	NodeID    meshid.NodeID
+	PublicKey []byte
+	FirstSeen time.Time
+	// When the key was trusted, either on first use or by a Matrix user
+	TrustedAt *time.Time
+	// The Matrix user who trusted the key. Empty if it was trusted on first use
+	TrustedBy id.UserID
+}
+
+var _ dbutil.DataStruct[*KeyHistoryEntry] = (*KeyHistoryEntry)(nil)
+
+func newKeyHistoryEntry(qh *dbutil.QueryHelper[*KeyHistoryEntry]) *KeyHistoryEntry {
+	return &KeyHistoryEntry{qh: qh}
+}
+
+// GetByNodeID returns all keys announced by a node, oldest first
+func (q *KeyHistoryQuery) GetByNodeID(ctx context.Context, nodeID meshid.NodeID) ([]*KeyHistoryEntry, error) {
+	return q.QueryMany(ctx, getKeyHistoryByNodeQuery, nodeID)
+}
+
+// SetTrusted marks a key of a node as trusted by a Matrix user
+func (q *KeyHistoryQuery) SetTrusted(ctx context.Context, nodeID meshid.NodeID, publicKey []byte, trustedBy id.UserID) error {
+	return q.Exec(ctx, setKeyHistoryTrustedQuery, nodeID, publicKey, time.Now().Unix(), dbutil.StrPtr(trustedBy))
+}
+
+// DeleteByNodeID removes every key recorded for a node
+func (q *KeyHistoryQuery) DeleteByNodeID(ctx context.Context, nodeID meshid.NodeID) error {
+	return q.Exec(ctx, deleteKeyHistoryByNodeQuery, nodeID)
+}
+
+func (k *KeyHistoryEntry) sqlVariables() []any {
+	var trusted *int64
+	if k.TrustedAt != nil {
+		trusted = ptr.Ptr(k.TrustedAt.UTC().Unix())
+	}
+	return []any{k.NodeID, k.PublicKey, k.FirstSeen.UTC().Unix(), trusted, dbutil.StrPtr(k.TrustedBy)}
+}
+
+// Insert records a key, doing nothing if it was already seen from the node
+func (k *KeyHistoryEntry) Insert(ctx context.Context) error {
+	return k.qh.Exec(ctx, insertKeyHistoryQuery, k.sqlVariables()...)
+}
+
+func (k *KeyHistoryEntry) Scan(row dbutil.Scannable) (*KeyHistoryEntry, error) {
+	var firstSeen int64
+	var trusted *int64
+	var trustedBy sql.NullString
+	err := row.Scan(&k.NodeID, &k.PublicKey, &firstSeen, &trusted, &trustedBy)
+	if err == nil {
+		k.FirstSeen = time.Unix(firstSeen, 0)
+		k.TrustedBy = id.UserID(trustedBy.String)
+		if trusted != nil {
+			k.TrustedAt = ptr.Ptr(time.Unix(*trusted, 0))
+		}
+	}
+	return k, err
+}
@@ -0,0 +1,71 @@
+package meshdb
+
+import (
+	"context"
+	"time"
+
+	"github.com/kabili207/matrix-meshtastic/pkg/meshid"
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	getKeyVerificationSelect = "SELECT local_node_id, remote_node_id, public_key, verified_at, verified_by FROM mesh_key_verification "
+	getKeyVerificationQuery  = getKeyVerificationSelect + "WHERE local_node_id=$1 AND remote_node_id=$2"
+	deleteKeyVerification    = "DELETE FROM mesh_key_verification WHERE local_node_id=$1 AND remote_node_id=$2"
+
+	upsertKeyVerificationQuery = `
+		INSERT INTO mesh_key_verification (local_node_id, remote_node_id, public_key, verified_at, verified_by)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (local_node_id, remote_node_id) DO UPDATE
+			SET public_key=excluded.public_key, verified_at=excluded.verified_at, verified_by=excluded.verified_by
+	`
+)
+
+type KeyVerificationQuery struct {
+	*dbutil.QueryHelper[*KeyVerification]
+}
+
+// KeyVerification records that a managed node completed a key verification with a remote node
+type KeyVerification struct {
+	qh *dbutil.QueryHelper[*KeyVerification]
+
+	LocalNodeID  meshid.NodeID
+	RemoteNodeID meshid.NodeID
+	// The public key of the remote node at the time it was verified
+	PublicKey  []byte
+	VerifiedAt time.Time
+	VerifiedBy id.UserID
+}
+
+var _ dbutil.DataStruct[*KeyVerification] = (*KeyVerification)(nil)
+
+func newKeyVerification(qh *dbutil.QueryHelper[*KeyVerification]) *KeyVerification {
+	return &KeyVerification{qh: qh}
+}
+
+func (q *KeyVerificationQuery) Get(ctx context.Context, localNode, remoteNode meshid.NodeID) (*KeyVerification, error) {
+	return q.QueryOne(ctx, getKeyVerificationQuery, localNode, remoteNode)
+}
+
+func (q *KeyVerificationQuery) Delete(ctx context.Context, localNode, remoteNode meshid.NodeID) error {
+	return q.Exec(ctx, deleteKeyVerification, localNode, remoteNode)
+}
+
+func (v *KeyVerification) sqlVariables() []any {
+	return []any{v.LocalNodeID, v.RemoteNodeID, v.PublicKey, v.VerifiedAt.UTC().Unix(), v.VerifiedBy}
+}
+
+// Upsert stores the verification, replacing an earlier one between the same nodes
+func (v *KeyVerification) Upsert(ctx context.Context) error {
+	return v.qh.Exec(ctx, upsertKeyVerificationQuery, v.sqlVariables()...)
+}
+
+func (v *KeyVerification) Scan(row dbutil.Scannable) (*KeyVerification, error) {
+	var verifiedAt int64
+	err := row.Scan(&v.LocalNodeID, &v.RemoteNodeID, &v.PublicKey, &verifiedAt, &v.VerifiedBy)
+	if err == nil {
+		v.VerifiedAt = time.Unix(verifiedAt, 0)
+	}
+	return v, err
+}
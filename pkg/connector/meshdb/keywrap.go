@@ -0,0 +1,155 @@
+package meshdb
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/kabili207/matrix-meshtastic/pkg/meshid"
+)
+
+const (
+	// The length of a key-encryption key, which is used for AES-256-GCM
+	KEKLength = 32
+
+	wrappedKeyVersion = 1
+	kekIDLength       = 4
+	// Curve25519 private keys are always 32 bytes, which is how unencrypted keys are recognized
+	plainPrivateKeyLength = 32
+)
+
+var (
+	ErrNoKEK      = errors.New("no key-encryption key configured")
+	ErrUnknownKEK = errors.New("private key was encrypted with a key-encryption key that isn't configured")
+)
+
+type kek struct {
+	id   []byte
+	aead cipher.AEAD
+}
+
+func newKEK(key []byte) (*kek, error) {
+	if len(key) != KEKLength {
+		return nil, fmt.Errorf("key-encryption key must be %d bytes", KEKLength)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(key)
+	return &kek{id: hash[:kekIDLength], aead: aead}, nil
+}
+
+// KeyWrapper encrypts the private keys of managed nodes with a key-encryption key (KEK) before
+// they're stored, so read access to the database isn't enough to decrypt PKI messages.
+//
+// Wrapped keys are stored as a version byte, the ID of the KEK, the nonce and the ciphertext.
+// The node ID is used as additional data, so keys can't be swapped between rows.
+type KeyWrapper struct {
+	current  *kek
+	previous []*kek
+}
+
+// SetKeys sets the KEK used to encrypt private keys, along with older KEKs that may still be
+// needed to decrypt keys that haven't been rotated yet
+func (w *KeyWrapper) SetKeys(current []byte, previous ...[]byte) error {
+	k, err := newKEK(current)
+	if err != nil {
+		return err
+	}
+	w.current = k
+	w.previous = nil
+	for _, p := range previous {
+		k, err = newKEK(p)
+		if err != nil {
+			return err
+		}
+		w.previous = append(w.previous, k)
+	}
+	return nil
+}
+
+func (w *KeyWrapper) findKEK(id []byte) *kek {
+	if w.current != nil && bytes.Equal(w.current.id, id) {
+		return w.current
+	}
+	for _, k := range w.previous {
+		if bytes.Equal(k.id, id) {
+			return k
+		}
+	}
+	return nil
+}
+
+func nodeAdditionalData(nodeID meshid.NodeID) []byte {
+	return binary.BigEndian.AppendUint32(nil, uint32(nodeID))
+}
+
+// Wrap encrypts the private key of a node with the current KEK
+func (w *KeyWrapper) Wrap(nodeID meshid.NodeID, privateKey []byte) ([]byte, error) {
+	if len(privateKey) == 0 {
+		return nil, nil
+	} else if w.current == nil {
+		return nil, ErrNoKEK
+	}
+	nonce := make([]byte, w.current.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append([]byte{wrappedKeyVersion}, w.current.id...)
+	out = append(out, nonce...)
+	return w.current.aead.Seal(out, nonce, privateKey, nodeAdditionalData(nodeID)), nil
+}
+
+// Unwrap decrypts a private key that was encrypted with Wrap
+func (w *KeyWrapper) Unwrap(nodeID meshid.NodeID, wrapped []byte) ([]byte, error) {
+	if len(wrapped) == 0 {
+		return nil, nil
+	}
+	k, payload, err := w.parseWrapped(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := k.aead.NonceSize()
+	if len(payload) < nonceSize {
+		return nil, errors.New("wrapped private key is too short")
+	}
+	key, err := k.aead.Open(nil, payload[:nonceSize], payload[nonceSize:], nodeAdditionalData(nodeID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt private key of %s: %w", nodeID, err)
+	}
+	return key, nil
+}
+
+func (w *KeyWrapper) parseWrapped(wrapped []byte) (*kek, []byte, error) {
+	if len(wrapped) < 1+kekIDLength || wrapped[0] != wrappedKeyVersion {
+		return nil, nil, errors.New("private key is not in the wrapped format")
+	}
+	k := w.findKEK(wrapped[1 : 1+kekIDLength])
+	if k == nil {
+		return nil, nil, ErrUnknownKEK
+	}
+	return k, wrapped[1+kekIDLength:], nil
+}
+
+// needsRewrap checks if a stored private key is unencrypted, or if rotate is set, if it was
+// encrypted with an older KEK
+func (w *KeyWrapper) needsRewrap(stored []byte, rotate bool) (bool, error) {
+	if len(stored) == plainPrivateKeyLength {
+		return true, nil
+	}
+	k, _, err := w.parseWrapped(stored)
+	if err != nil {
+		return false, err
+	}
+	return rotate && k != w.current, nil
+}
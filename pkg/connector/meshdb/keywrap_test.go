@@ -0,0 +1,104 @@
+package meshdb
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/kabili207/matrix-meshtastic/pkg/meshid"
+)
+
+func testKey(fill byte, length int) []byte {
+	return bytes.Repeat([]byte{fill}, length)
+}
+
+func newTestWrapper(t *testing.T, current []byte, previous ...[]byte) *KeyWrapper {
+	t.Helper()
+	w := &KeyWrapper{}
+	if err := w.SetKeys(current, previous...); err != nil {
+		t.Fatalf("SetKeys failed: %v", err)
+	}
+	return w
+}
+
+func TestKeyWrapRoundTrip(t *testing.T) {
+	w := newTestWrapper(t, testKey(1, KEKLength))
+	privateKey := testKey(0xAB, plainPrivateKeyLength)
+
+	wrapped, err := w.Wrap(meshid.NodeID(0x12345678), privateKey)
+	if err != nil {
+		t.Fatalf("Wrap failed: %v", err)
+	} else if bytes.Contains(wrapped, privateKey) {
+		t.Fatal("Wrapped key contains the plain private key")
+	}
+	unwrapped, err := w.Unwrap(meshid.NodeID(0x12345678), wrapped)
+	if err != nil {
+		t.Fatalf("Unwrap failed: %v", err)
+	} else if !bytes.Equal(unwrapped, privateKey) {
+		t.Fatalf("Unwrap returned %X, want %X", unwrapped, privateKey)
+	}
+}
+
+func TestKeyUnwrapWrongNode(t *testing.T) {
+	w := newTestWrapper(t, testKey(1, KEKLength))
+	wrapped, err := w.Wrap(meshid.NodeID(0x12345678), testKey(0xAB, plainPrivateKeyLength))
+	if err != nil {
+		t.Fatalf("Wrap failed: %v", err)
+	}
+	if _, err = w.Unwrap(meshid.NodeID(0x87654321), wrapped); err == nil {
+		t.Fatal("Unwrap succeeded with the wrong node ID")
+	}
+}
+
+func TestKeyUnwrapAfterRotation(t *testing.T) {
+	oldKEK, newKEK := testKey(1, KEKLength), testKey(2, KEKLength)
+	wrapped, err := newTestWrapper(t, oldKEK).Wrap(meshid.NodeID(0x12345678), testKey(0xAB, plainPrivateKeyLength))
+	if err != nil {
+		t.Fatalf("Wrap failed: %v", err)
+	}
+
+	if _, err = newTestWrapper(t, newKEK).Unwrap(meshid.NodeID(0x12345678), wrapped); !errors.Is(err, ErrUnknownKEK) {
+		t.Fatalf("Unwrap without the old KEK returned %v, want ErrUnknownKEK", err)
+	}
+	if _, err = newTestWrapper(t, newKEK, oldKEK).Unwrap(meshid.NodeID(0x12345678), wrapped); err != nil {
+		t.Fatalf("Unwrap with the old KEK failed: %v", err)
+	}
+}
+
+func TestNeedsRewrap(t *testing.T) {
+	oldKEK, newKEK := testKey(1, KEKLength), testKey(2, KEKLength)
+	nodeID := meshid.NodeID(0x12345678)
+	privateKey := testKey(0xAB, plainPrivateKeyLength)
+	underOld, err := newTestWrapper(t, oldKEK).Wrap(nodeID, privateKey)
+	if err != nil {
+		t.Fatalf("Wrap failed: %v", err)
+	}
+	w := newTestWrapper(t, newKEK, oldKEK)
+	underCurrent, err := w.Wrap(nodeID, privateKey)
+	if err != nil {
+		t.Fatalf("Wrap failed: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		stored []byte
+		rotate bool
+		want   bool
+	}{
+		{"plain", privateKey, false, true},
+		{"plain when rotating", privateKey, true, true},
+		{"older KEK", underOld, false, false},
+		{"older KEK when rotating", underOld, true, true},
+		{"current KEK when rotating", underCurrent, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := w.needsRewrap(tt.stored, tt.rotate)
+			if err != nil {
+				t.Fatalf("needsRewrap failed: %v", err)
+			} else if got != tt.want {
+				t.Errorf("needsRewrap() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -13,7 +13,7 @@ import (
 )
 
 const (
-	getMeshNodeInfoSelect             = "SELECT id, user_id, long_name, short_name, node_role, is_licensed, is_unmessageable, is_managed, is_direct, public_key, private_key, last_seen FROM mesh_node_info "
+	getMeshNodeInfoSelect             = "SELECT id, user_id, long_name, short_name, node_role, is_licensed, is_unmessageable, is_managed, is_direct, public_key, private_key, last_seen, pending_public_key FROM mesh_node_info "
 	getMeshNodeInfoByNodeIDQuery      = getMeshNodeInfoSelect + "WHERE id=$1"
 	getMeshNodeInfoByUserIDQuery      = getMeshNodeInfoSelect + "WHERE user_id=$1"
 	getMeshNodeInfoByShortUserIDQuery = getMeshNodeInfoSelect + "WHERE user_id LIKE $1"
@@ -22,6 +22,9 @@ const (
 
 	setMeshNodeInfoNamesQuery = "UPDATE mesh_node_info SET long_name=$1, short_name=$2 WHERE id = $3"
 
+	getMeshNodeInfoPrivateKeysQuery = "SELECT id, private_key FROM mesh_node_info WHERE private_key IS NOT NULL"
+	setMeshNodeInfoPrivateKeyQuery  = "UPDATE mesh_node_info SET private_key=$2 WHERE id=$1"
+
 	setMeshNodeInfoLastSeen = `
 		INSERT INTO mesh_node_info (id, user_id, is_direct, last_seen)
 		VALUES ($1, $2, $3, $4)
@@ -31,8 +34,8 @@ const (
 	`
 
 	setMeshNodeInfoQuery = `
-		INSERT INTO mesh_node_info (id, user_id, long_name, short_name, node_role, is_licensed, is_unmessageable, is_managed, is_direct, public_key, private_key, last_seen)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		INSERT INTO mesh_node_info (id, user_id, long_name, short_name, node_role, is_licensed, is_unmessageable, is_managed, is_direct, public_key, private_key, last_seen, pending_public_key)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
 		ON CONFLICT (id) DO UPDATE SET
 			user_id=excluded.user_id,
 			long_name=excluded.long_name,
@@ -44,16 +47,19 @@ const (
 			is_direct=excluded.is_direct,
 			public_key=excluded.public_key,
 			private_key=excluded.private_key,
-			last_seen=excluded.last_seen
+			last_seen=excluded.last_seen,
+			pending_public_key=excluded.pending_public_key
 	`
 )
 
 type MeshNodeInfoQuery struct {
 	*dbutil.QueryHelper[*MeshNodeInfo]
+	keys *KeyWrapper
 }
 
 type MeshNodeInfo struct {
-	qh *dbutil.QueryHelper[*MeshNodeInfo]
+	qh   *dbutil.QueryHelper[*MeshNodeInfo]
+	keys *KeyWrapper
 
 	NodeID         meshid.NodeID
 	UserID         string
@@ -65,14 +71,17 @@ type MeshNodeInfo struct {
 	IsManaged      bool
 	IsDirect       bool
 	PublicKey      []byte
-	PrivateKey     []byte
-	LastSeen       *time.Time
+	// The private key of a managed node. It's encrypted when stored, but always decrypted here
+	PrivateKey []byte
+	LastSeen   *time.Time
+	// A public key that differs from the pinned one, which must be trusted before it's used
+	PendingPublicKey []byte
 }
 
 var _ dbutil.DataStruct[*MeshNodeInfo] = (*MeshNodeInfo)(nil)
 
-func newMeshNodeInfo(qh *dbutil.QueryHelper[*MeshNodeInfo]) *MeshNodeInfo {
-	return &MeshNodeInfo{qh: qh}
+func newMeshNodeInfo(qh *dbutil.QueryHelper[*MeshNodeInfo], keys *KeyWrapper) *MeshNodeInfo {
+	return &MeshNodeInfo{qh: qh, keys: keys}
 }
 
 func (q *MeshNodeInfoQuery) GetByNodeID(ctx context.Context, nodeID meshid.NodeID) (*MeshNodeInfo, error) {
@@ -100,16 +109,71 @@ func (q *MeshNodeInfoQuery) GetManagedNodes(ctx context.Context) ([]*MeshNodeInf
 	return q.QueryMany(ctx, getMeshNodeInfoIsManagedQuery)
 }
 
-func (m *MeshNodeInfo) sqlVariables() []any {
+// EncryptPrivateKeys encrypts private keys that are still stored in plain text. If rotate is set,
+// keys encrypted with an older key-encryption key are re-encrypted with the current one.
+// Returns the number of keys that were encrypted
+func (q *MeshNodeInfoQuery) EncryptPrivateKeys(ctx context.Context, rotate bool) (int, error) {
+	rows, err := q.GetDB().Query(ctx, getMeshNodeInfoPrivateKeysQuery)
+	stored, err := dbutil.NewRowIterWithError(rows, func(row dbutil.Scannable) (*MeshNodeInfo, error) {
+		var m MeshNodeInfo
+		return &m, row.Scan(&m.NodeID, &m.PrivateKey)
+	}, err).AsList()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	err = q.GetDB().DoTxn(ctx, nil, func(ctx context.Context) error {
+		for _, m := range stored {
+			if len(m.PrivateKey) == 0 {
+				continue
+			}
+			needsRewrap, err := q.keys.needsRewrap(m.PrivateKey, rotate)
+			if err != nil {
+				return fmt.Errorf("unable to read private key of %s: %w", m.NodeID, err)
+			} else if !needsRewrap {
+				continue
+			}
+			plain := m.PrivateKey
+			if len(plain) != plainPrivateKeyLength {
+				if plain, err = q.keys.Unwrap(m.NodeID, m.PrivateKey); err != nil {
+					return err
+				}
+			}
+			wrapped, err := q.keys.Wrap(m.NodeID, plain)
+			if err != nil {
+				return err
+			}
+			if err = q.Exec(ctx, setMeshNodeInfoPrivateKeyQuery, m.NodeID, wrapped); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (m *MeshNodeInfo) sqlVariables() ([]any, error) {
 	var ts *int64
 	if m.LastSeen != nil {
 		ts = ptr.Ptr(m.LastSeen.UTC().Unix())
 	}
-	return []any{m.NodeID, m.UserID, m.LongName, m.ShortName, m.Role, m.IsLicensed, m.IsUnmessagable, m.IsManaged, m.IsDirect, m.PublicKey, m.PrivateKey, ts}
+	privateKey, err := m.keys.Wrap(m.NodeID, m.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt private key: %w", err)
+	}
+	return []any{m.NodeID, m.UserID, m.LongName, m.ShortName, m.Role, m.IsLicensed, m.IsUnmessagable, m.IsManaged, m.IsDirect, m.PublicKey, privateKey, ts, m.PendingPublicKey}, nil
 }
 
 func (m *MeshNodeInfo) SetAll(ctx context.Context) error {
-	return m.qh.Exec(ctx, setMeshNodeInfoQuery, m.sqlVariables()...)
+	vars, err := m.sqlVariables()
+	if err != nil {
+		return err
+	}
+	return m.qh.Exec(ctx, setMeshNodeInfoQuery, vars...)
 }
 
 func (q *MeshNodeInfoQuery) SetNames(ctx context.Context, nodeID meshid.NodeID, longName, shortName string) error {
@@ -122,9 +186,14 @@ func (q *MeshNodeInfoQuery) SetLastSeen(ctx context.Context, nodeID meshid.NodeI
 
 func (f *MeshNodeInfo) Scan(row dbutil.Scannable) (*MeshNodeInfo, error) {
 	var ts *int64
-	err := row.Scan(&f.NodeID, &f.UserID, &f.LongName, &f.ShortName, &f.Role, &f.IsLicensed, &f.IsUnmessagable, &f.IsManaged, &f.IsDirect, &f.PublicKey, &f.PrivateKey, &ts)
-	if err == nil && ts != nil {
+	var privateKey []byte
+	err := row.Scan(&f.NodeID, &f.UserID, &f.LongName, &f.ShortName, &f.Role, &f.IsLicensed, &f.IsUnmessagable, &f.IsManaged, &f.IsDirect, &f.PublicKey, &privateKey, &ts, &f.PendingPublicKey)
+	if err != nil {
+		return f, err
+	}
+	if ts != nil {
 		f.LastSeen = ptr.Ptr(time.Unix(*ts, 0))
 	}
+	f.PrivateKey, err = f.keys.Unwrap(f.NodeID, privateKey)
 	return f, err
 }
@@ -0,0 +1,74 @@
+package meshdb
+
+import (
+	"context"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+const (
+	getMessageAliasSelect           = "SELECT alias_id, message_id, part_index, created FROM mesh_message_alias "
+	getMessageAliasByAliasIDQuery   = getMessageAliasSelect + "WHERE alias_id=$1"
+	getMessageAliasByMessageIDQuery = getMessageAliasSelect + "WHERE message_id=$1 ORDER BY part_index"
+
+	insertMessageAliasQuery = `
+		INSERT INTO mesh_message_alias (alias_id, message_id, part_index, created)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (alias_id) DO UPDATE
+			SET message_id=excluded.message_id, part_index=excluded.part_index, created=excluded.created
+	`
+	deleteMessageAliasesBeforeQuery = "DELETE FROM mesh_message_alias WHERE created < $1"
+)
+
+type MessageAliasQuery struct {
+	*dbutil.QueryHelper[*MessageAlias]
+}
+
+// MessageAlias maps the ID of an additional packet of a multi-part message
+// to the ID of the bridged message it belongs to
+type MessageAlias struct {
+	qh *dbutil.QueryHelper[*MessageAlias]
+
+	AliasID   networkid.MessageID
+	MessageID networkid.MessageID
+	PartIndex int
+	Created   time.Time
+}
+
+var _ dbutil.DataStruct[*MessageAlias] = (*MessageAlias)(nil)
+
+func newMessageAlias(qh *dbutil.QueryHelper[*MessageAlias]) *MessageAlias {
+	return &MessageAlias{qh: qh}
+}
+
+func (q *MessageAliasQuery) GetByAliasID(ctx context.Context, aliasID networkid.MessageID) (*MessageAlias, error) {
+	return q.QueryOne(ctx, getMessageAliasByAliasIDQuery, aliasID)
+}
+
+func (q *MessageAliasQuery) GetByMessageID(ctx context.Context, messageID networkid.MessageID) ([]*MessageAlias, error) {
+	return q.QueryMany(ctx, getMessageAliasByMessageIDQuery, messageID)
+}
+
+// DeleteBefore removes aliases created before the given time
+func (q *MessageAliasQuery) DeleteBefore(ctx context.Context, before time.Time) error {
+	return q.Exec(ctx, deleteMessageAliasesBeforeQuery, before.UTC().Unix())
+}
+
+func (a *MessageAlias) sqlVariables() []any {
+	return []any{a.AliasID, a.MessageID, a.PartIndex, a.Created.UTC().Unix()}
+}
+
+func (a *MessageAlias) Insert(ctx context.Context) error {
+	return a.qh.Exec(ctx, insertMessageAliasQuery, a.sqlVariables()...)
+}
+
+func (a *MessageAlias) Scan(row dbutil.Scannable) (*MessageAlias, error) {
+	var created int64
+	err := row.Scan(&a.AliasID, &a.MessageID, &a.PartIndex, &created)
+	if err == nil {
+		a.Created = time.Unix(created, 0)
+	}
+	return a, err
+}
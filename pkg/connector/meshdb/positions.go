@@ -0,0 +1,87 @@
+package meshdb
+
+import (
+	"context"
+	"time"
+
+	"github.com/kabili207/matrix-meshtastic/pkg/meshid"
+	"go.mau.fi/util/dbutil"
+)
+
+const (
+	getPositionSelect           = "SELECT node_id, received, latitude, longitude, altitude, precision_meters, ground_speed, ground_track, sats_in_view, gateway FROM mesh_positions "
+	getPositionByNodeSinceQuery = getPositionSelect + "WHERE node_id=$1 AND received >= $2 ORDER BY received"
+
+	insertPositionQuery = `
+		INSERT INTO mesh_positions (node_id, received, latitude, longitude, altitude, precision_meters, ground_speed, ground_track, sats_in_view, gateway)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (node_id, received) DO NOTHING
+	`
+	deletePositionsBeforeQuery = "DELETE FROM mesh_positions WHERE received < $1"
+	// Keeps the newest positions of each node, deleting anything older than the Nth newest
+	trimPositionsPerNodeQuery = `
+		DELETE FROM mesh_positions WHERE received < (
+			SELECT p.received FROM mesh_positions p
+			WHERE p.node_id = mesh_positions.node_id
+			ORDER BY p.received DESC LIMIT 1 OFFSET $1
+		)
+	`
+)
+
+type PositionQuery struct {
+	*dbutil.QueryHelper[*Position]
+}
+
+// Position is a single position report received from a node
+type Position struct {
+	qh *dbutil.QueryHelper[*Position]
+
+	NodeID      meshid.NodeID
+	Received    time.Time
+	Latitude    float32
+	Longitude   float32
+	Altitude    *float32
+	Precision   *float32
+	GroundSpeed *uint32
+	GroundTrack *uint32
+	SatsInView  *uint32
+	Gateway     *meshid.NodeID
+}
+
+var _ dbutil.DataStruct[*Position] = (*Position)(nil)
+
+func newPosition(qh *dbutil.QueryHelper[*Position]) *Position {
+	return &Position{qh: qh}
+}
+
+// GetByNodeSince returns the positions reported by a node since the given time, oldest first
+func (q *PositionQuery) GetByNodeSince(ctx context.Context, nodeID meshid.NodeID, since time.Time) ([]*Position, error) {
+	return q.QueryMany(ctx, getPositionByNodeSinceQuery, nodeID, since.UTC().Unix())
+}
+
+// DeleteBefore removes all positions received before the given time
+func (q *PositionQuery) DeleteBefore(ctx context.Context, before time.Time) error {
+	return q.Exec(ctx, deletePositionsBeforeQuery, before.UTC().Unix())
+}
+
+// TrimPerNode removes all but the newest positions of each node
+func (q *PositionQuery) TrimPerNode(ctx context.Context, keep int) error {
+	return q.Exec(ctx, trimPositionsPerNodeQuery, keep-1)
+}
+
+func (p *Position) sqlVariables() []any {
+	return []any{p.NodeID, p.Received.UTC().Unix(), p.Latitude, p.Longitude, p.Altitude, p.Precision, p.GroundSpeed, p.GroundTrack, p.SatsInView, p.Gateway}
+}
+
+func (p *Position) Insert(ctx context.Context) error {
+	return p.qh.Exec(ctx, insertPositionQuery, p.sqlVariables()...)
+}
+
+func (p *Position) Scan(row dbutil.Scannable) (*Position, error) {
+	var received int64
+	err := row.Scan(&p.NodeID, &received, &p.Latitude, &p.Longitude, &p.Altitude, &p.Precision, &p.GroundSpeed, &p.GroundTrack, &p.SatsInView, &p.Gateway)
+	if err == nil {
+		p.Received = time.Unix(received, 0)
+	}
+	return p, err
+}
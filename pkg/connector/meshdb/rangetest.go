@@ -0,0 +1,69 @@
+package meshdb
+
+import (
+	"context"
+	"time"
+
+	"github.com/kabili207/matrix-meshtastic/pkg/meshid"
+	"go.mau.fi/util/dbutil"
+)
+
+const (
+	getRangeTestSelect         = "SELECT node_id, channel_name, seq, gateway, rx_snr, rx_rssi, hop_count, latitude, longitude, gateway_latitude, gateway_longitude, received FROM mesh_range_test "
+	getRangeTestByChannelQuery = getRangeTestSelect + "WHERE channel_name=$1 AND received >= $2 AND received <= $3 ORDER BY received"
+
+	insertRangeTestQuery = `
+		INSERT INTO mesh_range_test (node_id, channel_name, seq, gateway, rx_snr, rx_rssi, hop_count, latitude, longitude, gateway_latitude, gateway_longitude, received)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		ON CONFLICT (node_id, received, seq, gateway) DO NOTHING
+	`
+)
+
+type RangeTestQuery struct {
+	*dbutil.QueryHelper[*RangeTestResult]
+}
+
+type RangeTestResult struct {
+	qh *dbutil.QueryHelper[*RangeTestResult]
+
+	NodeID           meshid.NodeID
+	ChannelName      string
+	Sequence         uint32
+	Gateway          meshid.NodeID
+	RxSnr            float32
+	RxRssi           int32
+	HopCount         uint32
+	Latitude         *float32
+	Longitude        *float32
+	GatewayLatitude  *float32
+	GatewayLongitude *float32
+	Received         time.Time
+}
+
+var _ dbutil.DataStruct[*RangeTestResult] = (*RangeTestResult)(nil)
+
+func newRangeTestResult(qh *dbutil.QueryHelper[*RangeTestResult]) *RangeTestResult {
+	return &RangeTestResult{qh: qh}
+}
+
+// GetByChannel returns all results received on a channel between the given times, oldest first
+func (q *RangeTestQuery) GetByChannel(ctx context.Context, channelName string, since, until time.Time) ([]*RangeTestResult, error) {
+	return q.QueryMany(ctx, getRangeTestByChannelQuery, channelName, since.UTC().Unix(), until.UTC().Unix())
+}
+
+func (r *RangeTestResult) sqlVariables() []any {
+	return []any{r.NodeID, r.ChannelName, r.Sequence, r.Gateway, r.RxSnr, r.RxRssi, r.HopCount, r.Latitude, r.Longitude, r.GatewayLatitude, r.GatewayLongitude, r.Received.UTC().Unix()}
+}
+
+func (r *RangeTestResult) Insert(ctx context.Context) error {
+	return r.qh.Exec(ctx, insertRangeTestQuery, r.sqlVariables()...)
+}
+
+func (r *RangeTestResult) Scan(row dbutil.Scannable) (*RangeTestResult, error) {
+	var received int64
+	err := row.Scan(&r.NodeID, &r.ChannelName, &r.Sequence, &r.Gateway, &r.RxSnr, &r.RxRssi, &r.HopCount, &r.Latitude, &r.Longitude, &r.GatewayLatitude, &r.GatewayLongitude, &received)
+	if err == nil {
+		r.Received = time.Unix(received, 0)
+	}
+	return r, err
+}
@@ -1,4 +1,4 @@
--- v0 -> v2: Latest revision
+-- v0 -> v11: Latest revision
 
 CREATE TABLE mesh_node_info (
     -- 0 = unset, 1 = non-lora broadcast, 4294967295 = broadcast
@@ -17,6 +17,7 @@ CREATE TABLE mesh_node_info (
     public_key       BYTEA,
     private_key      BYTEA,
     last_seen        BIGINT,
+    pending_public_key BYTEA,
 
     PRIMARY KEY (id),
     CONSTRAINT mesh_node_info_user_id UNIQUE (user_id)
@@ -42,10 +43,98 @@ CREATE TABLE mesh_waypoints (
     -- only: postgres
     updated_by      BIGINT NOT NULL CHECK (updated_by > 1 AND updated_by < '4294967295'::BIGINT),
     updated_date    BIGINT NOT NULL,
+    room_mxid       TEXT,
+    event_mxid      TEXT,
+    warned_expiry   BIGINT,
 
     PRIMARY KEY (id),
     CONSTRAINT mesh_waypoints_locked_to_fkey FOREIGN KEY (locked_to)
         REFERENCES mesh_node_info (id) ON UPDATE CASCADE ON DELETE CASCADE,
     CONSTRAINT mesh_waypoints_updated_by_fkey FOREIGN KEY (updated_by)
         REFERENCES mesh_node_info (id) ON UPDATE CASCADE ON DELETE CASCADE
-)
\ No newline at end of file
+);
+
+CREATE TABLE mesh_range_test (
+    -- only: sqlite (line commented)
+--	node_id           BIGINT NOT NULL CHECK (node_id >= 2 AND node_id < 4294967295),
+    -- only: postgres
+    node_id           BIGINT NOT NULL CHECK (node_id >= 2 AND node_id < '4294967295'::BIGINT),
+    channel_name      VARCHAR(32) NOT NULL,
+    seq               BIGINT NOT NULL,
+    gateway           BIGINT NOT NULL,
+    rx_snr            REAL NOT NULL,
+    rx_rssi           INTEGER NOT NULL,
+    hop_count         INTEGER NOT NULL,
+    latitude          REAL,
+    longitude         REAL,
+    gateway_latitude  REAL,
+    gateway_longitude REAL,
+    received          BIGINT NOT NULL,
+
+    PRIMARY KEY (node_id, received, seq, gateway)
+);
+
+CREATE INDEX mesh_range_test_channel_idx ON mesh_range_test (channel_name, received);
+
+CREATE TABLE mesh_message_alias (
+    alias_id   TEXT    NOT NULL PRIMARY KEY,
+    message_id TEXT    NOT NULL,
+    part_index INTEGER NOT NULL,
+    created    BIGINT  NOT NULL DEFAULT 0
+);
+
+CREATE INDEX mesh_message_alias_message_idx ON mesh_message_alias (message_id);
+CREATE INDEX mesh_message_alias_created_idx ON mesh_message_alias (created);
+
+CREATE TABLE mesh_positions (
+    -- only: sqlite (line commented)
+--	node_id          BIGINT NOT NULL CHECK (node_id >= 2 AND node_id < 4294967295),
+    -- only: postgres
+    node_id          BIGINT NOT NULL CHECK (node_id >= 2 AND node_id < '4294967295'::BIGINT),
+    received         BIGINT NOT NULL,
+    latitude         REAL NOT NULL,
+    longitude        REAL NOT NULL,
+    altitude         REAL,
+    precision_meters REAL,
+    ground_speed     INTEGER,
+    ground_track     INTEGER,
+    sats_in_view     INTEGER,
+    gateway          BIGINT,
+
+    PRIMARY KEY (node_id, received)
+);
+
+CREATE INDEX mesh_positions_received_idx ON mesh_positions (received);
+
+CREATE TABLE mesh_key_history (
+    -- only: sqlite (line commented)
+--	node_id     BIGINT NOT NULL CHECK (node_id >= 2 AND node_id < 4294967295),
+    -- only: postgres
+    node_id     BIGINT NOT NULL CHECK (node_id >= 2 AND node_id < '4294967295'::BIGINT),
+    public_key  BYTEA NOT NULL,
+    first_seen  BIGINT NOT NULL,
+    trusted_at  BIGINT,
+    trusted_by  TEXT,
+
+    PRIMARY KEY (node_id, public_key),
+    CONSTRAINT mesh_key_history_node_id_fkey FOREIGN KEY (node_id)
+        REFERENCES mesh_node_info (id) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE TABLE mesh_key_verification (
+    -- only: sqlite (line commented)
+--	local_node_id  BIGINT NOT NULL CHECK (local_node_id >= 2 AND local_node_id < 4294967295),
+    -- only: postgres
+    local_node_id  BIGINT NOT NULL CHECK (local_node_id >= 2 AND local_node_id < '4294967295'::BIGINT),
+    -- only: sqlite (line commented)
+--	remote_node_id BIGINT NOT NULL CHECK (remote_node_id >= 2 AND remote_node_id < 4294967295),
+    -- only: postgres
+    remote_node_id BIGINT NOT NULL CHECK (remote_node_id >= 2 AND remote_node_id < '4294967295'::BIGINT),
+    public_key     BYTEA NOT NULL,
+    verified_at    BIGINT NOT NULL,
+    verified_by    TEXT NOT NULL,
+
+    PRIMARY KEY (local_node_id, remote_node_id),
+    CONSTRAINT mesh_key_verification_remote_node_id_fkey FOREIGN KEY (remote_node_id)
+        REFERENCES mesh_node_info (id) ON UPDATE CASCADE ON DELETE CASCADE
+);
@@ -0,0 +1,23 @@
+-- v3: Add range test results
+
+CREATE TABLE mesh_range_test (
+    -- only: sqlite (line commented)
+--	node_id           BIGINT NOT NULL CHECK (node_id >= 2 AND node_id < 4294967295),
+    -- only: postgres
+    node_id           BIGINT NOT NULL CHECK (node_id >= 2 AND node_id < '4294967295'::BIGINT),
+    channel_name      VARCHAR(32) NOT NULL,
+    seq               BIGINT NOT NULL,
+    gateway           BIGINT NOT NULL,
+    rx_snr            REAL NOT NULL,
+    rx_rssi           INTEGER NOT NULL,
+    hop_count         INTEGER NOT NULL,
+    latitude          REAL,
+    longitude         REAL,
+    gateway_latitude  REAL,
+    gateway_longitude REAL,
+    received          BIGINT NOT NULL,
+
+    PRIMARY KEY (node_id, received, seq)
+);
+
+CREATE INDEX mesh_range_test_channel_idx ON mesh_range_test (channel_name, received);
@@ -0,0 +1,9 @@
+-- v4: Add message aliases for split messages
+
+CREATE TABLE mesh_message_alias (
+    alias_id   TEXT    NOT NULL PRIMARY KEY,
+    message_id TEXT    NOT NULL,
+    part_index INTEGER NOT NULL
+);
+
+CREATE INDEX mesh_message_alias_message_idx ON mesh_message_alias (message_id);
@@ -0,0 +1,4 @@
+-- v5: Track the Matrix events of bridged waypoints
+
+ALTER TABLE mesh_waypoints ADD COLUMN room_mxid TEXT;
+ALTER TABLE mesh_waypoints ADD COLUMN event_mxid TEXT;
@@ -0,0 +1,3 @@
+-- v6: Track expiry warnings sent for waypoints
+
+ALTER TABLE mesh_waypoints ADD COLUMN warned_expiry BIGINT;
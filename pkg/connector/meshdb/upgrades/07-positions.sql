@@ -0,0 +1,21 @@
+-- v7: Add position history
+
+CREATE TABLE mesh_positions (
+    -- only: sqlite (line commented)
+--	node_id          BIGINT NOT NULL CHECK (node_id >= 2 AND node_id < 4294967295),
+    -- only: postgres
+    node_id          BIGINT NOT NULL CHECK (node_id >= 2 AND node_id < '4294967295'::BIGINT),
+    received         BIGINT NOT NULL,
+    latitude         REAL NOT NULL,
+    longitude        REAL NOT NULL,
+    altitude         REAL,
+    precision_meters REAL,
+    ground_speed     INTEGER,
+    ground_track     INTEGER,
+    sats_in_view     INTEGER,
+    gateway          BIGINT,
+
+    PRIMARY KEY (node_id, received)
+);
+
+CREATE INDEX mesh_positions_received_idx ON mesh_positions (received);
@@ -0,0 +1,24 @@
+-- v8: Pin node public keys and keep a history of the keys seen
+
+ALTER TABLE mesh_node_info ADD COLUMN pending_public_key BYTEA;
+
+CREATE TABLE mesh_key_history (
+    -- only: sqlite (line commented)
+--	node_id     BIGINT NOT NULL CHECK (node_id >= 2 AND node_id < 4294967295),
+    -- only: postgres
+    node_id     BIGINT NOT NULL CHECK (node_id >= 2 AND node_id < '4294967295'::BIGINT),
+    public_key  BYTEA NOT NULL,
+    first_seen  BIGINT NOT NULL,
+    trusted_at  BIGINT,
+    trusted_by  TEXT,
+
+    PRIMARY KEY (node_id, public_key),
+    CONSTRAINT mesh_key_history_node_id_fkey FOREIGN KEY (node_id)
+        REFERENCES mesh_node_info (id) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+-- Keys that were already known are treated as trusted on first use
+INSERT INTO mesh_key_history (node_id, public_key, first_seen, trusted_at)
+SELECT id, public_key, COALESCE(last_seen, 0), COALESCE(last_seen, 0)
+FROM mesh_node_info
+WHERE public_key IS NOT NULL AND length(public_key) > 0 AND is_managed = false;
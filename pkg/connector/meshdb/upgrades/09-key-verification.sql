@@ -0,0 +1,19 @@
+-- v9: Store the results of key verifications with remote nodes
+
+CREATE TABLE mesh_key_verification (
+    -- only: sqlite (line commented)
+--	local_node_id  BIGINT NOT NULL CHECK (local_node_id >= 2 AND local_node_id < 4294967295),
+    -- only: postgres
+    local_node_id  BIGINT NOT NULL CHECK (local_node_id >= 2 AND local_node_id < '4294967295'::BIGINT),
+    -- only: sqlite (line commented)
+--	remote_node_id BIGINT NOT NULL CHECK (remote_node_id >= 2 AND remote_node_id < 4294967295),
+    -- only: postgres
+    remote_node_id BIGINT NOT NULL CHECK (remote_node_id >= 2 AND remote_node_id < '4294967295'::BIGINT),
+    public_key     BYTEA NOT NULL,
+    verified_at    BIGINT NOT NULL,
+    verified_by    TEXT NOT NULL,
+
+    PRIMARY KEY (local_node_id, remote_node_id),
+    CONSTRAINT mesh_key_verification_remote_node_id_fkey FOREIGN KEY (remote_node_id)
+        REFERENCES mesh_node_info (id) ON UPDATE CASCADE ON DELETE CASCADE
+);
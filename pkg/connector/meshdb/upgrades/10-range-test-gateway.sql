@@ -0,0 +1,30 @@
+-- v10: Keep range test packets heard by more than one gateway
+
+CREATE TABLE mesh_range_test_new (
+    -- only: sqlite (line commented)
+--	node_id           BIGINT NOT NULL CHECK (node_id >= 2 AND node_id < 4294967295),
+    -- only: postgres
+    node_id           BIGINT NOT NULL CHECK (node_id >= 2 AND node_id < '4294967295'::BIGINT),
+    channel_name      VARCHAR(32) NOT NULL,
+    seq               BIGINT NOT NULL,
+    gateway           BIGINT NOT NULL,
+    rx_snr            REAL NOT NULL,
+    rx_rssi           INTEGER NOT NULL,
+    hop_count         INTEGER NOT NULL,
+    latitude          REAL,
+    longitude         REAL,
+    gateway_latitude  REAL,
+    gateway_longitude REAL,
+    received          BIGINT NOT NULL,
+
+    PRIMARY KEY (node_id, received, seq, gateway)
+);
+
+INSERT INTO mesh_range_test_new (node_id, channel_name, seq, gateway, rx_snr, rx_rssi, hop_count, latitude, longitude, gateway_latitude, gateway_longitude, received)
+SELECT node_id, channel_name, seq, gateway, rx_snr, rx_rssi, hop_count, latitude, longitude, gateway_latitude, gateway_longitude, received
+FROM mesh_range_test;
+
+DROP TABLE mesh_range_test;
+ALTER TABLE mesh_range_test_new RENAME TO mesh_range_test;
+
+CREATE INDEX mesh_range_test_channel_idx ON mesh_range_test (channel_name, received);
@@ -0,0 +1,8 @@
+-- v11: Track when message aliases were created so old ones can be pruned
+
+ALTER TABLE mesh_message_alias ADD COLUMN created BIGINT NOT NULL DEFAULT 0;
+-- only: sqlite (line commented)
+--UPDATE mesh_message_alias SET created=CAST(strftime('%s', 'now') AS BIGINT);
+-- only: postgres
+UPDATE mesh_message_alias SET created=CAST(EXTRACT(EPOCH FROM NOW()) AS BIGINT);
+CREATE INDEX mesh_message_alias_created_idx ON mesh_message_alias (created);
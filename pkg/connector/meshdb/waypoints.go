@@ -2,23 +2,28 @@ package meshdb
 
 import (
 	"context"
+	"database/sql"
 	"time"
 
 	"github.com/kabili207/matrix-meshtastic/pkg/meshid"
 	"go.mau.fi/util/dbutil"
 	"go.mau.fi/util/ptr"
+	"maunium.net/go/mautrix/id"
 )
 
 const (
-	getWaypointSelect            = "SELECT id, name, icon, description, latitude, longitude, locked_to, expires, updated_by, updated_date FROM mesh_waypoints "
-	getWaypointByWaypointIDQuery = getWaypointSelect + "WHERE id=$1"
-	getWaypointByNodeIDQuery     = getWaypointSelect + "WHERE locked_to=$1 or updated_by=$1"
+	getWaypointSelect               = "SELECT id, name, icon, description, latitude, longitude, locked_to, expires, updated_by, updated_date, room_mxid, event_mxid, warned_expiry FROM mesh_waypoints "
+	getWaypointByWaypointIDQuery    = getWaypointSelect + "WHERE id=$1"
+	getWaypointByNodeIDQuery        = getWaypointSelect + "WHERE locked_to=$1 or updated_by=$1"
+	getWaypointExpiredQuery         = getWaypointSelect + "WHERE expires IS NOT NULL AND expires <= $1"
+	getWaypointUnwarnedExpiryQuery  = getWaypointSelect + "WHERE expires IS NOT NULL AND expires <= $1 AND (warned_expiry IS NULL OR warned_expiry <> expires)"
+	getWaypointInactiveAuthorsQuery = getWaypointSelect + "WHERE updated_by IN (SELECT id FROM mesh_node_info WHERE last_seen < $1)"
 
 	deleteWaypointByWaypointIDQuery = "DELETE FROM mesh_waypoints WHERE id=$1"
 
 	setWaypointQuery = `
-		INSERT INTO mesh_waypoints (id, name, icon, description, latitude, longitude, locked_to, expires, updated_by, updated_date)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		INSERT INTO mesh_waypoints (id, name, icon, description, latitude, longitude, locked_to, expires, updated_by, updated_date, room_mxid, event_mxid, warned_expiry)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
 		ON CONFLICT (id) DO UPDATE SET
 			name=excluded.name,
 			icon=excluded.icon,
@@ -28,7 +33,10 @@ const (
 			locked_to=excluded.locked_to,
 			expires=excluded.expires,
 			updated_by=excluded.updated_by,
-			updated_date=excluded.updated_date
+			updated_date=excluded.updated_date,
+			room_mxid=excluded.room_mxid,
+			event_mxid=excluded.event_mxid,
+			warned_expiry=excluded.warned_expiry
 	`
 )
 
@@ -49,6 +57,11 @@ type Waypoint struct {
 	Expires     *time.Time
 	UpdatedBy   meshid.NodeID
 	UpdatedDate *time.Time
+	// The Matrix room and event the waypoint was bridged to, if any
+	RoomMXID  id.RoomID
+	EventMXID id.EventID
+	// The expiry time the author was last warned about
+	WarnedExpiry *time.Time
 }
 
 var _ dbutil.DataStruct[*Waypoint] = (*Waypoint)(nil)
@@ -64,19 +77,39 @@ func (q *WaypointQuery) GetByWaypointID(ctx context.Context, waypointID uint32)
 func (q *WaypointQuery) GetByNodeID(ctx context.Context, nodeID meshid.NodeID) ([]*Waypoint, error) {
 	return q.QueryMany(ctx, getWaypointByNodeIDQuery, nodeID)
 }
+
+// GetExpired returns all waypoints that expired before the given time
+func (q *WaypointQuery) GetExpired(ctx context.Context, before time.Time) ([]*Waypoint, error) {
+	return q.QueryMany(ctx, getWaypointExpiredQuery, before.Unix())
+}
+
+// GetUnwarnedExpiring returns the waypoints expiring before the given time whose
+// authors haven't been warned about that expiry yet
+func (q *WaypointQuery) GetUnwarnedExpiring(ctx context.Context, before time.Time) ([]*Waypoint, error) {
+	return q.QueryMany(ctx, getWaypointUnwarnedExpiryQuery, before.Unix())
+}
+
+// GetByInactiveAuthors returns the waypoints last updated by nodes not seen since the given time
+func (q *WaypointQuery) GetByInactiveAuthors(ctx context.Context, lastSeen time.Time) ([]*Waypoint, error) {
+	return q.QueryMany(ctx, getWaypointInactiveAuthorsQuery, lastSeen.Unix())
+}
+
 func (q *WaypointQuery) DeleteByID(ctx context.Context, waypointID uint32) error {
 	return q.Exec(ctx, deleteWaypointByWaypointIDQuery, waypointID)
 }
 
 func (w *Waypoint) sqlVariables() []any {
-	var expires, updated *int64
+	var expires, updated, warned *int64
 	if w.Expires != nil {
 		expires = ptr.Ptr(w.Expires.UTC().Unix())
 	}
 	if w.UpdatedDate != nil {
 		updated = ptr.Ptr(w.UpdatedDate.UTC().Unix())
 	}
-	return []any{w.WaypointID, w.Name, w.Icon, w.Description, w.Latitude, w.Longitude, w.LockedTo, expires, w.UpdatedBy, updated}
+	if w.WarnedExpiry != nil {
+		warned = ptr.Ptr(w.WarnedExpiry.UTC().Unix())
+	}
+	return []any{w.WaypointID, w.Name, w.Icon, w.Description, w.Latitude, w.Longitude, w.LockedTo, expires, w.UpdatedBy, updated, dbutil.StrPtr(w.RoomMXID), dbutil.StrPtr(w.EventMXID), warned}
 }
 
 func (w *Waypoint) SetAll(ctx context.Context) error {
@@ -84,15 +117,21 @@ func (w *Waypoint) SetAll(ctx context.Context) error {
 }
 
 func (w *Waypoint) Scan(row dbutil.Scannable) (*Waypoint, error) {
-	var expires, updated *int64
-	err := row.Scan(&w.WaypointID, &w.Name, &w.Icon, &w.Description, &w.Latitude, &w.Longitude, &w.LockedTo, &expires, &w.UpdatedBy, &updated)
+	var expires, updated, warned *int64
+	var roomMXID, eventMXID sql.NullString
+	err := row.Scan(&w.WaypointID, &w.Name, &w.Icon, &w.Description, &w.Latitude, &w.Longitude, &w.LockedTo, &expires, &w.UpdatedBy, &updated, &roomMXID, &eventMXID, &warned)
 	if err == nil {
+		w.RoomMXID = id.RoomID(roomMXID.String)
+		w.EventMXID = id.EventID(eventMXID.String)
 		if expires != nil {
 			w.Expires = ptr.Ptr(time.Unix(*expires, 0))
 		}
 		if updated != nil {
 			w.UpdatedDate = ptr.Ptr(time.Unix(*updated, 0))
 		}
+		if warned != nil {
+			w.WarnedExpiry = ptr.Ptr(time.Unix(*warned, 0))
+		}
 	}
 	return w, err
 }
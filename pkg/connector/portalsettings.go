@@ -0,0 +1,147 @@
+package connector
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/kabili207/matrix-meshtastic/pkg/meshid"
+	"go.mau.fi/util/ptr"
+	"maunium.net/go/mautrix/bridgev2"
+)
+
+// portalSetting describes a per-portal option that can be changed with the portal-setting command
+type portalSetting struct {
+	Name        string
+	Description string
+	Values      []string
+	Get         func(meta *meshid.PortalMetadata) string
+	Set         func(meta *meshid.PortalMetadata, value string) error
+}
+
+var portalSettings = []*portalSetting{
+	{
+		Name:        "alert-highlight",
+		Description: "Mention everyone in the room when an alert or detection sensor packet is received",
+		Values:      []string{"on", "off"},
+		Get: func(meta *meshid.PortalMetadata) string {
+			return formatOnOff(meta.ShouldHighlightAlerts())
+		},
+		Set: func(meta *meshid.PortalMetadata, value string) error {
+			val, err := parseOnOff(value)
+			if err != nil {
+				return err
+			}
+			meta.AlertHighlight = ptr.Ptr(val)
+			return nil
+		},
+	},
+	{
+		Name:        "compress-text",
+		Description: "Compress messages that are too long for a single packet, if that makes them fit",
+		Values:      []string{"on", "off", "default"},
+		Get: func(meta *meshid.PortalMetadata) string {
+			if meta.CompressText == nil {
+				return "default"
+			}
+			return formatOnOff(*meta.CompressText)
+		},
+		Set: func(meta *meshid.PortalMetadata, value string) error {
+			if strings.EqualFold(value, "default") {
+				meta.CompressText = nil
+				return nil
+			}
+			val, err := parseOnOff(value)
+			if err != nil {
+				return err
+			}
+			meta.CompressText = ptr.Ptr(val)
+			return nil
+		},
+	},
+	{
+		Name:        "locations",
+		Description: "Show position updates of nodes that opted in with share-location as live location beacons, location messages, or not at all",
+		Values:      []string{meshid.LocationModeBeacon, meshid.LocationModeMessage, meshid.LocationModeOff},
+		Get: func(meta *meshid.PortalMetadata) string {
+			return meta.GetLocationMode()
+		},
+		Set: func(meta *meshid.PortalMetadata, value string) error {
+			switch value = strings.ToLower(value); value {
+			case meshid.LocationModeBeacon, meshid.LocationModeMessage, meshid.LocationModeOff:
+				meta.LocationMode = value
+				return nil
+			}
+			return fmt.Errorf("expected beacon, message or off, got %q", value)
+		},
+	},
+	{
+		Name:        "position-precision",
+		Description: "The most bits of precision locations sent to this channel may have, where 32 is exact and 0 refuses locations",
+		Values:      []string{"0-32", "default"},
+		Get: func(meta *meshid.PortalMetadata) string {
+			return formatPrecisionLimit(meta.PositionPrecision)
+		},
+		Set: func(meta *meshid.PortalMetadata, value string) (err error) {
+			meta.PositionPrecision, err = parsePrecisionLimit(value)
+			return err
+		},
+	},
+}
+
+// getPortalSetting finds a portal setting by name
+func getPortalSetting(name string) *portalSetting {
+	for _, s := range portalSettings {
+		if s.Name == strings.ToLower(name) {
+			return s
+		}
+	}
+	return nil
+}
+
+// getPortalMetadata returns the metadata for a portal, initializing it if needed
+func getPortalMetadata(portal *bridgev2.Portal) *meshid.PortalMetadata {
+	meta, ok := portal.Metadata.(*meshid.PortalMetadata)
+	if !ok || meta == nil {
+		meta = &meshid.PortalMetadata{}
+		portal.Metadata = meta
+	}
+	return meta
+}
+
+// formatPrecisionLimit formats an optional limit on the bits of precision of locations
+func formatPrecisionLimit(limit *uint32) string {
+	if limit == nil {
+		return "default"
+	}
+	return strconv.FormatUint(uint64(*limit), 10)
+}
+
+// parsePrecisionLimit parses a number of bits of precision between 0 and 32, or "default" to remove the limit
+func parsePrecisionLimit(value string) (*uint32, error) {
+	if strings.EqualFold(value, "default") {
+		return nil, nil
+	}
+	bits, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || bits > 32 {
+		return nil, fmt.Errorf("expected a number of bits between 0 and 32, or default, got %q", value)
+	}
+	return ptr.Ptr(uint32(bits)), nil
+}
+
+func formatOnOff(val bool) string {
+	if val {
+		return "on"
+	}
+	return "off"
+}
+
+func parseOnOff(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "on", "true", "yes", "1":
+		return true, nil
+	case "off", "false", "no", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("expected on or off, got %q", value)
+}
@@ -0,0 +1,182 @@
+package connector
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kabili207/matrix-meshtastic/pkg/connector/meshdb"
+	"github.com/kabili207/matrix-meshtastic/pkg/mesh"
+	"github.com/kabili207/matrix-meshtastic/pkg/meshid"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/event"
+)
+
+// The period covered by the track command when no start time is given
+const trackDefaultWindow = 24 * time.Hour
+
+// recordPosition stores a position report in the position history
+func (c *MeshtasticConnector) recordPosition(ctx context.Context, evt *mesh.MeshLocationEvent) error {
+	pos := c.meshDB.Position.New()
+	pos.NodeID = evt.From
+	pos.Received = time.Unix(int64(evt.Timestamp), 0)
+	pos.Latitude = evt.Location.Latitude
+	pos.Longitude = evt.Location.Longitude
+	pos.Altitude = evt.Location.Altitude
+	pos.Precision = evt.Location.Uncertainty
+	pos.GroundSpeed = evt.GroundSpeed
+	pos.GroundTrack = evt.GroundTrack
+	pos.SatsInView = evt.SatsInView
+	if evt.Via != 0 {
+		pos.Gateway = &evt.Via
+	}
+	return pos.Insert(ctx)
+}
+
+// canSeeNode checks if a Matrix user may look at the position history of a node. Besides admins
+// and the owner of the node, that's anyone who shares a portal with the node through one of their logins
+func (c *MeshtasticConnector) canSeeNode(ctx context.Context, user *bridgev2.User, nodeID meshid.NodeID) (bool, error) {
+	if user.Permissions.Admin {
+		return true, nil
+	}
+	ghost, err := c.bridge.GetExistingGhostByID(ctx, meshid.MakeUserID(nodeID))
+	if err != nil || ghost == nil {
+		return false, err
+	}
+	if meta, ok := ghost.Metadata.(*meshid.GhostMetadata); ok && meta.UserMXID == user.MXID {
+		return true, nil
+	}
+	ghostMXID := ghost.Intent.GetMXID()
+	for _, login := range user.GetUserLogins() {
+		userPortals, err := c.bridge.DB.UserPortal.GetAllForLogin(ctx, login.UserLogin)
+		if err != nil {
+			return false, err
+		}
+		for _, up := range userPortals {
+			portal, err := c.bridge.GetExistingPortalByKey(ctx, up.Portal)
+			if err != nil || portal == nil || portal.MXID == "" {
+				continue
+			}
+			member, err := c.bridge.Matrix.GetMemberInfo(ctx, portal.MXID, ghostMXID)
+			if err == nil && member != nil && member.Membership == event.MembershipJoin {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// prunePositions applies the retention limits to the position history
+func (c *MeshtasticConnector) prunePositions(ctx context.Context) {
+	cfg := c.Config.PositionHistory
+	if cfg.RetentionDays > 0 {
+		before := time.Now().Add(-time.Duration(cfg.RetentionDays) * 24 * time.Hour)
+		if err := c.meshDB.Position.DeleteBefore(ctx, before); err != nil {
+			c.log.Err(err).Msg("Failed to delete old positions")
+		}
+	}
+	if cfg.MaxPerNode > 0 {
+		if err := c.meshDB.Position.TrimPerNode(ctx, cfg.MaxPerNode); err != nil {
+			c.log.Err(err).Msg("Failed to trim position history")
+		}
+	}
+}
+
+// trackStats holds aggregated information about the path of a node
+type trackStats struct {
+	Points   int
+	Distance float64
+	MaxSpeed uint32
+	First    *meshdb.Position
+	Last     *meshdb.Position
+}
+
+func summarizeTrack(positions []*meshdb.Position) *trackStats {
+	stats := &trackStats{Points: len(positions)}
+	var prev *meshid.GeoURI
+	for _, p := range positions {
+		if stats.First == nil {
+			stats.First = p
+		}
+		stats.Last = p
+		geo := &meshid.GeoURI{Latitude: p.Latitude, Longitude: p.Longitude}
+		if prev != nil {
+			stats.Distance += prev.DistanceTo(geo)
+		}
+		prev = geo
+		if p.GroundSpeed != nil {
+			stats.MaxSpeed = max(stats.MaxSpeed, *p.GroundSpeed)
+		}
+	}
+	return stats
+}
+
+// formatTrackSummary creates a human-readable summary of the path of a node
+func (c *MeshtasticConnector) formatTrackSummary(nodeID meshid.NodeID, since time.Time, positions []*meshdb.Position) string {
+	var sb strings.Builder
+
+	sb.WriteString(fmt.Sprintf("**Track of %s** since %s\n", c.getNodeDisplayName(nodeID), since.UTC().Format(time.RFC1123)))
+	if len(positions) == 0 {
+		sb.WriteString("No positions were received")
+		return sb.String()
+	}
+
+	stats := summarizeTrack(positions)
+	sb.WriteString(fmt.Sprintf("Positions: %d\n", stats.Points))
+	sb.WriteString(fmt.Sprintf("First: %s\n", stats.First.Received.UTC().Format(time.RFC1123)))
+	sb.WriteString(fmt.Sprintf("Last: %s\n", stats.Last.Received.UTC().Format(time.RFC1123)))
+	sb.WriteString(fmt.Sprintf("Distance: %.2f km\n", stats.Distance/1000))
+	if stats.MaxSpeed > 0 {
+		sb.WriteString(fmt.Sprintf("Max speed: %d m/s\n", stats.MaxSpeed))
+	}
+	last := meshid.GeoURI{Latitude: stats.Last.Latitude, Longitude: stats.Last.Longitude}
+	sb.WriteString(fmt.Sprintf("Last position: %s", last.String()))
+	return sb.String()
+}
+
+type gpxFile struct {
+	XMLName xml.Name `xml:"gpx"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Version string   `xml:"version,attr"`
+	Creator string   `xml:"creator,attr"`
+	Track   gpxTrack `xml:"trk"`
+}
+
+type gpxTrack struct {
+	Name    string          `xml:"name"`
+	Segment []gpxTrackPoint `xml:"trkseg>trkpt"`
+}
+
+type gpxTrackPoint struct {
+	Latitude  float32  `xml:"lat,attr"`
+	Longitude float32  `xml:"lon,attr"`
+	Elevation *float32 `xml:"ele,omitempty"`
+	Time      string   `xml:"time"`
+	Sats      *uint32  `xml:"sat,omitempty"`
+}
+
+// trackGPX renders the path of a node as a GPX file
+func trackGPX(name string, positions []*meshdb.Position) ([]byte, error) {
+	gpx := gpxFile{
+		Xmlns:   "http://www.topografix.com/GPX/1/1",
+		Version: "1.1",
+		Creator: "matrix-meshtastic",
+		Track:   gpxTrack{Name: name},
+	}
+	for _, p := range positions {
+		gpx.Track.Segment = append(gpx.Track.Segment, gpxTrackPoint{
+			Latitude:  p.Latitude,
+			Longitude: p.Longitude,
+			Elevation: p.Altitude,
+			Time:      p.Received.UTC().Format(time.RFC3339),
+			Sats:      p.SatsInView,
+		})
+	}
+	data, err := xml.MarshalIndent(gpx, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
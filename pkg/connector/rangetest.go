@@ -0,0 +1,399 @@
+package connector
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kabili207/matrix-meshtastic/pkg/connector/meshdb"
+	"github.com/kabili207/matrix-meshtastic/pkg/mesh"
+	"github.com/kabili207/matrix-meshtastic/pkg/meshid"
+	"go.mau.fi/util/ptr"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	// RangeTestMinInterval matches the shortest sender interval allowed by the firmware range test module
+	RangeTestMinInterval = 15 * time.Second
+	// rangeTestDefaultWindow is how far back summaries look when no session has been run on a channel
+	rangeTestDefaultWindow = 24 * time.Hour
+	// lastPositionMaxAge is how long a reported position is used for range test distances. Older
+	// positions are forgotten, so nodes that stop reporting don't stay in memory forever
+	lastPositionMaxAge = 24 * time.Hour
+)
+
+// RangeTestSession tracks a managed node that is sending sequenced range test packets
+type RangeTestSession struct {
+	FromNode meshid.NodeID
+	Channel  meshid.ChannelDef
+	RoomID   id.RoomID
+	Interval time.Duration
+	Started  time.Time
+	Sent     atomic.Uint32
+
+	stopped atomic.Pointer[time.Time]
+	cancel  context.CancelFunc
+}
+
+// IsRunning indicates if the session is still sending packets
+func (s *RangeTestSession) IsRunning() bool {
+	return s.stopped.Load() == nil
+}
+
+// Stopped returns when the session was stopped, or nil if it's still running
+func (s *RangeTestSession) Stopped() *time.Time {
+	return s.stopped.Load()
+}
+
+// rangeTestKey identifies a range test session by sending node and channel name
+type rangeTestKey struct {
+	From    meshid.NodeID
+	Channel string
+}
+
+// RangeTestTracker manages active and recently finished range test sessions
+type RangeTestTracker struct {
+	mu       sync.Mutex
+	sessions map[rangeTestKey]*RangeTestSession
+}
+
+// NewRangeTestTracker creates a new RangeTestTracker
+func NewRangeTestTracker() *RangeTestTracker {
+	return &RangeTestTracker{
+		sessions: make(map[rangeTestKey]*RangeTestSession),
+	}
+}
+
+// Get returns the most recent session for a node and channel, if any
+func (t *RangeTestTracker) Get(from meshid.NodeID, channelName string) *RangeTestSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sessions[rangeTestKey{From: from, Channel: channelName}]
+}
+
+// Add registers a new session, replacing any finished session for the same node and channel
+func (t *RangeTestTracker) Add(session *RangeTestSession) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := rangeTestKey{From: session.FromNode, Channel: session.Channel.GetName()}
+	if existing, ok := t.sessions[key]; ok && existing.IsRunning() {
+		return errors.New("a range test is already running on this channel")
+	}
+	t.sessions[key] = session
+	return nil
+}
+
+// Stop ends the session for a node and channel and returns it
+func (t *RangeTestTracker) Stop(from meshid.NodeID, channelName string) *RangeTestSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	session, ok := t.sessions[rangeTestKey{From: from, Channel: channelName}]
+	if !ok || !session.IsRunning() {
+		return nil
+	}
+	session.cancel()
+	session.stopped.Store(ptr.Ptr(time.Now()))
+	return session
+}
+
+// StopAll ends every running session
+func (t *RangeTestTracker) StopAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for _, session := range t.sessions {
+		if session.IsRunning() {
+			session.cancel()
+			session.stopped.Store(&now)
+		}
+	}
+}
+
+// startRangeTest begins sending sequenced range test packets from a managed node
+func (c *MeshtasticConnector) startRangeTest(from meshid.NodeID, channel meshid.ChannelDef, interval time.Duration, roomID id.RoomID) (*RangeTestSession, error) {
+	if interval < RangeTestMinInterval {
+		return nil, fmt.Errorf("interval must be at least %s", RangeTestMinInterval)
+	}
+	if cfg := c.getChannelConfig(channel); cfg != nil && !cfg.DownlinkEnabled() {
+		return nil, errDownlinkDisabled
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	session := &RangeTestSession{
+		FromNode: from,
+		Channel:  channel,
+		RoomID:   roomID,
+		Interval: interval,
+		Started:  time.Now(),
+		cancel:   cancel,
+	}
+	if err := c.rangeTestTracker.Add(session); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	log := c.log.With().
+		Str("action", "range_test").
+		Stringer("from_node_id", from).
+		Str("channel", channel.GetName()).
+		Logger()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for seq := uint32(1); ; seq++ {
+			if _, err := c.meshClient.SendRangeTest(from, channel, seq); err != nil {
+				log.Err(err).Uint32("seq", seq).Msg("Failed to send range test packet")
+			} else {
+				session.Sent.Store(seq)
+			}
+			select {
+			case <-ctx.Done():
+				log.Info().Uint32("sent", session.Sent.Load()).Msg("Range test stopped")
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	log.Info().Dur("interval", interval).Msg("Range test started")
+	return session, nil
+}
+
+// handleMeshRangeTest records an incoming range test packet along with the last known positions
+func (c *MeshtasticConnector) handleMeshRangeTest(evt *mesh.MeshRangeTestEvent) {
+	log := c.log.With().
+		Str("action", "handle_range_test").
+		Stringer("from_node_id", evt.From).
+		Stringer("gateway", evt.Via).
+		Uint32("seq", evt.Sequence).
+		Logger()
+	ctx := log.WithContext(context.Background())
+
+	c.getRemoteGhost(ctx, meshid.MakeUserID(evt.From), true)
+	c.meshDB.MeshNodeInfo.SetLastSeen(ctx, evt.From, evt.IsNeighbor)
+
+	result := c.meshDB.RangeTest.New()
+	result.NodeID = evt.From
+	result.ChannelName = evt.ChannelName
+	result.Sequence = evt.Sequence
+	result.Gateway = evt.Via
+	result.RxSnr = evt.RxSnr
+	result.RxRssi = evt.RxRssi
+	result.HopCount = evt.HopCount
+	result.Received = time.Unix(int64(evt.Timestamp), 0)
+	if pos := c.getLastPosition(evt.From); pos != nil {
+		result.Latitude, result.Longitude = &pos.Latitude, &pos.Longitude
+	}
+	if pos := c.getLastPosition(evt.Via); pos != nil {
+		result.GatewayLatitude, result.GatewayLongitude = &pos.Latitude, &pos.Longitude
+	}
+
+	if err := result.Insert(ctx); err != nil {
+		log.Err(err).Msg("Failed to save range test result")
+		return
+	}
+	log.Debug().
+		Float32("snr", evt.RxSnr).
+		Int32("rssi", evt.RxRssi).
+		Uint32("hops", evt.HopCount).
+		Msg("Range test packet recorded")
+}
+
+// lastPosition is the most recent position reported by a node
+type lastPosition struct {
+	Location meshid.GeoURI
+	Received time.Time
+}
+
+// setLastPosition caches the most recent position reported by a node. Positions that are too old
+// to be used are swept out at most once per lastPositionMaxAge
+func (c *MeshtasticConnector) setLastPosition(nodeID meshid.NodeID, location meshid.GeoURI) {
+	c.positionLock.Lock()
+	defer c.positionLock.Unlock()
+	now := time.Now()
+	c.lastPositions[nodeID] = lastPosition{Location: location, Received: now}
+	if now.Sub(c.lastPositionSweep) < lastPositionMaxAge {
+		return
+	}
+	c.lastPositionSweep = now
+	for id, pos := range c.lastPositions {
+		if now.Sub(pos.Received) > lastPositionMaxAge {
+			delete(c.lastPositions, id)
+		}
+	}
+}
+
+// getLastPosition returns the most recent position reported by a node, if known and recent enough
+func (c *MeshtasticConnector) getLastPosition(nodeID meshid.NodeID) *meshid.GeoURI {
+	c.positionLock.RLock()
+	defer c.positionLock.RUnlock()
+	if pos, ok := c.lastPositions[nodeID]; ok && time.Since(pos.Received) <= lastPositionMaxAge {
+		return &pos.Location
+	}
+	return nil
+}
+
+// getRangeTestResults returns the results received on a channel during the last session
+// sent by the node, or during the default window if the node has not run a session
+func (c *MeshtasticConnector) getRangeTestResults(ctx context.Context, from meshid.NodeID, channelName string) ([]*meshdb.RangeTestResult, error) {
+	until := time.Now()
+	since := until.Add(-rangeTestDefaultWindow)
+	if session := c.rangeTestTracker.Get(from, channelName); session != nil {
+		since = session.Started
+		if stopped := session.Stopped(); stopped != nil {
+			until = *stopped
+		}
+	}
+	return c.meshDB.RangeTest.GetByChannel(ctx, channelName, since, until)
+}
+
+// rangeTestStats holds aggregated range test results for a single sender and gateway pair
+type rangeTestStats struct {
+	Sender      meshid.NodeID
+	Gateway     meshid.NodeID
+	Received    int
+	MinSeq      uint32
+	MaxSeq      uint32
+	SnrTotal    float64
+	RssiTotal   int64
+	MaxHops     uint32
+	DistTotal   float64
+	DistSamples int
+	MaxDistance float64
+}
+
+func (s *rangeTestStats) expected() int {
+	return int(s.MaxSeq-s.MinSeq) + 1
+}
+
+func (s *rangeTestStats) packetLoss() float64 {
+	return 100 * (1 - float64(s.Received)/float64(s.expected()))
+}
+
+func (s *rangeTestStats) add(result *meshdb.RangeTestResult) {
+	if s.Received == 0 || result.Sequence < s.MinSeq {
+		s.MinSeq = result.Sequence
+	}
+	if result.Sequence > s.MaxSeq {
+		s.MaxSeq = result.Sequence
+	}
+	s.Received++
+	s.SnrTotal += float64(result.RxSnr)
+	s.RssiTotal += int64(result.RxRssi)
+	s.MaxHops = max(s.MaxHops, result.HopCount)
+	if result.Latitude != nil && result.GatewayLatitude != nil {
+		from := meshid.GeoURI{Latitude: *result.Latitude, Longitude: *result.Longitude}
+		to := meshid.GeoURI{Latitude: *result.GatewayLatitude, Longitude: *result.GatewayLongitude}
+		dist := from.DistanceTo(&to)
+		s.DistTotal += dist
+		s.DistSamples++
+		s.MaxDistance = max(s.MaxDistance, dist)
+	}
+}
+
+// aggregateRangeTest groups range test results by sender and gateway
+func aggregateRangeTest(results []*meshdb.RangeTestResult) []*rangeTestStats {
+	type statsKey struct{ sender, gateway meshid.NodeID }
+	grouped := map[statsKey]*rangeTestStats{}
+	for _, r := range results {
+		key := statsKey{r.NodeID, r.Gateway}
+		stats, ok := grouped[key]
+		if !ok {
+			stats = &rangeTestStats{Sender: r.NodeID, Gateway: r.Gateway}
+			grouped[key] = stats
+		}
+		stats.add(r)
+	}
+
+	list := make([]*rangeTestStats, 0, len(grouped))
+	for _, s := range grouped {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Sender != list[j].Sender {
+			return list[i].Sender < list[j].Sender
+		}
+		return list[i].Gateway < list[j].Gateway
+	})
+	return list
+}
+
+// formatRangeTestSummary creates a human-readable summary of range test results
+func (c *MeshtasticConnector) formatRangeTestSummary(channelName string, session *RangeTestSession, results []*meshdb.RangeTestResult) string {
+	var sb strings.Builder
+
+	sb.WriteString(fmt.Sprintf("**Range test results for %s**\n", channelName))
+	if session != nil {
+		sb.WriteString(fmt.Sprintf("Sent %d packets from %s every %s\n", session.Sent.Load(), c.getNodeDisplayName(session.FromNode), session.Interval))
+	}
+	if len(results) == 0 {
+		sb.WriteString("No range test packets were received")
+		return sb.String()
+	}
+
+	for _, s := range aggregateRangeTest(results) {
+		sb.WriteString(fmt.Sprintf("\n**%s** via %s\n", c.getNodeDisplayName(s.Sender), c.getNodeDisplayName(s.Gateway)))
+		sb.WriteString(fmt.Sprintf("&nbsp;&nbsp;Received: %d/%d (%.1f%% loss)\n", s.Received, s.expected(), s.packetLoss()))
+		sb.WriteString(fmt.Sprintf("&nbsp;&nbsp;Avg SNR: %.2f dB, Avg RSSI: %d dBm\n", s.SnrTotal/float64(s.Received), s.RssiTotal/int64(s.Received)))
+		sb.WriteString(fmt.Sprintf("&nbsp;&nbsp;Max hops: %d\n", s.MaxHops))
+		if s.DistSamples > 0 {
+			sb.WriteString(fmt.Sprintf("&nbsp;&nbsp;Distance: %.2f km avg, %.2f km max\n", s.DistTotal/float64(s.DistSamples)/1000, s.MaxDistance/1000))
+		} else {
+			sb.WriteString("&nbsp;&nbsp;Distance: *unknown*\n")
+		}
+	}
+
+	return sb.String()
+}
+
+// rangeTestCSV renders range test results as a CSV file
+func rangeTestCSV(results []*meshdb.RangeTestResult) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+
+	formatCoord := func(f *float32) string {
+		if f == nil {
+			return ""
+		}
+		return strconv.FormatFloat(float64(*f), 'f', 7, 32)
+	}
+
+	w.Write([]string{"received", "node_id", "channel", "seq", "gateway", "rx_snr", "rx_rssi", "hop_count", "latitude", "longitude", "gateway_latitude", "gateway_longitude", "distance_m"})
+	for _, r := range results {
+		dist := ""
+		if r.Latitude != nil && r.GatewayLatitude != nil {
+			from := meshid.GeoURI{Latitude: *r.Latitude, Longitude: *r.Longitude}
+			to := meshid.GeoURI{Latitude: *r.GatewayLatitude, Longitude: *r.GatewayLongitude}
+			dist = strconv.FormatFloat(from.DistanceTo(&to), 'f', 1, 64)
+		}
+		w.Write([]string{
+			r.Received.UTC().Format(time.RFC3339),
+			r.NodeID.String(),
+			r.ChannelName,
+			strconv.FormatUint(uint64(r.Sequence), 10),
+			r.Gateway.String(),
+			strconv.FormatFloat(float64(r.RxSnr), 'f', 2, 32),
+			strconv.FormatInt(int64(r.RxRssi), 10),
+			strconv.FormatUint(uint64(r.HopCount), 10),
+			formatCoord(r.Latitude),
+			formatCoord(r.Longitude),
+			formatCoord(r.GatewayLatitude),
+			formatCoord(r.GatewayLongitude),
+			dist,
+		})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
@@ -0,0 +1,179 @@
+package connector
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kabili207/matrix-meshtastic/pkg/mesh"
+)
+
+// The largest part count that will be treated as a multi-part marker
+const maxReassemblyParts = 20
+
+var (
+	// Matches markers at the start of a message, such as "(1/3) text", "[1/3] text" and "1/3: text"
+	partPrefixRegex = regexp.MustCompile(`^\s*(?:[(\[](\d{1,2})\s*/\s*(\d{1,2})[)\]]|(\d{1,2})/(\d{1,2}):)\s*`)
+	// Matches markers at the end of a message, such as "text (1/3)" and "text [1/3]"
+	partSuffixRegex = regexp.MustCompile(`\s*[(\[](\d{1,2})\s*/\s*(\d{1,2})[)\]]\s*$`)
+)
+
+// parsePartMarker looks for a multi-part marker in a message, returning the part
+// index, the total number of parts, and the message with the marker removed
+func parsePartMarker(message string) (index, total int, text string, ok bool) {
+	var indexStr, totalStr string
+	if m := partPrefixRegex.FindStringSubmatch(message); m != nil {
+		indexStr, totalStr = m[1], m[2]
+		if indexStr == "" {
+			indexStr, totalStr = m[3], m[4]
+		}
+		text = message[len(m[0]):]
+	} else if m := partSuffixRegex.FindStringSubmatch(message); m != nil {
+		indexStr, totalStr = m[1], m[2]
+		text = message[:len(message)-len(m[0])]
+	} else {
+		return 0, 0, message, false
+	}
+	index, _ = strconv.Atoi(indexStr)
+	total, _ = strconv.Atoi(totalStr)
+	if total < 2 || total > maxReassemblyParts || index < 1 || index > total || strings.TrimSpace(text) == "" {
+		return 0, 0, message, false
+	}
+	return index, total, text, true
+}
+
+type partialMessage struct {
+	// The login the first part was received through, which the combined message is queued with
+	client *MeshtasticClient
+	total  int
+	parts  map[int]*mesh.MeshMessageEvent
+	timer  *time.Timer
+}
+
+// reassembledMessage is a message combined from the parts of a multi-part message
+type reassembledMessage struct {
+	// The combined message, using the packet ID of the part with the lowest index that was received
+	Message *mesh.MeshMessageEvent
+	// Packet IDs of the other parts that were received
+	AliasPacketIDs []uint32
+	// Indexes of any parts that never arrived
+	MissingParts []int
+	TotalParts   int
+}
+
+// MessageReassembler buffers the parts of numbered multi-part messages until all parts
+// have arrived or the timeout passes. It's shared by all logins, so channel messages
+// received through several of them are only buffered once, unless portals are split
+type MessageReassembler struct {
+	lock    sync.Mutex
+	pending map[string]*partialMessage
+	timeout time.Duration
+	emit    func(client *MeshtasticClient, msg *reassembledMessage)
+}
+
+func NewMessageReassembler(timeout time.Duration, emit func(client *MeshtasticClient, msg *reassembledMessage)) *MessageReassembler {
+	return &MessageReassembler{
+		pending: make(map[string]*partialMessage),
+		timeout: timeout,
+		emit:    emit,
+	}
+}
+
+// Add buffers a message if it is part of a multi-part message. It returns false if
+// the message doesn't have a part marker and should be handled normally
+func (r *MessageReassembler) Add(client *MeshtasticClient, evt *mesh.MeshMessageEvent, messIDSender string) bool {
+	index, total, text, ok := parsePartMarker(evt.Message)
+	if !ok {
+		return false
+	}
+	part := *evt
+	part.Message = text
+	key := fmt.Sprintf("%s|%s|%s|%d", messIDSender, evt.From, evt.To, total)
+	if client.bridge.Config.SplitPortals {
+		// Every login has its own portal for the channel, so each one needs its own copy
+		key += "|" + string(client.UserLogin.ID)
+	}
+
+	r.lock.Lock()
+	pm, ok := r.pending[key]
+	if !ok {
+		pm = &partialMessage{
+			client: client,
+			total:  total,
+			parts:  make(map[int]*mesh.MeshMessageEvent),
+		}
+		pm.timer = time.AfterFunc(r.timeout, func() { r.complete(key, pm) })
+		r.pending[key] = pm
+	}
+	if _, exists := pm.parts[index]; !exists {
+		pm.parts[index] = &part
+	}
+	done := len(pm.parts) == pm.total
+	r.lock.Unlock()
+
+	if done {
+		r.complete(key, pm)
+	}
+	return true
+}
+
+// Flush emits all pending messages, regardless of whether they are complete
+func (r *MessageReassembler) Flush() {
+	r.lock.Lock()
+	pending := r.pending
+	r.pending = make(map[string]*partialMessage)
+	r.lock.Unlock()
+	for _, pm := range pending {
+		pm.timer.Stop()
+		r.emit(pm.client, pm.combine())
+	}
+}
+
+func (r *MessageReassembler) complete(key string, pm *partialMessage) {
+	r.lock.Lock()
+	if r.pending[key] != pm {
+		// Already emitted by the timer or a flush
+		r.lock.Unlock()
+		return
+	}
+	delete(r.pending, key)
+	pm.timer.Stop()
+	r.lock.Unlock()
+	r.emit(pm.client, pm.combine())
+}
+
+func (pm *partialMessage) combine() *reassembledMessage {
+	indexes := make([]int, 0, len(pm.parts))
+	for i := range pm.parts {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	combined := *pm.parts[indexes[0]]
+	result := &reassembledMessage{
+		Message:    &combined,
+		TotalParts: pm.total,
+	}
+	texts := make([]string, 0, pm.total)
+	for i := 1; i <= pm.total; i++ {
+		part, ok := pm.parts[i]
+		if !ok {
+			result.MissingParts = append(result.MissingParts, i)
+			texts = append(texts, "[…]")
+			continue
+		}
+		texts = append(texts, part.Message)
+		if combined.ReplyId == 0 {
+			combined.ReplyId = part.ReplyId
+		}
+		if part != pm.parts[indexes[0]] {
+			result.AliasPacketIDs = append(result.AliasPacketIDs, part.PacketId)
+		}
+	}
+	combined.Message = strings.Join(texts, " ")
+	return result
+}
@@ -0,0 +1,245 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/kabili207/matrix-meshtastic/pkg/mesh"
+	"github.com/kabili207/matrix-meshtastic/pkg/meshid"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/id"
+)
+
+const zeroWidthJoiner = '\u200d'
+
+// Aliases are only needed for replies and reactions to recent messages
+const messageAliasRetention = 30 * 24 * time.Hour
+
+// sendTextMessage sends a text message, splitting it into several packets if it is too long
+// to fit in one. Only the first part is sent before returning, so the Matrix event isn't held
+// up while the rest are sent with the configured delay. The remaining parts are stored as
+// aliases of the message once sent, and failures are reported in the room with a notice
+func (c *MeshtasticClient) sendTextMessage(ctx context.Context, from, to meshid.NodeID, channel meshid.ChannelDef, message string, replyID uint32, usePKI, allowCompression bool, roomID id.RoomID, messIDSender string) (uint32, error) {
+	if callsign := c.main.getCallsign(from); callsign != "" {
+		message = withStationID(message, callsign)
+	}
+	// Held until every part is sent, so parts of different messages to the same destination aren't interleaved
+	splitLock := c.destinationSplitLock(to, channel)
+	splitLock.Lock()
+	cfg := c.main.Config.MessageSplitting
+	if !cfg.Enabled || mesh.TextFits(message, allowCompression) {
+		defer splitLock.Unlock()
+		return c.MeshClient.SendMessage(from, to, channel, message, replyID, usePKI, allowCompression)
+	}
+
+	parts := splitForSending(message, cfg.Numbered, allowCompression)
+	if len(parts) > cfg.MaxParts {
+		splitLock.Unlock()
+		return 0, fmt.Errorf("message is too long: it would need %d parts, but at most %d are allowed", len(parts), cfg.MaxParts)
+	}
+	packetID, err := c.MeshClient.SendMessage(from, to, channel, parts[0], replyID, usePKI, allowCompression)
+	if err != nil {
+		splitLock.Unlock()
+		return 0, fmt.Errorf("failed to send part 1 of %d: %w", len(parts), err)
+	}
+
+	messageID := meshid.MakeMessageID(messIDSender, packetID)
+	log := zerolog.Ctx(ctx).With().Str("message_id", string(messageID)).Logger()
+	go func() {
+		defer splitLock.Unlock()
+		ctx := log.WithContext(context.Background())
+		for i, part := range parts[1:] {
+			if cfg.DelaySeconds > 0 {
+				time.Sleep(time.Duration(cfg.DelaySeconds) * time.Second)
+			}
+			// Only the first part is sent as a reply, otherwise clients show the quote on every part
+			partID, err := c.MeshClient.SendMessage(from, to, channel, part, 0, usePKI, allowCompression)
+			if err != nil {
+				log.Err(err).Int("part", i+2).Int("parts", len(parts)).Msg("Failed to send message part")
+				c.main.sendNoticeToRoom(ctx, roomID, fmt.Sprintf("Only %d of %d parts of your message were sent to the mesh: %v", i+1, len(parts), err))
+				return
+			}
+			alias := c.main.meshDB.MessageAlias.New()
+			alias.AliasID = meshid.MakeMessageID(messIDSender, partID)
+			alias.MessageID = messageID
+			alias.PartIndex = i + 1
+			alias.Created = time.Now()
+			if err = alias.Insert(ctx); err != nil {
+				log.Err(err).Msg("Failed to store message part alias")
+			}
+		}
+	}()
+	return packetID, nil
+}
+
+// destinationSplitLock returns the lock for a channel or DM target, so sending a long message
+// doesn't hold up messages to the other portals of the login
+func (c *MeshtasticClient) destinationSplitLock(to meshid.NodeID, channel meshid.ChannelDef) *sync.Mutex {
+	key := to.String()
+	if to == meshid.BROADCAST_ID {
+		key = channelConfigKey(channel)
+	}
+	c.splitLocksLock.Lock()
+	defer c.splitLocksLock.Unlock()
+	if c.splitLocks == nil {
+		c.splitLocks = map[string]*sync.Mutex{}
+	}
+	lock, ok := c.splitLocks[key]
+	if !ok {
+		lock = &sync.Mutex{}
+		c.splitLocks[key] = lock
+	}
+	return lock
+}
+
+// splitForSending splits a message into parts that each fit in a packet. When compression is
+// allowed, parts are made as long as they can be while still fitting once compressed
+func splitForSending(message string, numbered, allowCompression bool) []string {
+	parts := splitMessage(message, mesh.MaxPayloadLen, numbered)
+	if !allowCompression {
+		return parts
+	}
+	allFit := func(parts []string) bool {
+		for _, part := range parts {
+			if !mesh.TextFits(part, true) {
+				return false
+			}
+		}
+		return true
+	}
+	for lo, hi := mesh.MaxPayloadLen+1, len(message); lo <= hi; {
+		limit := (lo + hi) / 2
+		if candidate := splitMessage(message, limit, numbered); allFit(candidate) {
+			parts = candidate
+			lo = limit + 1
+		} else {
+			hi = limit - 1
+		}
+	}
+	return parts
+}
+
+// storeMessageAliases records the IDs of the additional packets of a multi-part message
+// so replies and reactions to any part can be mapped back to the bridged message
+func (c *MeshtasticConnector) storeMessageAliases(ctx context.Context, messageID networkid.MessageID, aliasIDs []networkid.MessageID) error {
+	for i, aliasID := range aliasIDs {
+		alias := c.meshDB.MessageAlias.New()
+		alias.AliasID = aliasID
+		alias.MessageID = messageID
+		alias.PartIndex = i + 1
+		alias.Created = time.Now()
+		if err := alias.Insert(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneMessageAliases removes the aliases of messages older than messageAliasRetention
+func (c *MeshtasticConnector) pruneMessageAliases(ctx context.Context) {
+	if err := c.meshDB.MessageAlias.DeleteBefore(ctx, time.Now().Add(-messageAliasRetention)); err != nil {
+		c.log.Err(err).Msg("Failed to delete old message aliases")
+	}
+}
+
+// resolveMessageID maps the ID of any part of a multi-part message to the ID of the bridged message.
+// IDs that aren't known aliases are returned unchanged
+func (c *MeshtasticConnector) resolveMessageID(ctx context.Context, messageID networkid.MessageID) networkid.MessageID {
+	alias, err := c.meshDB.MessageAlias.GetByAliasID(ctx, messageID)
+	if err != nil {
+		c.log.Err(err).Str("message_id", string(messageID)).Msg("Failed to look up message alias")
+	} else if alias != nil {
+		return alias.MessageID
+	}
+	return messageID
+}
+
+// splitMessage splits a message into parts of at most limit bytes, breaking between words
+// where possible. If numbered is set, a (1/3) style counter is appended to each part
+func splitMessage(message string, limit int, numbered bool) []string {
+	if len(message) <= limit {
+		return []string{message}
+	}
+	if !numbered {
+		return splitText(message, limit)
+	}
+	// Reserve room for the counter, growing it if the part count needs more digits
+	for reserve := len(" (1/9)"); reserve < limit/2; reserve++ {
+		parts := splitText(message, limit-reserve)
+		if len(fmt.Sprintf(" (%d/%d)", len(parts), len(parts))) > reserve {
+			continue
+		}
+		for i := range parts {
+			parts[i] += fmt.Sprintf(" (%d/%d)", i+1, len(parts))
+		}
+		return parts
+	}
+	return splitText(message, limit)
+}
+
+func splitText(text string, limit int) []string {
+	var parts []string
+	for len(text) > limit {
+		cut := lastWordBreak(text, limit)
+		if cut <= 0 {
+			cut = lastGraphemeBreak(text, limit)
+		}
+		parts = append(parts, strings.TrimRightFunc(text[:cut], unicode.IsSpace))
+		text = strings.TrimLeftFunc(text[cut:], unicode.IsSpace)
+	}
+	if text != "" {
+		parts = append(parts, text)
+	}
+	return parts
+}
+
+// lastWordBreak finds the last whitespace at or before limit that leaves some text
+// before it, returning 0 if there is none
+func lastWordBreak(text string, limit int) int {
+	for i := limit; i > 0; i-- {
+		if text[i] < utf8.RuneSelf && unicode.IsSpace(rune(text[i])) {
+			if strings.TrimSpace(text[:i]) != "" {
+				return i
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// lastGraphemeBreak finds the last position at or before limit that doesn't split a
+// character, including combining marks, emoji modifiers and joined emoji sequences
+func lastGraphemeBreak(text string, limit int) int {
+	i := limit
+	for i > 0 && !utf8.RuneStart(text[i]) {
+		i--
+	}
+	runeBreak := i
+	for i > 0 {
+		next, _ := utf8.DecodeRuneInString(text[i:])
+		prev, size := utf8.DecodeLastRuneInString(text[:i])
+		if !extendsGrapheme(next) && prev != zeroWidthJoiner {
+			return i
+		}
+		i -= size
+	}
+	// A single absurdly long grapheme, fall back to splitting between code points
+	if runeBreak == 0 {
+		_, size := utf8.DecodeRuneInString(text)
+		return size
+	}
+	return runeBreak
+}
+
+func extendsGrapheme(r rune) bool {
+	return unicode.In(r, unicode.Mn, unicode.Me, unicode.Mc) ||
+		r == zeroWidthJoiner ||
+		unicode.Is(unicode.Variation_Selector, r) ||
+		(r >= 0x1F3FB && r <= 0x1F3FF)
+}
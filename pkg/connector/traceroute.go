@@ -233,6 +233,6 @@ func (c *MeshtasticConnector) sendNoticeToRoom(ctx context.Context, roomID id.Ro
 	}
 	_, err := c.bridge.Bot.SendMessage(ctx, roomID, event.EventMessage, content, nil)
 	if err != nil {
-		c.log.Err(err).Str("room_id", roomID.String()).Msg("Failed to send traceroute response to room")
+		c.log.Err(err).Str("room_id", roomID.String()).Msg("Failed to send notice to room")
 	}
 }
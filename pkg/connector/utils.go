@@ -1,5 +1,16 @@
 package connector
 
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
 // Truncate string.
 func TruncateString(str string, length int) string {
 	if length <= 0 {
@@ -16,3 +27,71 @@ func TruncateString(str string, length int) string {
 	}
 	return truncated
 }
+
+// splitQuotedArgs splits command arguments on whitespace, keeping text in double quotes together
+func splitQuotedArgs(raw string) []string {
+	var args []string
+	var current strings.Builder
+	inQuotes, hasArg := false, false
+	for _, r := range raw {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			hasArg = true
+		case unicode.IsSpace(r) && !inQuotes:
+			if hasArg {
+				args = append(args, current.String())
+				current.Reset()
+				hasArg = false
+			}
+		default:
+			current.WriteRune(r)
+			hasArg = true
+		}
+	}
+	if hasArg {
+		args = append(args, current.String())
+	}
+	return args
+}
+
+// parseDuration parses a duration such as 2h30m, also accepting a whole number of days such as 3d
+func parseDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// sendFileToRoom uploads a file and sends it to a Matrix room as the bridge bot
+func (c *MeshtasticConnector) sendFileToRoom(ctx context.Context, roomID id.RoomID, data []byte, fileName, mimeType string) error {
+	url, file, err := c.bridge.Bot.UploadMedia(ctx, roomID, data, fileName, mimeType)
+	if err != nil {
+		return err
+	}
+	msgType := event.MsgFile
+	if mimeType == "image/png" {
+		msgType = event.MsgImage
+	}
+	content := &event.MessageEventContent{
+		MsgType:  msgType,
+		Body:     fileName,
+		FileName: fileName,
+		URL:      url,
+		File:     file,
+		Info: &event.FileInfo{
+			MimeType: mimeType,
+			Size:     len(data),
+		},
+	}
+	if file != nil {
+		file.URL = url
+		content.URL = ""
+	}
+	_, err = c.bridge.Bot.SendMessage(ctx, roomID, event.EventMessage, &event.Content{Parsed: content}, nil)
+	return err
+}
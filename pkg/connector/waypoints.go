@@ -0,0 +1,332 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/kabili207/matrix-meshtastic/pkg/connector/meshdb"
+	"github.com/kabili207/matrix-meshtastic/pkg/mesh"
+	"github.com/kabili207/matrix-meshtastic/pkg/meshid"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/matrix"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/bridgev2/simplevent"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/id"
+)
+
+// getWaypointPortal finds the portal a newly received waypoint should be posted in.
+// Broadcast waypoints go to the channel portal, while waypoints sent to a managed node go to the DM portal.
+//
+// A waypoint only keeps track of a single Matrix message, so broadcast waypoints aren't bridged when
+// portals are split and there isn't a single portal for the channel
+func (c *MeshtasticConnector) getWaypointPortal(ctx context.Context, evt *mesh.MeshWaypointEvent) (*bridgev2.Portal, error) {
+	if evt.To == meshid.BROADCAST_ID || evt.To == meshid.BROADCAST_ID_NO_LORA {
+		if c.bridge.Config.SplitPortals {
+			zerolog.Ctx(ctx).Warn().Msg("Not bridging broadcast waypoint, as waypoints aren't supported with split portals")
+			return nil, nil
+		}
+		return c.getChannelPortal(ctx, evt.ChannelName, evt.ChannelKey)
+	}
+	if !c.IsManagedNode(evt.To) {
+		return nil, nil
+	}
+	portal, err := c.bridge.GetExistingPortalByKey(ctx, networkid.PortalKey{
+		ID:       meshid.MakeDMPortalID(evt.From, evt.To),
+		Receiver: meshid.MakeUserLoginID(evt.To),
+	})
+	if err != nil || portal == nil || portal.MXID == "" {
+		return nil, err
+	}
+	return portal, nil
+}
+
+// waypointIcon returns the icon of a waypoint, or a pin if it doesn't have one. Waypoints
+// received before empty icons were handled have a NUL character stored instead
+func waypointIcon(w *meshdb.Waypoint) string {
+	if w.Icon == "" || w.Icon == "\x00" {
+		return "📍"
+	}
+	return w.Icon
+}
+
+func (c *MeshtasticConnector) formatWaypoint(w *meshdb.Waypoint) *event.MessageEventContent {
+	lines := []string{fmt.Sprintf("%s %s", waypointIcon(w), w.Name)}
+	if w.Description != "" {
+		lines = append(lines, w.Description)
+	}
+	if w.Expires != nil {
+		lines = append(lines, fmt.Sprintf("Expires: %s", w.Expires.UTC().Format(time.RFC1123)))
+	}
+	if w.LockedTo != nil {
+		lines = append(lines, fmt.Sprintf("Locked to: %s", c.getNodeDisplayName(*w.LockedTo)))
+	}
+	lines = append(lines, fmt.Sprintf("Set by: %s", c.getNodeDisplayName(w.UpdatedBy)))
+	geo := meshid.GeoURI{Latitude: w.Latitude, Longitude: w.Longitude}
+	return &event.MessageEventContent{
+		MsgType: event.MsgLocation,
+		Body:    strings.Join(lines, "\n"),
+		GeoURI:  geo.String(),
+	}
+}
+
+// postWaypoint posts a waypoint to Matrix as a location message, or edits the existing
+// message if it was already posted. The waypoint row is updated with the Matrix event, but not saved.
+//
+// Waypoints are posted by the bridge bot rather than the ghost of the node that set them, as any
+// node can update an unlocked waypoint and Matrix only allows the original sender to edit a message
+func (c *MeshtasticConnector) postWaypoint(ctx context.Context, w *meshdb.Waypoint, portal *bridgev2.Portal) error {
+	content := c.formatWaypoint(w)
+	if w.EventMXID != "" {
+		content.SetEdit(w.EventMXID)
+		_, err := c.bridge.Bot.SendMessage(ctx, w.RoomMXID, event.EventMessage, &event.Content{Parsed: content}, nil)
+		return err
+	}
+	if portal == nil {
+		return nil
+	}
+	resp, err := c.bridge.Bot.SendMessage(ctx, portal.MXID, event.EventMessage, &event.Content{Parsed: content}, nil)
+	if err != nil {
+		return err
+	}
+	w.RoomMXID = portal.MXID
+	w.EventMXID = resp.EventID
+	return nil
+}
+
+// redactWaypoint removes the Matrix message of a waypoint, if it was posted
+func (c *MeshtasticConnector) redactWaypoint(ctx context.Context, w *meshdb.Waypoint, reason string) error {
+	if w.EventMXID == "" {
+		return nil
+	}
+	_, err := c.bridge.Bot.SendMessage(ctx, w.RoomMXID, event.EventRedaction, &event.Content{
+		Parsed: &event.RedactionEventContent{
+			Redacts: w.EventMXID,
+			Reason:  reason,
+		},
+	}, nil)
+	return err
+}
+
+// expireWaypoint removes a waypoint that is no longer relevant. Depending on the config, the Matrix
+// message is either redacted or kept with a notice saying the waypoint expired
+func (c *MeshtasticConnector) expireWaypoint(ctx context.Context, w *meshdb.Waypoint, reason string) {
+	log := c.log.With().
+		Str("action", "expire_waypoint").
+		Uint32("waypoint_id", w.WaypointID).
+		Str("reason", reason).
+		Logger()
+	if c.Config.Waypoints.ExpiredAction == "notice" {
+		if w.EventMXID != "" {
+			content := &event.MessageEventContent{
+				MsgType:   event.MsgNotice,
+				Body:      fmt.Sprintf("%s: %s", reason, w.Name),
+				RelatesTo: (&event.RelatesTo{}).SetReplyTo(w.EventMXID),
+			}
+			if _, err := c.bridge.Bot.SendMessage(ctx, w.RoomMXID, event.EventMessage, &event.Content{Parsed: content}, nil); err != nil {
+				log.Err(err).Msg("Failed to post waypoint expiry notice")
+			}
+		}
+	} else if err := c.redactWaypoint(ctx, w, reason); err != nil {
+		log.Err(err).Msg("Failed to redact waypoint message")
+	}
+	if err := c.meshDB.Waypoint.DeleteByID(ctx, w.WaypointID); err != nil {
+		log.Err(err).Msg("Failed to delete waypoint")
+		return
+	}
+	log.Info().Msg("Removed waypoint")
+}
+
+// warnWaypointExpiry tells the Matrix user who set a waypoint that it will expire soon, in the
+// DM portal between the bridge node and their node
+func (c *MeshtasticConnector) warnWaypointExpiry(ctx context.Context, w *meshdb.Waypoint) {
+	log := c.log.With().
+		Str("action", "warn_waypoint_expiry").
+		Uint32("waypoint_id", w.WaypointID).
+		Logger()
+	if !c.IsManagedNode(w.UpdatedBy) {
+		return
+	}
+	login := c.bridge.GetCachedUserLoginByID(meshid.MakeUserLoginID(w.UpdatedBy))
+	if login == nil {
+		return
+	}
+	client, ok := login.Client.(*MeshtasticClient)
+	if !ok {
+		return
+	}
+	notice := fmt.Sprintf(
+		"Your waypoint %d (%s) expires at %s. Renew it with `%s waypoint edit %d expires <duration>`",
+		w.WaypointID, w.Name, w.Expires.UTC().Format(time.RFC1123), c.bridge.Config.CommandPrefix, w.WaypointID,
+	)
+	bridgeNode := c.GetBaseNodeID()
+	res := login.QueueRemoteEvent(&simplevent.Message[string]{
+		EventMeta: simplevent.EventMeta{
+			Type:         bridgev2.RemoteEventMessage,
+			PortalKey:    client.makeDMPortalKey(bridgeNode, w.UpdatedBy),
+			CreatePortal: true,
+			Sender:       client.makeEventSender(bridgeNode),
+			Timestamp:    time.Now(),
+		},
+		Data: notice,
+		// Derived from the expiry, so a warning that is queued twice is only posted once
+		ID: meshid.MakeMessageID(bridgeNode.String(), w.WaypointID^uint32(w.Expires.Unix())),
+		ConvertMessageFunc: func(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, data string) (*bridgev2.ConvertedMessage, error) {
+			content := format.RenderMarkdown(data, true, false)
+			content.MsgType = event.MsgNotice
+			return &bridgev2.ConvertedMessage{
+				Parts: []*bridgev2.ConvertedMessagePart{{Type: event.EventMessage, Content: &content}},
+			}, nil
+		},
+	})
+	if !res.Success && !res.Queued {
+		log.Err(res.Error).Msg("Failed to send waypoint expiry warning")
+		return
+	}
+	// Only warn once per expiry time, renewing the waypoint allows another warning
+	w.WarnedExpiry = w.Expires
+	if err := w.SetAll(ctx); err != nil {
+		log.Err(err).Msg("Failed to save waypoint")
+	}
+}
+
+// toMeshWaypoint converts a stored waypoint into the form used to send it to the mesh
+func toMeshWaypoint(w *meshdb.Waypoint) mesh.Waypoint {
+	mw := mesh.Waypoint{
+		ID:          w.WaypointID,
+		Name:        w.Name,
+		Description: w.Description,
+		Latitude:    w.Latitude,
+		Longitude:   w.Longitude,
+		LockedTo:    w.LockedTo,
+		Expires:     w.Expires,
+	}
+	if r, _ := utf8.DecodeRuneInString(w.Icon); r != utf8.RuneError {
+		mw.Icon = r
+	}
+	return mw
+}
+
+// canEditWaypoint checks whether a node is allowed to change a waypoint
+func canEditWaypoint(w *meshdb.Waypoint, nodeID meshid.NodeID) bool {
+	return w.LockedTo == nil || *w.LockedTo == nodeID
+}
+
+// sendWaypoint broadcasts a waypoint on a channel, then handles it as if it had been
+// received so it's saved and posted to Matrix the same way as waypoints from the mesh
+func (c *MeshtasticConnector) sendWaypoint(from meshid.NodeID, channelName, channelKey string, w mesh.Waypoint) error {
+	channel, err := meshid.NewChannelDef(channelName, &channelKey)
+	if err != nil {
+		return err
+	}
+	if cfg := c.getChannelConfig(channel); cfg != nil && !cfg.DownlinkEnabled() {
+		return errDownlinkDisabled
+	}
+	packetID, err := c.meshClient.SendWaypoint(from, channel, w)
+	if err != nil {
+		return err
+	}
+	icon := ""
+	if w.Icon != 0 {
+		icon = string(w.Icon)
+	}
+	c.handleMeshWaypoint(&mesh.MeshWaypointEvent{
+		MeshEvent: mesh.MeshEvent{
+			ChannelName: channelName,
+			ChannelKey:  &channelKey,
+			From:        from,
+			To:          meshid.BROADCAST_ID,
+			Timestamp:   uint32(time.Now().Unix()),
+			PacketId:    packetID,
+		},
+		WaypointID:  w.ID,
+		IsDelete:    w.Expires != nil && w.Expires.Before(time.Now()),
+		Name:        w.Name,
+		Description: w.Description,
+		Latitude:    w.Latitude,
+		Longitude:   w.Longitude,
+		Icon:        icon,
+		LockedTo:    w.LockedTo,
+		Expires:     w.Expires,
+	})
+	return nil
+}
+
+// newWaypointID picks a random waypoint ID that isn't already in use
+func (c *MeshtasticConnector) newWaypointID(ctx context.Context) (uint32, error) {
+	for {
+		waypointID := rand.Uint32()
+		if waypointID == 0 {
+			continue
+		}
+		existing, err := c.meshDB.Waypoint.GetByWaypointID(ctx, waypointID)
+		if err != nil {
+			return 0, err
+		} else if existing == nil {
+			return waypointID, nil
+		}
+	}
+}
+
+// getEventLocation reads the position from a location message that was shared in a room
+func (c *MeshtasticConnector) getEventLocation(ctx context.Context, roomID id.RoomID, eventID id.EventID) (*meshid.GeoURI, error) {
+	mc, ok := c.bridge.Matrix.(*matrix.Connector)
+	if !ok {
+		return nil, errors.New("unable to fetch Matrix events")
+	}
+	evt, err := mc.AS.BotClient().GetEvent(ctx, roomID, eventID)
+	if err != nil {
+		return nil, err
+	}
+	if evt.Type == event.EventEncrypted {
+		return nil, errors.New("the location is encrypted, send the position as a geo: URI instead")
+	}
+	if err := evt.Content.ParseRaw(evt.Type); err != nil && !errors.Is(err, event.ErrContentAlreadyParsed) {
+		return nil, err
+	}
+	msg := evt.Content.AsMessage()
+	if msg.MsgType != event.MsgLocation || msg.GeoURI == "" {
+		return nil, errors.New("the replied to message isn't a location")
+	}
+	return meshid.ParseGeoURI(msg.GeoURI)
+}
+
+// parseWaypointIcon parses a waypoint icon, which must be a single emoji
+func parseWaypointIcon(icon string) (rune, error) {
+	// Emoji presentation selectors can't be sent, the icon is a single code point
+	icon = strings.Map(func(r rune) rune {
+		if unicode.Is(unicode.Variation_Selector, r) {
+			return -1
+		}
+		return r
+	}, icon)
+	if utf8.RuneCountInString(icon) != 1 {
+		return 0, fmt.Errorf("the icon must be a single emoji")
+	}
+	r, _ := utf8.DecodeRuneInString(icon)
+	return r, nil
+}
+
+// parseWaypointExpiry parses how long a waypoint should last, either as a duration
+// such as 2h30m or 3d, or "never"
+func parseWaypointExpiry(expiry string) (*time.Time, error) {
+	if strings.EqualFold(expiry, "never") {
+		return nil, nil
+	}
+	dur, err := parseDuration(expiry)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expiry: %s", expiry)
+	} else if dur <= 0 {
+		return nil, fmt.Errorf("the expiry must be in the future")
+	}
+	expires := time.Now().Add(dur)
+	return &expires, nil
+}
@@ -0,0 +1,112 @@
+package mesh
+
+import (
+	"slices"
+	"time"
+	"unicode/utf8"
+
+	"github.com/kabili207/matrix-meshtastic/pkg/meshid"
+	pb "github.com/meshnet-gophers/meshtastic-go/meshtastic"
+	"google.golang.org/protobuf/proto"
+)
+
+// The channel hash is only 8 bits, so different channels regularly share one. Packets are
+// decrypted by trying every channel with a matching hash, starting with the one that most
+// recently decrypted a packet, and discarding decodes that don't look like a valid packet.
+// A channel whose hash isn't shared is trusted to have the right key, as the firmware does.
+
+// ChannelHash returns the hash of a channel. Unlike radio.ChannelHash, unencrypted channels are
+// supported, which like in the firmware are hashed by their name alone
+func ChannelHash(channel meshid.ChannelDef) uint32 {
+	var h uint8
+	for _, b := range []byte(channel.GetName()) {
+		h ^= b
+	}
+	for _, b := range channel.GetKeyBytes() {
+		h ^= b
+	}
+	return uint32(h)
+}
+
+// channelDefID identifies a channel by both its name and key, as either can differ between channels
+func channelDefID(channel meshid.ChannelDef) string {
+	return channel.GetName() + "/" + channel.GetKeyString()
+}
+
+// channelsForHash returns the joined channels with the given hash, ordered by most recent successful decryption
+func (c *MeshtasticClient) channelsForHash(idHash uint32) []meshid.ChannelDef {
+	var matches []meshid.ChannelDef
+	seen := map[string]bool{}
+	c.channelsLock.RLock()
+	for _, v := range c.channels {
+		if ChannelHash(v) == idHash && !seen[channelDefID(v)] {
+			seen[channelDefID(v)] = true
+			matches = append(matches, v)
+		}
+	}
+	c.channelsLock.RUnlock()
+	if len(matches) > 1 {
+		c.channelStatsLock.Lock()
+		slices.SortStableFunc(matches, func(a, b meshid.ChannelDef) int {
+			return c.channelLastDecrypted[channelDefID(b)].Compare(c.channelLastDecrypted[channelDefID(a)])
+		})
+		c.channelStatsLock.Unlock()
+	}
+	return matches
+}
+
+func (c *MeshtasticClient) markChannelDecrypted(channel meshid.ChannelDef) {
+	c.channelStatsLock.Lock()
+	c.channelLastDecrypted[channelDefID(channel)] = time.Now()
+	c.channelStatsLock.Unlock()
+}
+
+// payloadTypes are the protobuf messages carried by each port, used to check decoded payloads
+var payloadTypes = map[pb.PortNum]func() proto.Message{
+	pb.PortNum_NODEINFO_APP:               func() proto.Message { return &pb.User{} },
+	pb.PortNum_POSITION_APP:               func() proto.Message { return &pb.Position{} },
+	pb.PortNum_MAP_REPORT_APP:             func() proto.Message { return &pb.MapReport{} },
+	pb.PortNum_TRACEROUTE_APP:             func() proto.Message { return &pb.RouteDiscovery{} },
+	pb.PortNum_TELEMETRY_APP:              func() proto.Message { return &pb.Telemetry{} },
+	pb.PortNum_NEIGHBORINFO_APP:           func() proto.Message { return &pb.NeighborInfo{} },
+	pb.PortNum_STORE_FORWARD_APP:          func() proto.Message { return &pb.StoreAndForward{} },
+	pb.PortNum_STORE_FORWARD_PLUSPLUS_APP: func() proto.Message { return &pb.StoreForwardPlusPlus{} },
+	pb.PortNum_ROUTING_APP:                func() proto.Message { return &pb.Routing{} },
+	pb.PortNum_ADMIN_APP:                  func() proto.Message { return &pb.AdminMessage{} },
+	pb.PortNum_PAXCOUNTER_APP:             func() proto.Message { return &pb.Paxcount{} },
+	pb.PortNum_KEY_VERIFICATION_APP:       func() proto.Message { return &pb.KeyVerification{} },
+	pb.PortNum_WAYPOINT_APP:               func() proto.Message { return &pb.Waypoint{} },
+}
+
+// isPlausibleData checks if a packet decrypted with a channel key is likely to be a real packet.
+// Decrypting with the wrong key produces garbage, which occasionally still parses as a protobuf,
+// so the payload is checked against what its port carries. Unknown fields are allowed, as newer
+// firmware may add them
+func isPlausibleData(data *pb.Data) bool {
+	if data == nil || data.Portnum == pb.PortNum_UNKNOWN_APP {
+		return false
+	} else if _, ok := pb.PortNum_name[int32(data.Portnum)]; !ok {
+		return false
+	}
+	switch data.Portnum {
+	case pb.PortNum_TEXT_MESSAGE_APP, pb.PortNum_ALERT_APP, pb.PortNum_RANGE_TEST_APP, pb.PortNum_DETECTION_SENSOR_APP:
+		return utf8.Valid(data.Payload)
+	}
+	if newPayload, ok := payloadTypes[data.Portnum]; ok {
+		return proto.Unmarshal(data.Payload, newPayload()) == nil
+	}
+	return true
+}
+
+// ChannelHashCollisions returns the other joined channels that share a hash with the given channel,
+// which means their packets have to be told apart by trying each key
+func (c *MeshtasticClient) ChannelHashCollisions(channel meshid.ChannelDef) []meshid.ChannelDef {
+	hash := ChannelHash(channel)
+	var collisions []meshid.ChannelDef
+	for _, v := range c.channelsForHash(hash) {
+		if channelDefID(v) != channelDefID(channel) {
+			collisions = append(collisions, v)
+		}
+	}
+	return collisions
+}
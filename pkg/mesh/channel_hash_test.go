@@ -0,0 +1,176 @@
+package mesh
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/kabili207/matrix-meshtastic/pkg/mesh/connectors"
+	"github.com/kabili207/matrix-meshtastic/pkg/meshid"
+	pb "github.com/meshnet-gophers/meshtastic-go/meshtastic"
+	"github.com/meshnet-gophers/meshtastic-go/radio"
+	"github.com/rs/zerolog"
+	"google.golang.org/protobuf/proto"
+)
+
+// collidingChannels returns two channels with the same name whose keys contain the same bytes in a
+// different order, so they share a hash
+func collidingChannels(t *testing.T) (meshid.ChannelDef, meshid.ChannelDef) {
+	t.Helper()
+	keyA := make([]byte, 16)
+	keyB := make([]byte, 16)
+	for i := range keyA {
+		keyA[i] = byte(i + 1)
+		keyB[len(keyB)-1-i] = byte(i + 1)
+	}
+	return makeTestChannel(t, "Shared", keyA), makeTestChannel(t, "Shared", keyB)
+}
+
+func makeTestChannel(t *testing.T, name string, key []byte) meshid.ChannelDef {
+	t.Helper()
+	keyString := base64.StdEncoding.EncodeToString(key)
+	channel, err := meshid.NewChannelDef(name, &keyString)
+	if err != nil {
+		t.Fatalf("NewChannelDef(%q) failed: %v", name, err)
+	}
+	return channel
+}
+
+func newTestClient(t *testing.T, channels ...meshid.ChannelDef) *MeshtasticClient {
+	t.Helper()
+	c := NewMeshtasticClient(0x12345678, zerolog.Nop())
+	for _, channel := range channels {
+		if err := c.AddChannelDef(channel); err != nil {
+			t.Fatalf("AddChannelDef(%s) failed: %v", channel.GetName(), err)
+		}
+	}
+	return c
+}
+
+func encryptTestPacket(t *testing.T, channel meshid.ChannelDef, data *pb.Data) *connectors.NetworkMeshPacket {
+	t.Helper()
+	plain, err := proto.Marshal(data)
+	if err != nil {
+		t.Fatalf("Failed to marshal data: %v", err)
+	}
+	packet := &pb.MeshPacket{From: 0x0BADF00D, To: uint32(meshid.BROADCAST_ID), Id: 4242, Channel: ChannelHash(channel)}
+	encrypted, err := radio.XOR(plain, channel.GetKeyBytes(), packet.Id, packet.From)
+	if err != nil {
+		t.Fatalf("Failed to encrypt packet: %v", err)
+	}
+	packet.PayloadVariant = &pb.MeshPacket_Encrypted{Encrypted: encrypted}
+	return &connectors.NetworkMeshPacket{MeshPacket: packet}
+}
+
+func TestChannelsForHashOrdering(t *testing.T) {
+	a, b := collidingChannels(t)
+	if ChannelHash(a) != ChannelHash(b) {
+		t.Fatalf("test channels don't share a hash: %d and %d", ChannelHash(a), ChannelHash(b))
+	}
+	other := makeTestChannel(t, "Other", []byte{0x01})
+	c := newTestClient(t, a, b, other)
+
+	ids := func() []string {
+		var out []string
+		for _, v := range c.channelsForHash(ChannelHash(a)) {
+			out = append(out, channelDefID(v))
+		}
+		return out
+	}
+	assertOrder := func(want ...meshid.ChannelDef) {
+		t.Helper()
+		got := ids()
+		if len(got) != len(want) {
+			t.Fatalf("channelsForHash returned %v, want %d channels", got, len(want))
+		}
+		for i, v := range want {
+			if got[i] != channelDefID(v) {
+				t.Fatalf("channelsForHash returned %v, want %s at %d", got, channelDefID(v), i)
+			}
+		}
+	}
+
+	// Without any decryptions, channels keep the order they were joined in
+	assertOrder(a, b)
+	c.markChannelDecrypted(b)
+	assertOrder(b, a)
+	// Separate the timestamps, which may otherwise be equal on coarse clocks
+	c.channelLastDecrypted[channelDefID(b)] = c.channelLastDecrypted[channelDefID(b)].Add(-time.Second)
+	c.markChannelDecrypted(a)
+	assertOrder(a, b)
+}
+
+func TestTryDecryptPSKRejectsWrongKey(t *testing.T) {
+	a, b := collidingChannels(t)
+	c := newTestClient(t, a, b)
+	// The wrong channel is tried first
+	c.markChannelDecrypted(a)
+
+	want := &pb.Data{Portnum: pb.PortNum_TEXT_MESSAGE_APP, Payload: []byte("hello from the other channel")}
+	packet := encryptTestPacket(t, b, want)
+	data, err := c.tryDecryptPSK(packet)
+	if err != nil {
+		t.Fatalf("tryDecryptPSK failed: %v", err)
+	} else if string(data.Payload) != string(want.Payload) {
+		t.Fatalf("tryDecryptPSK decoded %q, want %q", data.Payload, want.Payload)
+	} else if packet.ChannelKey == nil || *packet.ChannelKey != b.GetKeyString() {
+		t.Fatalf("tryDecryptPSK used key %v, want %s", packet.ChannelKey, b.GetKeyString())
+	}
+}
+
+func TestTryDecryptPSKSingleCandidate(t *testing.T) {
+	a, _ := collidingChannels(t)
+	c := newTestClient(t, a)
+
+	// A port this bridge doesn't know the payload of is still accepted
+	want := &pb.Data{Portnum: pb.PortNum_PRIVATE_APP, Payload: []byte{0xFF, 0x00}}
+	data, err := c.tryDecryptPSK(encryptTestPacket(t, a, want))
+	if err != nil {
+		t.Fatalf("tryDecryptPSK failed: %v", err)
+	} else if data.Portnum != want.Portnum {
+		t.Fatalf("tryDecryptPSK decoded port %s, want %s", data.Portnum, want.Portnum)
+	}
+}
+
+func TestTryDecryptPSKRejectsForeignChannel(t *testing.T) {
+	a, b := collidingChannels(t)
+	c := newTestClient(t, a)
+
+	// The packet is from a channel that wasn't joined, but shares the hash of the only one that was
+	packet := encryptTestPacket(t, b, &pb.Data{Portnum: pb.PortNum_TEXT_MESSAGE_APP, Payload: []byte("hello from a foreign channel")})
+	if data, err := c.tryDecryptPSK(packet); err == nil {
+		t.Fatalf("tryDecryptPSK accepted a packet from a foreign channel: %v", data)
+	}
+}
+
+func TestIsPlausibleData(t *testing.T) {
+	position, err := proto.Marshal(&pb.Position{LatitudeI: proto.Int32(473000000)})
+	if err != nil {
+		t.Fatalf("Failed to marshal position: %v", err)
+	}
+	// Field 99 isn't defined in Data, but newer firmware may send fields this bridge doesn't know
+	withUnknown := &pb.Data{Portnum: pb.PortNum_TEXT_MESSAGE_APP, Payload: []byte("hi")}
+	withUnknown.ProtoReflect().SetUnknown([]byte{0x98, 0x06, 0x01})
+
+	tests := []struct {
+		name string
+		data *pb.Data
+		want bool
+	}{
+		{"nil", nil, false},
+		{"unknown port", &pb.Data{Portnum: pb.PortNum_UNKNOWN_APP}, false},
+		{"undefined port", &pb.Data{Portnum: pb.PortNum(12345)}, false},
+		{"text", &pb.Data{Portnum: pb.PortNum_TEXT_MESSAGE_APP, Payload: []byte("hello")}, true},
+		{"invalid text", &pb.Data{Portnum: pb.PortNum_TEXT_MESSAGE_APP, Payload: []byte{0xC3, 0x28}}, false},
+		{"position", &pb.Data{Portnum: pb.PortNum_POSITION_APP, Payload: position}, true},
+		{"invalid position", &pb.Data{Portnum: pb.PortNum_POSITION_APP, Payload: []byte{0x0F, 0xFF}}, false},
+		{"unknown data field", withUnknown, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isPlausibleData(tt.data); got != tt.want {
+				t.Errorf("isPlausibleData() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package mesh
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/iancoleman/strcase"
+	"github.com/kabili207/matrix-meshtastic/pkg/meshid"
+	pb "github.com/meshnet-gophers/meshtastic-go/meshtastic"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	channelURLHost = "meshtastic.org"
+	channelURLPath = "/e/"
+)
+
+// ParseChannelURL decodes a Meshtastic channel URL, such as https://meshtastic.org/e/#CgMSAQES...,
+// into the channels it contains
+func ParseChannelURL(rawURL string) ([]meshid.ChannelDef, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return nil, err
+	} else if !strings.EqualFold(u.Host, channelURLHost) || strings.TrimSuffix(u.Path, "/")+"/" != channelURLPath {
+		return nil, fmt.Errorf("not a Meshtastic channel URL, expected https://%s%s#...", channelURLHost, channelURLPath)
+	}
+	// The apps encode the fragment as unpadded URL-safe base64, but be lenient with what gets pasted
+	fragment := strings.TrimRight(u.Fragment, "=")
+	fragment = strings.NewReplacer("+", "-", "/", "_").Replace(fragment)
+	data, err := base64.RawURLEncoding.DecodeString(fragment)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode channel URL: %w", err)
+	}
+	var channelSet pb.ChannelSet
+	if err = proto.Unmarshal(data, &channelSet); err != nil {
+		return nil, fmt.Errorf("failed to decode channel URL: %w", err)
+	} else if len(channelSet.Settings) == 0 {
+		return nil, errors.New("channel URL doesn't contain any channels")
+	}
+
+	preset := pb.Config_LoRaConfig_LONG_FAST
+	if channelSet.LoraConfig != nil && channelSet.LoraConfig.UsePreset {
+		preset = channelSet.LoraConfig.ModemPreset
+	}
+	channels := make([]meshid.ChannelDef, 0, len(channelSet.Settings))
+	for _, settings := range channelSet.Settings {
+		name := settings.Name
+		if name == "" {
+			// Like the firmware, unnamed channels are named after the modem preset
+			name = PresetName(preset)
+		}
+		key := base64.StdEncoding.EncodeToString(settings.Psk)
+		channel, err := meshid.NewChannelDef(name, &key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key for channel %s: %w", name, err)
+		}
+		channels = append(channels, channel)
+	}
+	return channels, nil
+}
+
+// MakeChannelURL encodes channels into a Meshtastic channel URL. The URL adds the channels to a
+// device rather than replacing its primary channel, so no LoRa config is included
+func MakeChannelURL(channels ...meshid.ChannelDef) (string, error) {
+	var channelSet pb.ChannelSet
+	for _, channel := range channels {
+		psk, err := base64.StdEncoding.DecodeString(channel.GetKeyString())
+		if err != nil {
+			return "", err
+		}
+		channelSet.Settings = append(channelSet.Settings, &pb.ChannelSettings{
+			Name: channel.GetName(),
+			Psk:  psk,
+		})
+	}
+	data, err := proto.Marshal(&channelSet)
+	if err != nil {
+		return "", err
+	}
+	u := url.URL{
+		Scheme:   "https",
+		Host:     channelURLHost,
+		Path:     channelURLPath,
+		RawQuery: "add=true",
+		Fragment: base64.RawURLEncoding.EncodeToString(data),
+	}
+	return u.String(), nil
+}
+
+// ModemPreset returns the modem preset the bridge is assumed to use, which can only be known when
+// the primary channel is the default channel of a preset, such as LongFast
+func (c *MeshtasticClient) ModemPreset() (pb.Config_LoRaConfig_ModemPreset, bool) {
+	if c.primaryChannel == nil {
+		return 0, false
+	}
+	preset, ok := pb.Config_LoRaConfig_ModemPreset_value[strcase.ToScreamingSnake(c.primaryChannel.GetName())]
+	return pb.Config_LoRaConfig_ModemPreset(preset), ok
+}
+
+// PresetName converts a modem preset to the name used by its default channel, e.g. LONG_FAST to LongFast
+func PresetName(preset pb.Config_LoRaConfig_ModemPreset) string {
+	var sb strings.Builder
+	for _, part := range strings.Split(preset.String(), "_") {
+		if part == "" {
+			continue
+		}
+		sb.WriteString(part[:1])
+		sb.WriteString(strings.ToLower(part[1:]))
+	}
+	return sb.String()
+}
@@ -16,6 +16,8 @@ type MeshConnector interface {
 	// This is required for connectors that are unable to listen to all channels,
 	// such as MQTT. Implementors are expected to maintain this list across connection restarts
 	AddChannel(channelName string)
+	// RemoveChannel stops listening to a channel added with AddChannel
+	RemoveChannel(channelName string)
 	SendPacket(channel string, packet *pb.MeshPacket) error
 	SetPacketHandler(fn MeshPacketHandler)
 	SetStateHandler(fn StateEventHandler)
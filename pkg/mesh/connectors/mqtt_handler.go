@@ -2,6 +2,7 @@ package connectors
 
 import (
 	"fmt"
+	"slices"
 	"sync"
 	"time"
 
@@ -26,8 +27,11 @@ type mqttMessageHandler struct {
 	stateFunc           StateEventHandler
 	previouslyConnected bool
 
-	channelLock     sync.RWMutex
-	pendingChannels []string
+	channelLock        sync.RWMutex
+	pendingChannels    []string
+	subscribedChannels map[string]bool
+	// The MQTT client can't unsubscribe, so packets on removed channels are dropped instead
+	removedChannels map[string]bool
 }
 
 func NewMQTTMessageHandler(nodeID meshid.NodeID, mqttClient *mqtt.Client, logger zerolog.Logger) MeshConnector {
@@ -36,6 +40,9 @@ func NewMQTTMessageHandler(nodeID meshid.NodeID, mqttClient *mqtt.Client, logger
 		log:             logger,
 		nodeID:          nodeID,
 		pendingChannels: []string{pkiChannelName},
+
+		subscribedChannels: map[string]bool{},
+		removedChannels:    map[string]bool{},
 	}
 
 	mqttClient.SetOnConnectHandler(mc.onMqttConnected)
@@ -89,13 +96,28 @@ func (h *mqttMessageHandler) SendPacket(channel string, packet *pb.MeshPacket) e
 }
 
 func (c *mqttMessageHandler) AddChannel(channelName string) {
+	c.channelLock.Lock()
+	defer c.channelLock.Unlock()
 
+	delete(c.removedChannels, channelName)
+	if c.subscribedChannels[channelName] {
+		return
+	}
 	if c.mqttClient != nil && c.mqttClient.IsConnected() {
 		c.mqttClient.Handle(channelName, c.handleMQTTMessage)
+		c.subscribedChannels[channelName] = true
 	} else {
-		c.channelLock.Lock()
 		c.pendingChannels = append(c.pendingChannels, channelName)
-		c.channelLock.Unlock()
+	}
+}
+
+func (c *mqttMessageHandler) RemoveChannel(channelName string) {
+	c.channelLock.Lock()
+	defer c.channelLock.Unlock()
+
+	c.pendingChannels = slices.DeleteFunc(c.pendingChannels, func(name string) bool { return name == channelName })
+	if c.subscribedChannels[channelName] {
+		c.removedChannels[channelName] = true
 	}
 }
 
@@ -110,6 +132,12 @@ func (h *mqttMessageHandler) SetStateHandler(fn StateEventHandler) {
 }
 
 func (c *mqttMessageHandler) handleMQTTMessage(m mqtt.Message) {
+	c.channelLock.RLock()
+	removed := c.removedChannels[c.mqttClient.GetChannelFromTopic(m.Topic)]
+	c.channelLock.RUnlock()
+	if removed {
+		return
+	}
 	log := c.log.With().Logger()
 	var env pb.ServiceEnvelope
 	err := proto.Unmarshal(m.Payload, &env)
@@ -150,6 +178,7 @@ func (c *mqttMessageHandler) onMqttConnected() {
 	c.channelLock.Lock()
 	for _, name := range c.pendingChannels {
 		c.mqttClient.Handle(name, c.handleMQTTMessage)
+		c.subscribedChannels[name] = true
 	}
 	c.pendingChannels = []string{}
 	c.channelLock.Unlock()
@@ -79,6 +79,11 @@ func (h *udpMessageHandler) AddChannel(channelName string) {
 	// Do nothing; not required for this connector
 }
 
+// RemoveChannel implements MeshHandler.
+func (h *udpMessageHandler) RemoveChannel(channelName string) {
+	// Do nothing; not required for this connector
+}
+
 // SetHandler registers the callback for incoming messages
 func (h *udpMessageHandler) SetPacketHandler(fn MeshPacketHandler) {
 	h.handlerFunc = fn
@@ -91,6 +96,16 @@ func (h *udpMessageHandler) SetStateHandler(fn StateEventHandler) {
 
 // SendPacket implements MeshHandler.
 func (h *udpMessageHandler) SendPacket(channel string, packet *pb.MeshPacket) error {
+	// Multicast carries packets in their over-the-air form, where unencrypted channels
+	// send the encoded data as is in place of the encrypted bytes
+	if decoded := packet.GetDecoded(); decoded != nil {
+		rawData, err := proto.Marshal(decoded)
+		if err != nil {
+			return err
+		}
+		packet = proto.CloneOf(packet)
+		packet.PayloadVariant = &pb.MeshPacket_Encrypted{Encrypted: rawData}
+	}
 	return h.SendMulticast(packet)
 }
 
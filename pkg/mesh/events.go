@@ -19,6 +19,11 @@ type MeshEvent struct {
 	IsNeighbor   bool
 }
 
+// Base returns the common fields of an event, which is useful when the type of the event doesn't matter
+func (e *MeshEvent) Base() *MeshEvent {
+	return e
+}
+
 type MeshMessageEvent struct {
 	MeshEvent
 	Message string
@@ -26,6 +31,17 @@ type MeshMessageEvent struct {
 	ReplyId uint32
 }
 
+type MeshAlertEvent struct {
+	MeshEvent
+	Message string
+	IsDM    bool
+}
+
+type MeshDetectionSensorEvent struct {
+	MeshEvent
+	Message string
+}
+
 type MeshReactionEvent struct {
 	MeshEvent
 	Emoji   string
@@ -38,6 +54,7 @@ type MeshLocationEvent struct {
 	Location    meshid.GeoURI
 	GroundSpeed *uint32
 	GroundTrack *uint32
+	SatsInView  *uint32
 }
 
 type MeshWaypointEvent struct {
@@ -64,6 +81,16 @@ type MeshNodeInfoEvent struct {
 	IsUnmessagable bool
 }
 
+type MeshKeyVerificationEvent struct {
+	MeshEvent
+	Stage KeyVerificationStage
+	// The number to give to the remote user, set when the stage is KeyVerificationNumberShown
+	SecurityNumber uint32
+	// The code the users should compare, set when the stage is KeyVerificationAwaitingConfirmation
+	Code   string
+	Reason string
+}
+
 type MeshChannelJoined struct {
 	ChannelID  string
 	ChannelKey *string
@@ -88,3 +115,12 @@ type MeshTracerouteEvent struct {
 	SnrBack    []int32
 	RequestId  uint32
 }
+
+type MeshRangeTestEvent struct {
+	MeshEvent
+	Sequence uint32
+	Payload  string
+	RxSnr    float32
+	RxRssi   int32
+	HopCount uint32
+}
@@ -3,26 +3,20 @@ package mesh
 import (
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jellydator/ttlcache/v3"
 	"github.com/kabili207/matrix-meshtastic/pkg/mesh/connectors"
 	"github.com/kabili207/matrix-meshtastic/pkg/meshid"
+	"github.com/kabili207/matrix-meshtastic/pkg/unishox"
 	pb "github.com/meshnet-gophers/meshtastic-go/meshtastic"
 	"github.com/meshnet-gophers/meshtastic-go/radio"
 	"go.mau.fi/util/ptr"
 	"google.golang.org/protobuf/proto"
 )
 
-func (c *MeshtasticClient) getChannelNameFromHash(idHash uint32) string {
-	for _, v := range c.channels {
-		if hash, err := radio.ChannelHash(v.GetName(), v.GetKeyBytes()); err == nil && hash == idHash {
-			return v.GetName()
-		}
-	}
-	return ""
-}
-
 func (c *MeshtasticClient) handleMeshPacket(packet connectors.NetworkMeshPacket) {
 	gateway := packet.GatewayNode
 	if gateway == 0 {
@@ -58,7 +52,9 @@ func (c *MeshtasticClient) handleMeshPacket(packet connectors.NetworkMeshPacket)
 
 	data := packet.GetDecoded()
 
-	if data == nil {
+	if data != nil {
+		c.resolveDecodedChannel(&packet)
+	} else {
 		if c.shouldUsePKIDecryption(packet) {
 			data, err = c.tryDecryptPKI(&packet)
 			if err != nil {
@@ -116,21 +112,61 @@ func (c *MeshtasticClient) tryDecryptPKI(packet *connectors.NetworkMeshPacket) (
 }
 
 func (c *MeshtasticClient) tryDecryptPSK(packet *connectors.NetworkMeshPacket) (*pb.Data, error) {
-	packet.ChannelName = c.getChannelNameFromHash(packet.Channel)
-	if packet.ChannelName == "" {
+	candidates := c.channelsForHash(packet.Channel)
+	if len(candidates) == 0 {
 		return nil, fmt.Errorf("unknown channel hash: %d", packet.Channel)
 	}
-	data, err := (*pb.Data)(nil), (error)(nil)
+	err := fmt.Errorf("no key for channel hash %d produced a valid packet", packet.Channel)
+	for _, v := range candidates {
+		data, decErr := decodeWithChannel(packet, v)
+		// Even a single candidate can be the wrong key, as the hash is only 8 bits and
+		// foreign channels share it, which is common on public MQTT servers
+		if decErr != nil || !isPlausibleData(data) {
+			continue
+		}
+		packet.ChannelName = v.GetName()
+		packet.ChannelKey = ptr.Ptr(v.GetKeyString())
+		c.markChannelDecrypted(v)
+		return data, nil
+	}
+	return nil, err
+}
+
+// decodeWithChannel decrypts a packet with the key of a channel. Packets on unencrypted channels
+// still arrive in the encrypted field, but contain the plain data
+func decodeWithChannel(packet *connectors.NetworkMeshPacket, channel meshid.ChannelDef) (*pb.Data, error) {
+	if len(channel.GetKeyBytes()) > 0 {
+		return radio.TryDecode(packet.MeshPacket, channel.GetKeyBytes())
+	}
+	var data pb.Data
+	if err := proto.Unmarshal(packet.GetEncrypted(), &data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// resolveDecodedChannel finds the channel of a packet that arrived already decoded, such as from an
+// MQTT gateway with encryption disabled. Those packets carry the channel index used by the gateway
+// rather than the channel hash, so the channel is found by the name of the MQTT topic instead.
+// When channels with the same name are joined with and without a key, the unencrypted one is used
+func (c *MeshtasticClient) resolveDecodedChannel(packet *connectors.NetworkMeshPacket) {
+	if packet.ChannelName == "" || packet.ChannelKey != nil {
+		return
+	}
+	var match meshid.ChannelDef
+	c.channelsLock.RLock()
+	defer c.channelsLock.RUnlock()
 	for _, v := range c.channels {
-		if v.GetName() == packet.ChannelName && v.GetKeyString() != "" {
-			data, err = radio.TryDecode(packet.MeshPacket, v.GetKeyBytes())
-			if err == nil && data != nil {
-				packet.ChannelKey = ptr.Ptr(v.GetKeyString())
-				return data, err
-			}
+		if v.GetName() != packet.ChannelName {
+			continue
+		}
+		if match == nil || (len(v.GetKeyBytes()) == 0 && len(match.GetKeyBytes()) > 0) {
+			match = v
 		}
 	}
-	return data, err
+	if match != nil {
+		packet.ChannelKey = ptr.Ptr(match.GetKeyString())
+	}
 }
 
 func (c *MeshtasticClient) requestKey(nodeID meshid.NodeID, handler KeyRequestFunc) ([]byte, error) {
@@ -198,24 +234,43 @@ func (c *MeshtasticClient) processMessage(packet connectors.NetworkMeshPacket, m
 	var evt any = meshEventEnv
 
 	switch message.Portnum {
-	case pb.PortNum_TEXT_MESSAGE_APP:
+	case pb.PortNum_TEXT_MESSAGE_APP, pb.PortNum_TEXT_MESSAGE_COMPRESSED_APP:
+		text := string(message.Payload)
+		if message.Portnum == pb.PortNum_TEXT_MESSAGE_COMPRESSED_APP {
+			text, err = unishox.Decompress(message.Payload)
+			if err != nil {
+				err = fmt.Errorf("failed to decompress text message: %w", err)
+				break
+			}
+		}
 		// The Android app has started sending the codepoint instead of a boolean,
 		// so we just look for non-zero
 		if message.Emoji != 0 {
 			evt = &MeshReactionEvent{
 				MeshEvent: meshEventEnv,
-				Emoji:     string(message.Payload),
+				Emoji:     text,
 				IsDM:      packet.To != uint32(meshid.BROADCAST_ID),
 				ReplyId:   message.ReplyId,
 			}
 		} else {
 			evt = &MeshMessageEvent{
 				MeshEvent: meshEventEnv,
-				Message:   string(message.Payload),
+				Message:   text,
 				IsDM:      packet.To != uint32(meshid.BROADCAST_ID),
 				ReplyId:   message.ReplyId,
 			}
 		}
+	case pb.PortNum_ALERT_APP:
+		evt = &MeshAlertEvent{
+			MeshEvent: meshEventEnv,
+			Message:   string(message.Payload),
+			IsDM:      packet.To != uint32(meshid.BROADCAST_ID),
+		}
+	case pb.PortNum_DETECTION_SENSOR_APP:
+		evt = &MeshDetectionSensorEvent{
+			MeshEvent: meshEventEnv,
+			Message:   string(message.Payload),
+		}
 	case pb.PortNum_NODEINFO_APP:
 		var user = pb.User{}
 		proto.Unmarshal(message.Payload, &user)
@@ -238,7 +293,7 @@ func (c *MeshtasticClient) processMessage(packet connectors.NetworkMeshPacket, m
 			if pos.Altitude != nil {
 				alt = ptr.Ptr(float32(*pos.Altitude))
 			}
-			evt = &MeshLocationEvent{
+			locEvt := &MeshLocationEvent{
 				MeshEvent: meshEventEnv,
 				Location: meshid.GeoURI{
 					Latitude:    float32(*pos.LatitudeI) * 1e-7,
@@ -249,6 +304,10 @@ func (c *MeshtasticClient) processMessage(packet connectors.NetworkMeshPacket, m
 				GroundSpeed: pos.GroundSpeed,
 				GroundTrack: pos.GroundTrack,
 			}
+			if pos.SatsInView > 0 {
+				locEvt.SatsInView = ptr.Ptr(pos.SatsInView)
+			}
+			evt = locEvt
 		}
 
 	case pb.PortNum_MAP_REPORT_APP:
@@ -330,27 +389,73 @@ func (c *MeshtasticClient) processMessage(packet connectors.NetworkMeshPacket, m
 		err = proto.Unmarshal(message.Payload, &r)
 		c.printPacketDetails(packet, &r)
 
+	case pb.PortNum_RANGE_TEST_APP:
+		payload := string(message.Payload)
+		seq, ok := parseRangeTestSequence(payload)
+		if !ok {
+			err = fmt.Errorf("invalid range test payload: %q", payload)
+			break
+		}
+		gateway := packet.GatewayNode
+		if gateway == 0 {
+			// Packets without a gateway were heard directly by the bridge
+			gateway = c.nodeId
+		}
+		hops := uint32(0)
+		if packet.HopStart >= packet.HopLimit {
+			hops = packet.HopStart - packet.HopLimit
+		}
+		rangeEnv := meshEventEnv
+		rangeEnv.Via = gateway
+		evt = &MeshRangeTestEvent{
+			MeshEvent: rangeEnv,
+			Sequence:  seq,
+			Payload:   payload,
+			RxSnr:     packet.RxSnr,
+			RxRssi:    packet.RxRssi,
+			HopCount:  hops,
+		}
+
+	case pb.PortNum_KEY_VERIFICATION_APP:
+		var kv = pb.KeyVerification{}
+		err = proto.Unmarshal(message.Payload, &kv)
+		if err == nil {
+			if kvEvt := c.handleKeyVerification(packet, message, &kv, meshEventEnv); kvEvt != nil {
+				evt = kvEvt
+			}
+		}
+
 	case pb.PortNum_WAYPOINT_APP:
 		var w = pb.Waypoint{}
 		err = proto.Unmarshal(message.Payload, &w)
 		if w.LatitudeI != nil && w.LongitudeI != nil {
 			lat := float32(*w.LatitudeI) * 1e-7
 			lon := float32(*w.LongitudeI) * 1e-7
-			expiration := time.Unix(int64(w.Expire), 0)
+			// Waypoints without an icon have it set to zero
+			icon := ""
+			if w.Icon != 0 {
+				icon = string(rune(w.Icon))
+			}
+			// An expiry of zero means the waypoint never expires
+			var expiration *time.Time
+			if w.Expire != 0 {
+				expiration = ptr.Ptr(time.Unix(int64(w.Expire), 0))
+			}
 			var lockedTo *meshid.NodeID
 			if w.LockedTo != 0 && w.LockedTo != uint32(meshid.BROADCAST_ID) && w.LockedTo != uint32(meshid.BROADCAST_ID_NO_LORA) {
 				lockedTo = ptr.Ptr(meshid.NodeID(w.LockedTo))
 			}
 			evt = &MeshWaypointEvent{
 				MeshEvent:   meshEventEnv,
-				IsDelete:    expiration.Before(time.Now()),
+				WaypointID:  w.Id,
+				IsDelete:    expiration != nil && expiration.Before(time.Now()),
 				Latitude:    lat,
 				Longitude:   lon,
 				LockedTo:    lockedTo,
 				Name:        w.Name,
 				Description: w.Description,
-				Icon:        string(rune(w.Icon)),
-				Expires:     &expiration,
+				Icon:        icon,
+				Expires:     expiration,
 			}
 		}
 	}
@@ -358,3 +463,17 @@ func (c *MeshtasticClient) processMessage(packet connectors.NetworkMeshPacket, m
 	c.notifyEvent(evt)
 	return err
 }
+
+// parseRangeTestSequence extracts the sequence number from a range test payload,
+// which the firmware sends as plain text in the form "seq N"
+func parseRangeTestSequence(payload string) (uint32, bool) {
+	raw, ok := strings.CutPrefix(strings.TrimSpace(payload), "seq ")
+	if !ok {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(strings.TrimSpace(raw), 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(seq), true
+}
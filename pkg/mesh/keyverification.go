@@ -0,0 +1,301 @@
+package mesh
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/kabili207/matrix-meshtastic/pkg/mesh/connectors"
+	"github.com/kabili207/matrix-meshtastic/pkg/meshid"
+	pb "github.com/meshnet-gophers/meshtastic-go/meshtastic"
+)
+
+// How long a key verification can take before it's abandoned, matching the firmware
+const keyVerificationTimeout = 60 * time.Second
+
+var (
+	ErrVerificationInProgress = errors.New("a key verification is already in progress for this node")
+	ErrNoVerification         = errors.New("no key verification is in progress with this node")
+)
+
+type KeyVerificationStage int
+
+const (
+	// The remote node answered our request, and the security number it displays needs to be entered
+	KeyVerificationAwaitingNumber KeyVerificationStage = iota
+	// We answered a request from the remote node, and the security number needs to be given to its user
+	KeyVerificationNumberShown
+	// Both sides have proven they hold the expected keys, and the users need to compare the verification code
+	KeyVerificationAwaitingConfirmation
+	// The verification could not be completed
+	KeyVerificationFailed
+)
+
+type keyVerificationState int
+
+const (
+	// Initiator states
+	verificationInitiated keyVerificationState = iota
+	verificationAwaitingNumber
+	// Responder states
+	verificationAwaitingHash1
+	// Both sides have the verification code and are waiting on the user
+	verificationAwaitingUser
+)
+
+// keyVerification tracks a key verification exchange between a managed node and a remote node.
+// The protocol mirrors the KeyVerificationModule in the firmware:
+//
+//  1. The initiator sends a nonce to the responder
+//  2. The responder picks a random security number and replies with hash2, derived from the
+//     number, the nonce, both node numbers and both public keys. The number is shown to its user
+//  3. The initiator's user enters the number. The initiator checks it against hash2 and sends hash1
+//  4. The responder checks hash1, and both sides show a short code derived from it
+type keyVerification struct {
+	Local, Remote meshid.NodeID
+	Initiator     bool
+	State         keyVerificationState
+	Nonce         uint64
+	Started       time.Time
+	Hash1         []byte
+	Hash2         []byte
+}
+
+func (v *keyVerification) expired() bool {
+	return time.Since(v.Started) > keyVerificationTimeout
+}
+
+// VerificationCode returns the short code the users of both nodes should compare
+func (v *keyVerification) VerificationCode() string {
+	return verificationCode(v.Hash1)
+}
+
+// verificationCode builds the readable code shown by the firmware, which maps the
+// upper six bits of the hash bytes onto printable characters
+func verificationCode(hash1 []byte) string {
+	code := make([]byte, 9)
+	for i := 0; i < 4; i++ {
+		code[i] = (hash1[i] >> 2) + 48
+	}
+	code[4] = ' '
+	for i := 5; i < 9; i++ {
+		code[i] = (hash1[i] >> 2) + 48
+	}
+	return string(code)
+}
+
+// FormatSecurityNumber formats a security number the way it's displayed on devices
+func FormatSecurityNumber(number uint32) string {
+	return fmt.Sprintf("%03d %03d", number/1000, number%1000)
+}
+
+func computeVerificationHashes(number uint32, nonce uint64, initiator, responder meshid.NodeID, initiatorKey, responderKey []byte) (hash1, hash2 []byte) {
+	h := sha256.New()
+	binary.Write(h, binary.LittleEndian, number)
+	binary.Write(h, binary.LittleEndian, nonce)
+	binary.Write(h, binary.LittleEndian, uint32(initiator))
+	binary.Write(h, binary.LittleEndian, uint32(responder))
+	h.Write(initiatorKey)
+	h.Write(responderKey)
+	hash1 = h.Sum(nil)
+
+	h.Reset()
+	binary.Write(h, binary.LittleEndian, nonce)
+	h.Write(hash1)
+	hash2 = h.Sum(nil)
+	return hash1, hash2
+}
+
+// getVerification returns the active verification of a managed node, discarding it if it timed out
+func (c *MeshtasticClient) getVerification(local meshid.NodeID) *keyVerification {
+	v, ok := c.verifications[local]
+	if ok && v.expired() {
+		delete(c.verifications, local)
+		return nil
+	}
+	return v
+}
+
+func (c *MeshtasticClient) sendKeyVerification(from, to meshid.NodeID, kv *pb.KeyVerification, requestId uint32) error {
+	_, err := c.sendProtoMessage(c.primaryChannel, kv, PacketInfo{
+		PortNum:      pb.PortNum_KEY_VERIFICATION_APP,
+		Encrypted:    PKIEncryption,
+		From:         from,
+		To:           to,
+		RequestId:    requestId,
+		WantResponse: requestId == 0,
+	})
+	return err
+}
+
+// StartKeyVerification begins a key verification from a managed node to a remote node
+func (c *MeshtasticClient) StartKeyVerification(from, to meshid.NodeID) error {
+	c.verificationLock.Lock()
+	defer c.verificationLock.Unlock()
+
+	if c.getVerification(from) != nil {
+		return ErrVerificationInProgress
+	}
+	v := &keyVerification{
+		Local:     from,
+		Remote:    to,
+		Initiator: true,
+		State:     verificationInitiated,
+		Nonce:     rand.Uint64(),
+		Started:   time.Now(),
+	}
+	if err := c.sendKeyVerification(from, to, &pb.KeyVerification{Nonce: v.Nonce}, 0); err != nil {
+		return err
+	}
+	c.verifications[from] = v
+	return nil
+}
+
+// SubmitSecurityNumber continues a key verification started by a managed node with the
+// security number shown on the remote node, returning the code the users should compare
+func (c *MeshtasticClient) SubmitSecurityNumber(from, to meshid.NodeID, number uint32) (string, error) {
+	c.verificationLock.Lock()
+	defer c.verificationLock.Unlock()
+
+	v := c.getVerification(from)
+	if v == nil || v.Remote != to || !v.Initiator {
+		return "", ErrNoVerification
+	} else if v.State != verificationAwaitingNumber {
+		return "", errors.New("the remote node hasn't responded to the verification request yet")
+	}
+
+	localKey, err := c.requestKey(from, c.pubKeyRequestHandler)
+	if err != nil {
+		return "", err
+	}
+	remoteKey, err := c.requestKey(to, c.pubKeyRequestHandler)
+	if err != nil {
+		return "", err
+	}
+	hash1, hash2 := computeVerificationHashes(number, v.Nonce, from, to, localKey, remoteKey)
+	if !bytes.Equal(hash2, v.Hash2) {
+		// The firmware allows retrying, since the number could simply have been mistyped
+		return "", errors.New("the security number does not match")
+	}
+
+	v.Hash1 = hash1
+	if err = c.sendKeyVerification(from, to, &pb.KeyVerification{Nonce: v.Nonce, Hash1: hash1}, 0); err != nil {
+		return "", err
+	}
+	v.State = verificationAwaitingUser
+	return v.VerificationCode(), nil
+}
+
+// FinishKeyVerification ends the key verification between two nodes. If confirmed is set, the
+// verification must have reached the point where the users were able to compare codes
+func (c *MeshtasticClient) FinishKeyVerification(from, to meshid.NodeID, confirmed bool) error {
+	c.verificationLock.Lock()
+	defer c.verificationLock.Unlock()
+
+	v := c.getVerification(from)
+	if v == nil || v.Remote != to {
+		return ErrNoVerification
+	}
+	if confirmed && v.State != verificationAwaitingUser {
+		return errors.New("the verification code hasn't been shown yet")
+	}
+	delete(c.verifications, from)
+	return nil
+}
+
+// handleKeyVerification processes a key verification packet sent to a managed node,
+// returning an event if the user needs to be involved
+func (c *MeshtasticClient) handleKeyVerification(packet connectors.NetworkMeshPacket, data *pb.Data, kv *pb.KeyVerification, env MeshEvent) *MeshKeyVerificationEvent {
+	local := meshid.NodeID(packet.To)
+	remote := meshid.NodeID(packet.From)
+
+	if !c.managedNodeFunc(local) {
+		return nil
+	}
+	log := c.log.With().
+		Stringer("local", local).
+		Stringer("remote", remote).
+		Logger()
+	if packet.ChannelName != "PKI" {
+		log.Warn().Msg("Ignoring key verification packet that wasn't PKI encrypted")
+		return nil
+	}
+
+	c.verificationLock.Lock()
+	defer c.verificationLock.Unlock()
+
+	v := c.getVerification(local)
+
+	if len(kv.Hash1) == 0 && len(kv.Hash2) == 0 && data.WantResponse {
+		if v != nil {
+			log.Warn().Msg("Key verification requested, but one is already in progress")
+			return nil
+		}
+		number := rand.Uint32N(999999) + 1
+		localKey, err := c.requestKey(local, c.pubKeyRequestHandler)
+		if err != nil {
+			log.Err(err).Msg("Unable to get public key for key verification")
+			return nil
+		}
+		remoteKey, err := c.requestKey(remote, c.pubKeyRequestHandler)
+		if err != nil {
+			log.Err(err).Msg("Unable to get public key for key verification")
+			return nil
+		}
+		v = &keyVerification{
+			Local:   local,
+			Remote:  remote,
+			State:   verificationAwaitingHash1,
+			Nonce:   kv.Nonce,
+			Started: time.Now(),
+		}
+		v.Hash1, v.Hash2 = computeVerificationHashes(number, kv.Nonce, remote, local, remoteKey, localKey)
+		if err = c.sendKeyVerification(local, remote, &pb.KeyVerification{Nonce: kv.Nonce, Hash2: v.Hash2}, packet.Id); err != nil {
+			log.Err(err).Msg("Failed to respond to key verification request")
+			return nil
+		}
+		c.verifications[local] = v
+		log.Info().Msg("Responded to key verification request")
+		return &MeshKeyVerificationEvent{
+			MeshEvent:      env,
+			Stage:          KeyVerificationNumberShown,
+			SecurityNumber: number,
+		}
+	}
+
+	if v == nil || v.Remote != remote || v.Nonce != kv.Nonce {
+		log.Debug().Msg("Ignoring key verification packet for an unknown exchange")
+		return nil
+	}
+
+	switch {
+	case v.State == verificationInitiated && len(kv.Hash2) == sha256.Size && len(kv.Hash1) == 0:
+		v.Hash2 = kv.Hash2
+		v.State = verificationAwaitingNumber
+		return &MeshKeyVerificationEvent{
+			MeshEvent: env,
+			Stage:     KeyVerificationAwaitingNumber,
+		}
+	case v.State == verificationAwaitingHash1 && len(kv.Hash1) == sha256.Size:
+		if !bytes.Equal(v.Hash1, kv.Hash1) {
+			delete(c.verifications, local)
+			log.Warn().Msg("Key verification hash mismatch")
+			return &MeshKeyVerificationEvent{
+				MeshEvent: env,
+				Stage:     KeyVerificationFailed,
+				Reason:    "the remote node entered the wrong security number, or its keys don't match",
+			}
+		}
+		v.State = verificationAwaitingUser
+		return &MeshKeyVerificationEvent{
+			MeshEvent: env,
+			Stage:     KeyVerificationAwaitingConfirmation,
+			Code:      v.VerificationCode(),
+		}
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package mesh
 
 import (
+	"crypto/ecdh"
 	"errors"
 	"fmt"
 	"log/slog"
@@ -39,12 +40,18 @@ type IsManagedFunc func(nodeID meshid.NodeID) bool
 type MeshConnectedFunc func(isReconnect bool)
 type MeshDisconnectedFunc func()
 type KeyRequestFunc func(nodeID meshid.NodeID) (key *string)
+type CallsignFunc func(nodeID meshid.NodeID) (callsign string)
+
+// ErrLicensedEncryption is returned when a node of a licensed amateur radio operator tries to
+// send an encrypted packet, which amateur radio rules don't allow
+var ErrLicensedEncryption = errors.New("licensed amateur radio operators can't send encrypted packets")
 
 type MeshtasticClient struct {
 	log             zerolog.Logger
 	startTime       *time.Time
 	nodeId          meshid.NodeID
 	channels        []meshid.ChannelDef
+	channelsLock    sync.RWMutex
 	currentPacketId uint32
 	primaryChannel  meshid.ChannelDef
 	hopLimit        uint32
@@ -57,6 +64,7 @@ type MeshtasticClient struct {
 	onDisconnectHandler   MeshDisconnectedFunc
 	pubKeyRequestHandler  KeyRequestFunc
 	privKeyRequestHandler KeyRequestFunc
+	callsignFunc          CallsignFunc
 
 	packetCache       *ttlcache.Cache[uint64, any]
 	packetCacheLock   sync.Mutex
@@ -68,6 +76,14 @@ type MeshtasticClient struct {
 	requestThrottle           *requestThrottle
 	neighborProvider          NeighborProvider
 	neighborBroadcastInterval *uint32
+
+	// Key verifications in progress, keyed by the managed node taking part in them
+	verifications    map[meshid.NodeID]*keyVerification
+	verificationLock sync.Mutex
+
+	// When each channel last decrypted a packet, used to order channels that share a hash
+	channelLastDecrypted map[string]time.Time
+	channelStatsLock     sync.Mutex
 }
 
 func NewMeshtasticClient(nodeId meshid.NodeID, logger zerolog.Logger) *MeshtasticClient {
@@ -85,6 +101,9 @@ func NewMeshtasticClient(nodeId meshid.NodeID, logger zerolog.Logger) *Meshtasti
 		meshConnectors:    []connectors.MeshConnector{},
 		// 3-minute throttle period matches firmware behavior
 		requestThrottle: newRequestThrottle(3 * time.Minute),
+		verifications:   map[meshid.NodeID]*keyVerification{},
+
+		channelLastDecrypted: map[string]time.Time{},
 	}
 
 	mc.packetCache = ttlcache.New(
@@ -209,25 +228,63 @@ func (c *MeshtasticClient) AddChannelDef(channelDef meshid.ChannelDef) error {
 		ChannelID:  channelDef.GetName(),
 		ChannelKey: &chanKey,
 	})
+	c.channelsLock.Lock()
 	found := false
 	for _, v := range c.channels {
 		if v.GetName() == channelDef.GetName() {
 			if v == channelDef {
+				c.channelsLock.Unlock()
 				return nil
 			}
 			found = true
 			break
 		}
 	}
+	c.channels = append(c.channels, channelDef)
+	c.channelsLock.Unlock()
+
 	if !found {
 		for _, h := range c.meshConnectors {
 			h.AddChannel(channelDef.GetName())
 		}
 	}
-	c.channels = append(c.channels, channelDef)
+	for _, other := range c.ChannelHashCollisions(channelDef) {
+		c.log.Warn().
+			Str("channel", channelDef.GetName()).
+			Str("other_channel", other.GetName()).
+			Msg("Channel shares its hash with another joined channel, both keys will be tried when decrypting")
+	}
+	return nil
+}
+
+// RemoveChannelDef stops listening to a channel. The primary channel can't be removed
+func (c *MeshtasticClient) RemoveChannelDef(channelDef meshid.ChannelDef) error {
+	if c.primaryChannel != nil && channelDefID(c.primaryChannel) == channelDefID(channelDef) {
+		return errors.New("the primary channel can't be removed")
+	}
+	c.channelsLock.Lock()
+	c.channels = slices.DeleteFunc(c.channels, func(v meshid.ChannelDef) bool {
+		return channelDefID(v) == channelDefID(channelDef)
+	})
+	nameStillJoined := slices.ContainsFunc(c.channels, func(v meshid.ChannelDef) bool { return v.GetName() == channelDef.GetName() })
+	c.channelsLock.Unlock()
+
+	// Channels with the same name share a topic, so only stop listening once none are left
+	if !nameStillJoined {
+		for _, h := range c.meshConnectors {
+			h.RemoveChannel(channelDef.GetName())
+		}
+	}
 	return nil
 }
 
+// GetChannels returns the channels the client is listening to
+func (c *MeshtasticClient) GetChannels() []meshid.ChannelDef {
+	c.channelsLock.RLock()
+	defer c.channelsLock.RUnlock()
+	return slices.Clone(c.channels)
+}
+
 func (c *MeshtasticClient) AddEventHandler(handler MeshEventFunc) {
 	c.eventHandlers = append(c.eventHandlers, handler)
 }
@@ -250,10 +307,37 @@ func (c *MeshtasticClient) SetPrimaryChannel(channelName, channelKey string) {
 	c.primaryChannel = def
 }
 
+// GetChannelDef returns the first joined channel with the given name, or nil if none is found
+func (c *MeshtasticClient) GetChannelDef(channelName string) meshid.ChannelDef {
+	c.channelsLock.RLock()
+	defer c.channelsLock.RUnlock()
+	for _, v := range c.channels {
+		if v.GetName() == channelName {
+			return v
+		}
+	}
+	return nil
+}
+
 func (c *MeshtasticClient) SetIsManagedNodeHandler(handler IsManagedFunc) {
 	c.managedNodeFunc = handler
 }
 
+// SetCallsignHandler sets the function used to look up the callsign of a managed node. Nodes with a
+// callsign are operated by licensed amateur radio operators, so they identify themselves with it
+// and never send encrypted packets
+func (c *MeshtasticClient) SetCallsignHandler(handler CallsignFunc) {
+	c.callsignFunc = handler
+}
+
+// getCallsign returns the callsign of a node, or an empty string if it isn't operated by a licensed operator
+func (c *MeshtasticClient) getCallsign(nodeID meshid.NodeID) string {
+	if c.callsignFunc == nil {
+		return ""
+	}
+	return c.callsignFunc(nodeID)
+}
+
 func (c *MeshtasticClient) SetOnConnectHandler(handler MeshConnectedFunc) {
 	c.onConnectHandler = handler
 }
@@ -330,6 +414,15 @@ func (c *MeshtasticClient) GenerateKeyPair() (publicKey, privateKey []byte, err
 	return radio.GenerateKeyPair()
 }
 
+// PublicKeyFromPrivate derives the public key belonging to a Curve25519 private key
+func (c *MeshtasticClient) PublicKeyFromPrivate(privateKey []byte) ([]byte, error) {
+	priv, err := ecdh.X25519().NewPrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return priv.PublicKey().Bytes(), nil
+}
+
 func getLastByteOfNodeNum(num uint32) uint8 {
 	lastByte := uint8(num & 0xFF)
 	if lastByte != 0 {
@@ -376,8 +469,12 @@ func (c *MeshtasticClient) sendBytes(channel meshid.ChannelDef, rawInfo []byte,
 	// While most devices seem to just ignore payloads that are too large, one of my devices
 	// on an older firmware had part of it's memory corrupted and started broadcasting different
 	// node info on every boot, adding junk node IDs the device db of nearby nodes
-	if len(rawInfo) > int(pb.Constants_DATA_PAYLOAD_LEN)-1 {
-		return 0, fmt.Errorf("message is too large for meshtastic network: max(%d) sent(%d)", int(pb.Constants_DATA_PAYLOAD_LEN)-1, len(rawInfo))
+	if len(rawInfo) > MaxPayloadLen {
+		return 0, fmt.Errorf("message is too large for meshtastic network: max(%d) sent(%d)", MaxPayloadLen, len(rawInfo))
+	}
+
+	if c.getCallsign(info.From) != "" && (info.Encrypted == PKIEncryption || (info.Encrypted == PSKEncryption && len(channel.GetKeyBytes()) > 0)) {
+		return 0, ErrLicensedEncryption
 	}
 
 	data := pb.Data{
@@ -389,7 +486,7 @@ func (c *MeshtasticClient) sendBytes(channel meshid.ChannelDef, rawInfo []byte,
 		Emoji:     uint32(emojiVal),
 	}
 
-	if info.WantResponse && info.To != meshid.BROADCAST_ID && (info.PortNum == pb.PortNum_NODEINFO_APP || info.PortNum == pb.PortNum_POSITION_APP || info.PortNum == pb.PortNum_TRACEROUTE_APP) {
+	if info.WantResponse && info.To != meshid.BROADCAST_ID && (info.PortNum == pb.PortNum_NODEINFO_APP || info.PortNum == pb.PortNum_POSITION_APP || info.PortNum == pb.PortNum_TRACEROUTE_APP || info.PortNum == pb.PortNum_KEY_VERIFICATION_APP) {
 		data.WantResponse = true
 		data.Bitfield = ptr.Ptr(*data.Bitfield | uint32(BITFIELD_WantResponse))
 	}
@@ -409,7 +506,7 @@ func (c *MeshtasticClient) sendBytes(channel meshid.ChannelDef, rawInfo []byte,
 
 	key := channel.GetKeyBytes()
 
-	channelHash, _ := radio.ChannelHash(channel.GetName(), key)
+	channelHash := ChannelHash(channel)
 
 	maxHops := c.hopLimit
 	if info.From != c.nodeId {
@@ -433,9 +530,18 @@ func (c *MeshtasticClient) sendBytes(channel meshid.ChannelDef, rawInfo []byte,
 		RelayNode: uint32(getLastByteOfNodeNum(uint32(c.nodeId))),
 	}
 
-	switch info.Encrypted {
+	// Channels without a key have nothing to encrypt with, so their packets are sent decoded
+	encType := info.Encrypted
+	if encType == PSKEncryption && len(key) == 0 {
+		encType = NoEncryption
+	}
+
+	switch encType {
 	case NoEncryption:
-		pkt.Channel = 0
+		// Map reports aren't tied to a channel, the firmware always sends them with a zero hash
+		if info.PortNum == pb.PortNum_MAP_REPORT_APP {
+			pkt.Channel = 0
+		}
 		pkt.PayloadVariant = &pb.MeshPacket_Decoded{
 			Decoded: &data,
 		}
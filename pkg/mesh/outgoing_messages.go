@@ -2,10 +2,14 @@ package mesh
 
 import (
 	"errors"
+	"fmt"
+	"math"
+	"strings"
 	"time"
+	"unicode/utf8"
 
-	"github.com/iancoleman/strcase"
 	"github.com/kabili207/matrix-meshtastic/pkg/meshid"
+	"github.com/kabili207/matrix-meshtastic/pkg/unishox"
 	pb "github.com/meshnet-gophers/meshtastic-go/meshtastic"
 	"github.com/shirou/gopsutil/v4/disk"
 	"github.com/shirou/gopsutil/v4/host"
@@ -14,14 +18,31 @@ import (
 	"go.mau.fi/util/ptr"
 )
 
-func (c *MeshtasticClient) SendMessage(from, to meshid.NodeID, channel meshid.ChannelDef, message string, replyID uint32, usePKI bool) (uint32, error) {
+// TextFits checks if a text message can be sent in a single packet, optionally using compression
+func TextFits(message string, allowCompression bool) bool {
+	if len(message) <= MaxPayloadLen {
+		return true
+	}
+	return allowCompression && len(unishox.Compress(message)) <= MaxPayloadLen
+}
+
+// SendMessage sends a text message. If allowCompression is set and the message is too
+// large to fit in a single packet, it will be sent Unishox2 compressed if that makes it fit
+func (c *MeshtasticClient) SendMessage(from, to meshid.NodeID, channel meshid.ChannelDef, message string, replyID uint32, usePKI, allowCompression bool) (uint32, error) {
 	data := []byte(message)
+	portNum := pb.PortNum_TEXT_MESSAGE_APP
+	if allowCompression && len(data) > MaxPayloadLen {
+		if compressed := unishox.Compress(message); len(compressed) <= MaxPayloadLen {
+			data = compressed
+			portNum = pb.PortNum_TEXT_MESSAGE_COMPRESSED_APP
+		}
+	}
 	encType := PSKEncryption
 	if usePKI {
 		encType = PKIEncryption
 	}
 	return c.sendBytes(channel, data, PacketInfo{
-		PortNum:   pb.PortNum_TEXT_MESSAGE_APP,
+		PortNum:   portNum,
 		Encrypted: encType,
 		From:      from,
 		To:        to,
@@ -70,6 +91,13 @@ func (c *MeshtasticClient) SendNodeInfo(from, to meshid.NodeID, longName, shortN
 		PublicKey:  publicKey,
 	}
 
+	if callsign := c.getCallsign(from); callsign != "" {
+		// Like the firmware, licensed nodes don't announce a public key, as they can't use PKI
+		nodeInfo.IsLicensed = true
+		nodeInfo.LongName = LicensedLongName(callsign, longName)
+		nodeInfo.PublicKey = nil
+	}
+
 	if from == c.nodeId {
 		nodeInfo.IsUnmessagable = ptr.Ptr(true)
 		// We used to use ROUTER, but the new CLIENT_BASE is more accurate to what we do
@@ -256,30 +284,61 @@ func (c *MeshtasticClient) SendNeighborInfoResponse(from, to meshid.NodeID, neig
 }
 
 // TODO: Create a user info struct to hold from, long, and short names
-func (c *MeshtasticClient) SendPosition(from, to meshid.NodeID, location meshid.GeoURI, timestamp *time.Time) (packetID uint32, err error) {
+// SendPosition sends a location on a channel, or with PKI to a single node. The coordinates are
+// truncated to the given number of bits of precision, where 32 is full precision
+func (c *MeshtasticClient) SendPosition(from, to meshid.NodeID, channel meshid.ChannelDef, location meshid.GeoURI, timestamp *time.Time, precision uint32, usePKI bool) (packetID uint32, err error) {
 
 	now := time.Now()
 	now = now.UTC()
 
-	latI := int32(location.Latitude * 1e7)
-	lonI := int32(location.Longitude * 1e7)
+	// Multiplying as float32 would round away the last digits of the coordinate
+	latI := TruncateCoordinate(int32(float64(location.Latitude)*1e7), precision)
+	lonI := TruncateCoordinate(int32(float64(location.Longitude)*1e7), precision)
 
 	nodeInfo := pb.Position{
 		Time:          uint32(now.Unix()),
 		Timestamp:     uint32(timestamp.Unix()),
 		LatitudeI:     &latI,
 		LongitudeI:    &lonI,
-		PrecisionBits: c.GetPrecisionBits(location.Uncertainty),
+		PrecisionBits: precision,
 	}
 
-	return c.sendProtoMessage(c.primaryChannel, &nodeInfo, PacketInfo{
+	encType := PSKEncryption
+	if usePKI {
+		encType = PKIEncryption
+	}
+	return c.sendProtoMessage(channel, &nodeInfo, PacketInfo{
 		PortNum:   pb.PortNum_POSITION_APP,
-		Encrypted: PSKEncryption,
+		Encrypted: encType,
 		From:      from,
 		To:        to,
 	})
 }
 
+// TruncateCoordinate reduces the precision of a coordinate the same way the firmware does, by zeroing
+// its low bits and moving it to the middle of the area it could be in
+func TruncateCoordinate(value int32, precision uint32) int32 {
+	if precision == 0 || precision >= 32 {
+		return value
+	}
+	truncated := uint32(value) & (math.MaxUint32 << (32 - precision))
+	truncated += 1 << (31 - precision)
+	return int32(truncated)
+}
+
+// LicensedLongName adds a callsign to the start of a long name, unless the name already contains it
+func LicensedLongName(callsign, longName string) string {
+	if strings.Contains(strings.ToUpper(longName), callsign) {
+		return longName
+	}
+	name := strings.TrimSpace(callsign + " " + longName)
+	for len(name) > 39 {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return strings.TrimSpace(name)
+}
+
 func (c *MeshtasticClient) GetPrecisionBits(meters *float32) uint32 {
 	if meters == nil {
 		return 0
@@ -359,8 +418,7 @@ func (c *MeshtasticClient) SendMapReport(from meshid.NodeID, longName, shortName
 
 	// TODO: Pull from root topic
 	region := pb.Config_LoRaConfig_RegionCode_value["US"]
-	defChanSnake := strcase.ToScreamingSnake(c.primaryChannel.GetName())
-	preset, hasDefaultChan := pb.Config_LoRaConfig_ModemPreset_value[defChanSnake]
+	preset, hasDefaultChan := c.ModemPreset()
 
 	latI := int32(location.Latitude * 1e7)
 	lonI := int32(location.Longitude * 1e7)
@@ -379,7 +437,7 @@ func (c *MeshtasticClient) SendMapReport(from meshid.NodeID, longName, shortName
 	}
 
 	if hasDefaultChan {
-		nodeInfo.ModemPreset = pb.Config_LoRaConfig_ModemPreset(preset)
+		nodeInfo.ModemPreset = preset
 	}
 
 	if location.Altitude != nil {
@@ -462,3 +520,46 @@ func (c *MeshtasticClient) SendTraceroute(from, to meshid.NodeID, channel meshid
 		WantResponse: true,
 	})
 }
+
+// SendRangeTest broadcasts a range test packet with the given sequence number on the channel
+func (c *MeshtasticClient) SendRangeTest(from meshid.NodeID, channel meshid.ChannelDef, seq uint32) (uint32, error) {
+	return c.sendBytes(channel, []byte(fmt.Sprintf("seq %d", seq)), PacketInfo{
+		PortNum:   pb.PortNum_RANGE_TEST_APP,
+		Encrypted: PSKEncryption,
+		From:      from,
+		To:        meshid.BROADCAST_ID,
+	})
+}
+
+// SendWaypoint broadcasts a waypoint on a channel. Setting the expiry to a time in the
+// past instructs other nodes to delete the waypoint
+func (c *MeshtasticClient) SendWaypoint(from meshid.NodeID, channel meshid.ChannelDef, waypoint Waypoint) (uint32, error) {
+	if len([]byte(waypoint.Name)) > 29 {
+		return 0, errors.New("waypoint name must be less than 30 bytes")
+	}
+	if len([]byte(waypoint.Description)) > 99 {
+		return 0, errors.New("waypoint description must be less than 100 bytes")
+	}
+	latI := int32(float64(waypoint.Latitude) * 1e7)
+	lonI := int32(float64(waypoint.Longitude) * 1e7)
+	w := pb.Waypoint{
+		Id:          waypoint.ID,
+		LatitudeI:   &latI,
+		LongitudeI:  &lonI,
+		Name:        waypoint.Name,
+		Description: waypoint.Description,
+		Icon:        uint32(waypoint.Icon),
+	}
+	if waypoint.Expires != nil {
+		w.Expire = uint32(waypoint.Expires.Unix())
+	}
+	if waypoint.LockedTo != nil {
+		w.LockedTo = uint32(*waypoint.LockedTo)
+	}
+	return c.sendProtoMessage(channel, &w, PacketInfo{
+		PortNum:   pb.PortNum_WAYPOINT_APP,
+		Encrypted: PSKEncryption,
+		From:      from,
+		To:        meshid.BROADCAST_ID,
+	})
+}
@@ -0,0 +1,31 @@
+package mesh
+
+import "testing"
+
+func TestTruncateCoordinate(t *testing.T) {
+	// Expected values follow the firmware, which masks the coordinate as a uint32 and then adds
+	// half of the remaining area: (value & (UINT32_MAX << (32 - precision))) + (1 << (31 - precision))
+	tests := []struct {
+		name      string
+		value     int32
+		precision uint32
+		want      int32
+	}{
+		{"medium precision", 473977419, 16, 473989120},
+		{"low precision", 473977419, 13, 474218496},
+		{"negative medium precision", -1224194155, 16, -1224179712},
+		{"negative low precision", -1224194155, 11, -1223688192},
+		{"negative high precision", -338688000, 24, -338687872},
+		{"one bit", 1, 1, 1073741824},
+		{"31 bits", 473977419, 31, 473977419},
+		{"full precision", 473977419, 32, 473977419},
+		{"no precision", 473977419, 0, 473977419},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := TruncateCoordinate(tt.value, tt.precision); got != tt.want {
+				t.Errorf("TruncateCoordinate(%d, %d) = %d, want %d", tt.value, tt.precision, got, tt.want)
+			}
+		})
+	}
+}
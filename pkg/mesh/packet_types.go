@@ -1,6 +1,14 @@
 package mesh
 
-import "github.com/kabili207/matrix-meshtastic/pkg/meshid"
+import (
+	"time"
+
+	"github.com/kabili207/matrix-meshtastic/pkg/meshid"
+	pb "github.com/meshnet-gophers/meshtastic-go/meshtastic"
+)
+
+// The largest payload that can be safely sent in a single packet
+const MaxPayloadLen = int(pb.Constants_DATA_PAYLOAD_LEN) - 1
 
 type MeshtasticPacket struct {
 	ChannelName  string
@@ -11,3 +19,16 @@ type MeshtasticPacket struct {
 	WantAck      bool
 	WantResponse bool
 }
+
+type Waypoint struct {
+	ID          uint32
+	Name        string
+	Description string
+	Icon        rune
+	Latitude    float32
+	Longitude   float32
+	// The only node allowed to update the waypoint, if set
+	LockedTo *meshid.NodeID
+	// When the waypoint expires. A nil value means it never does
+	Expires *time.Time
+}
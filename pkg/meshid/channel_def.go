@@ -2,7 +2,9 @@ package meshid
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 
 	"github.com/meshnet-gophers/meshtastic-go/radio"
 	"go.mau.fi/util/ptr"
@@ -29,7 +31,12 @@ func NewChannelDef(name string, publicKey *string) (ChannelDef, error) {
 			return nil, err
 		}
 		if len(keyBytes) == 1 {
+			// A single zero byte (AA==) turns encryption off, the same as in the firmware
 			keyBytes = expandShortPSK(keyBytes)
+		} else if bytes.Equal(keyBytes, []byte{0, 0}) {
+			// AAA= isn't a firmware key, but is still accepted as a way of writing an unencrypted channel.
+			// Zeroed keys of full length are real AES keys to the firmware, so they're kept
+			keyBytes = []byte{}
 		}
 	}
 	return &channelDefImpl{
@@ -39,6 +46,17 @@ func NewChannelDef(name string, publicKey *string) (ChannelDef, error) {
 	}, nil
 }
 
+// IsPublicChannel checks if anyone can read a channel, because it's unencrypted or uses
+// one of the well-known keys derived from the default key
+func IsPublicChannel(channel ChannelDef) bool {
+	key := channel.GetKeyBytes()
+	if len(key) == 0 {
+		return true
+	}
+	dkLen := len(radio.DefaultKey)
+	return len(key) == dkLen && bytes.Equal(key[:dkLen-1], radio.DefaultKey[:dkLen-1])
+}
+
 func tryCompactKey(keyBytes []byte) *string {
 	kbLen := len(keyBytes)
 	dkLen := len(radio.DefaultKey)
@@ -91,6 +109,15 @@ func (c *channelDefImpl) GetKeyBytes() []byte {
 	return c.keyBytes
 }
 
+// KeyFingerprint returns a short fingerprint of a channel key, so keys can be compared without revealing them
+func KeyFingerprint(key []byte) string {
+	if len(key) == 0 {
+		return "none"
+	}
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
 func ChannelDefFromPortalID(portalID networkid.PortalID) (channel ChannelDef, err error) {
 	name, key, err := ParsePortalID(portalID)
 	if err != nil {
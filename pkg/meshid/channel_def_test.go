@@ -0,0 +1,42 @@
+package meshid
+
+import (
+	"testing"
+
+	"go.mau.fi/util/ptr"
+)
+
+func TestNewChannelDefUnencryptedKeys(t *testing.T) {
+	tests := []struct {
+		name       string
+		key        *string
+		wantKeyLen int
+		wantString string
+		wantPublic bool
+	}{
+		{"nil", nil, 0, "", true},
+		{"empty", ptr.Ptr(""), 0, "", true},
+		{"short zero", ptr.Ptr("AA=="), 0, "", true},
+		{"legacy two zero bytes", ptr.Ptr("AAA="), 0, "", true},
+		{"full length zero", ptr.Ptr("AAAAAAAAAAAAAAAAAAAAAA=="), 16, "AAAAAAAAAAAAAAAAAAAAAA==", false},
+		{"default", ptr.Ptr("AQ=="), 16, "AQ==", true},
+		{"private", ptr.Ptr("AQIDBAUGBwgJCgsMDQ4PEA=="), 16, "AQIDBAUGBwgJCgsMDQ4PEA==", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			channel, err := NewChannelDef("Test", tt.key)
+			if err != nil {
+				t.Fatalf("NewChannelDef() failed: %v", err)
+			}
+			if got := len(channel.GetKeyBytes()); got != tt.wantKeyLen {
+				t.Errorf("len(GetKeyBytes()) = %d, want %d", got, tt.wantKeyLen)
+			}
+			if got := channel.GetKeyString(); got != tt.wantString {
+				t.Errorf("GetKeyString() = %q, want %q", got, tt.wantString)
+			}
+			if got := IsPublicChannel(channel); got != tt.wantPublic {
+				t.Errorf("IsPublicChannel() = %v, want %v", got, tt.wantPublic)
+			}
+		})
+	}
+}
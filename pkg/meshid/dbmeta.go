@@ -4,12 +4,71 @@ import "maunium.net/go/mautrix/id"
 
 type UserLoginMetadata struct {
 	NodeID NodeID `json:"node_id"`
+	// Set when the node is operated by a licensed amateur radio operator
+	Callsign string `json:"callsign,omitempty"`
+	// Overrides the bridge-wide dm_encryption policy when set
+	DMEncryption string `json:"dm_encryption,omitempty"`
+	// The most bits of precision locations sent from the node may have
+	MaxPositionPrecision *uint32 `json:"max_position_precision,omitempty"`
 }
 
+// How direct messages are encrypted when the public key of the recipient isn't known
+const (
+	// Wait for the key, and refuse to send the message if it doesn't arrive
+	DMEncryptionRequirePKI = "require_pki"
+	// Wait for the key, and fall back to the channel key if it doesn't arrive
+	DMEncryptionPreferPKI = "prefer_pki"
+	// Send with the channel key right away
+	DMEncryptionAllowPSK = "allow_psk"
+)
+
+// IsValidDMEncryption checks if a string is one of the DM encryption policies
+func IsValidDMEncryption(policy string) bool {
+	return policy == DMEncryptionRequirePKI || policy == DMEncryptionPreferPKI || policy == DMEncryptionAllowPSK
+}
+
+// How position updates are bridged into a channel portal
+const (
+	LocationModeOff     = "off"
+	LocationModeMessage = "message"
+	LocationModeBeacon  = "beacon"
+)
+
 type PortalMetadata struct {
-	ChannelName string  `json:"channel_name,omitempty"`
-	ChannelKey  *string `json:"channel_key,omitempty"`
+	ChannelName    string  `json:"channel_name,omitempty"`
+	ChannelKey     *string `json:"channel_key,omitempty"`
+	AlertHighlight *bool   `json:"alert_highlight,omitempty"`
+	CompressText   *bool   `json:"compress_text,omitempty"`
+	LocationMode   string  `json:"location_mode,omitempty"`
+	// The most bits of precision locations sent to the channel may have
+	PositionPrecision *uint32 `json:"position_precision,omitempty"`
+}
+
+// ShouldHighlightAlerts indicates if alert and detection sensor notices should mention the whole room.
+// Defaults to true when not set
+func (m *PortalMetadata) ShouldHighlightAlerts() bool {
+	return m.AlertHighlight == nil || *m.AlertHighlight
 }
+
+// ShouldCompressText indicates if oversized outgoing messages may be sent compressed.
+// Falls back to the bridge-wide default when not set
+func (m *PortalMetadata) ShouldCompressText(defaultValue bool) bool {
+	if m.CompressText == nil {
+		return defaultValue
+	}
+	return *m.CompressText
+}
+
+// GetLocationMode returns how position updates are bridged. Defaults to off when not set
+func (m *PortalMetadata) GetLocationMode() string {
+	if m.LocationMode == "" {
+		return LocationModeOff
+	}
+	return m.LocationMode
+}
+
 type GhostMetadata struct {
 	UserMXID id.UserID `json:"user_mxid,omitempty"`
+	// Whether the positions of the node may be bridged to portals that have locations turned on
+	ShareLocation bool `json:"share_location,omitempty"`
 }
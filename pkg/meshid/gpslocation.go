@@ -3,6 +3,7 @@ package meshid
 import (
 	"errors"
 	"fmt"
+	"math"
 	"net/url"
 	"sort"
 	"strconv"
@@ -165,3 +166,18 @@ func (g *GeoURI) String() string {
 
 	return builder.String()
 }
+
+// earthRadiusMeters is the mean radius of the Earth as used by the Meshtastic apps
+const earthRadiusMeters = 6371e3
+
+// DistanceTo returns the great-circle distance in meters between two locations
+func (g *GeoURI) DistanceTo(other *GeoURI) float64 {
+	lat1 := float64(g.Latitude) * math.Pi / 180
+	lat2 := float64(other.Latitude) * math.Pi / 180
+	dLat := lat2 - lat1
+	dLon := float64(other.Longitude-g.Longitude) * math.Pi / 180
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return earthRadiusMeters * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
@@ -34,9 +34,13 @@ func (mc *MessageConverter) convertPill(displayname, mxid, eventID string, ctx f
 	}
 	idUser := id.UserID(mxid)
 
-	nodeID := meshid.MXIDToNodeID(idUser)
+	var nodeID meshid.NodeID
 	if gid, ok := mc.Bridge.Matrix.ParseGhostMXID(idUser); ok {
 		nodeID, _ = meshid.ParseUserID(gid)
+	} else if mc.UserNodeID != nil {
+		nodeID = mc.UserNodeID(ctx.Ctx, idUser)
+	} else {
+		nodeID = meshid.MXIDToNodeID(idUser)
 	}
 
 	nodeStr := nodeID.String()
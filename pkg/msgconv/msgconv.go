@@ -1,15 +1,21 @@
 package msgconv
 
 import (
+	"context"
+
 	"github.com/kabili207/matrix-meshtastic/pkg/connector/meshdb"
+	"github.com/kabili207/matrix-meshtastic/pkg/meshid"
 	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/id"
 )
 
 type MessageConverter struct {
 	Bridge     *bridgev2.Bridge
 	HTMLParser *format.HTMLParser
 	MeshDB     *meshdb.Database
+	// Looks up the node ID a Matrix user sends from
+	UserNodeID func(ctx context.Context, mxid id.UserID) meshid.NodeID
 }
 
 func New(br *bridgev2.Bridge, db *meshdb.Database) *MessageConverter {
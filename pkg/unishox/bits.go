@@ -0,0 +1,235 @@
+package unishox
+
+// bitWriter appends MSB-first bit sequences to a byte slice
+type bitWriter struct {
+	buf  []byte
+	bits int
+}
+
+// write appends the top n bits of code
+func (w *bitWriter) write(code byte, n int) {
+	for i := 0; i < n; i++ {
+		if w.bits%8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		if code&(0x80>>i) != 0 {
+			w.buf[w.bits/8] |= 0x80 >> (w.bits % 8)
+		}
+		w.bits++
+	}
+}
+
+// writeValue appends the lowest n bits of val, most significant bit first
+func (w *bitWriter) writeValue(val int32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		var b byte
+		if val&(1<<i) != 0 {
+			b = 0x80
+		}
+		w.write(b, 1)
+	}
+}
+
+func (w *bitWriter) writeSwitch(state int) {
+	if state == setDelta {
+		w.write(uniStateSplCode, uniStateSplCodeLen)
+		w.write(uniStateSwCode, uniStateSwCodeLen)
+	} else {
+		w.write(swCode, swCodeLen)
+	}
+}
+
+func (w *bitWriter) writeHCode(set int) {
+	w.write(hCodes[set], int(hCodeLens[set]))
+}
+
+func (w *bitWriter) writeVCode(idx int) {
+	w.write(vCodes[idx], int(vCodeLens[idx]))
+}
+
+// writeCode appends a character code, switching sets as needed
+func (w *bitWriter) writeCode(code byte, state *int) {
+	hcode := int(code >> 5)
+	vcode := int(code & 0x1F)
+	switch hcode {
+	case setAlpha:
+		if *state != setAlpha {
+			w.writeSwitch(*state)
+			w.writeHCode(setAlpha)
+			*state = setAlpha
+		}
+	case setSym:
+		w.writeSwitch(*state)
+		w.writeHCode(setSym)
+	case setNum:
+		if *state != setNum {
+			w.writeSwitch(*state)
+			w.writeHCode(setNum)
+			if c := sets[hcode][vcode]; c >= '0' && c <= '9' {
+				*state = setNum
+			}
+		}
+	}
+	w.writeVCode(vcode)
+}
+
+func (w *bitWriter) writeCount(count int32) {
+	var till, base int32
+	for i := range countBitLens {
+		till += 1 << countBitLens[i]
+		if count < till {
+			w.write(countCodes[i]&0xF8, int(countCodes[i]&0x07))
+			w.writeValue(count-base, int(countBitLens[i]))
+			return
+		}
+		base = till
+	}
+}
+
+func (w *bitWriter) writeUnicode(code, prev int32) {
+	diff := code - prev
+	if diff < 0 {
+		diff = -diff
+	}
+	var till int32
+	for i := range uniBitLens {
+		till += 1 << uniBitLens[i]
+		if diff < till {
+			w.write(uniCodes[i]&0xF8, int(uniCodes[i]&0x07))
+			if prev > code {
+				w.write(0x80, 1)
+			} else {
+				w.write(0, 1)
+			}
+			w.writeValue(diff-uniAdder[i], int(uniBitLens[i]))
+			return
+		}
+	}
+}
+
+// bitReader reads MSB-first bit sequences from a byte slice
+type bitReader struct {
+	in  []byte
+	pos int
+	len int
+}
+
+func (r *bitReader) bit(pos int) bool {
+	return r.in[pos/8]&(0x80>>(pos%8)) != 0
+}
+
+// peekByte returns the next 8 bits, padding with zeros past the end of the input
+func (r *bitReader) peekByte() byte {
+	var b byte
+	for i := 0; i < 8; i++ {
+		if r.pos+i < r.len && r.bit(r.pos+i) {
+			b |= 0x80 >> i
+		}
+	}
+	return b
+}
+
+// readNum reads an n bit number, returning -1 if there aren't enough bits left
+func (r *bitReader) readNum(n int) int32 {
+	if r.pos+n > r.len {
+		return -1
+	}
+	var val int32
+	for i := 0; i < n; i++ {
+		val <<= 1
+		if r.bit(r.pos + i) {
+			val |= 1
+		}
+	}
+	r.pos += n
+	return val
+}
+
+// readStepCode counts consecutive 1 bits, up to limit, consuming the terminating 0
+func (r *bitReader) readStepCode(limit int) int {
+	idx := 0
+	for r.pos < r.len && r.bit(r.pos) {
+		idx++
+		r.pos++
+		if idx == limit {
+			return idx
+		}
+	}
+	if r.pos >= r.len {
+		return splCodeEnd
+	}
+	r.pos++
+	return idx
+}
+
+func (r *bitReader) readVCode() int {
+	if r.pos >= r.len {
+		return splCodeEnd
+	}
+	b := r.peekByte()
+	for i, code := range vCodes {
+		mask := byte(0xFF << (8 - vCodeLens[i]))
+		if b&mask == code {
+			r.pos += int(vCodeLens[i])
+			return i
+		}
+	}
+	return splCodeEnd
+}
+
+func (r *bitReader) readHCode() int {
+	if r.pos >= r.len {
+		return splCodeEnd
+	}
+	b := r.peekByte()
+	for i, code := range hCodes {
+		mask := byte(0xFF << (8 - hCodeLens[i]))
+		if b&mask == code {
+			r.pos += int(hCodeLens[i])
+			return i
+		}
+	}
+	return splCodeEnd
+}
+
+func (r *bitReader) readCount() int32 {
+	idx := r.readStepCode(4)
+	if idx == splCodeEnd {
+		return -1
+	}
+	val := r.readNum(int(countBitLens[idx]))
+	if val < 0 {
+		return -1
+	}
+	if idx > 0 {
+		val += countAdder[idx-1]
+	}
+	return val
+}
+
+// readUnicode reads a code point delta. Special codes are returned as
+// 0x7FFFFF00 plus the index of the special code
+func (r *bitReader) readUnicode() int32 {
+	idx := r.readStepCode(5)
+	if idx == splCodeEnd {
+		return 0x7FFFFF00 + splCodeEnd
+	}
+	if idx == 5 {
+		idx = r.readStepCode(4)
+		return 0x7FFFFF00 + int32(idx)
+	}
+	if r.pos >= r.len {
+		return 0x7FFFFF00 + splCodeEnd
+	}
+	negative := r.bit(r.pos)
+	r.pos++
+	val := r.readNum(int(uniBitLens[idx]))
+	if val < 0 {
+		return 0x7FFFFF00 + splCodeEnd
+	}
+	val += uniAdder[idx]
+	if negative {
+		return -val
+	}
+	return val
+}
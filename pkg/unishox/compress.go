@@ -0,0 +1,174 @@
+package unishox
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Compress encodes a string using the default Unishox2 preset
+func Compress(in string) []byte {
+	w := &bitWriter{}
+	w.write(magicBits, magicBitLen)
+
+	state := setAlpha
+	prevUni := int32(0)
+
+	for l := 0; l < len(in); l++ {
+		if l < len(in)-niceLen+1 {
+			if next, ok := writeBackReference(w, in, l, state); ok {
+				l = next
+				continue
+			}
+		}
+
+		c := in[l]
+		if l > 0 && l < len(in)-4 && c < utf8.RuneSelf &&
+			c == in[l-1] && c == in[l+1] && c == in[l+2] && c == in[l+3] {
+			count := l + 4
+			for count < len(in) && in[count] == c {
+				count++
+			}
+			count -= l
+			w.writeCode(rptCode, &state)
+			w.writeCount(int32(count - 4))
+			l += count - 1
+			continue
+		}
+
+		if i := freqSeqAt(in, l); i >= 0 {
+			w.writeCode(freqCodes[i], &state)
+			l += len(freqSeq[i]) - 1
+			continue
+		}
+
+		if state == setDelta && (c == ' ' || c == '.' || c == ',' || c == '\n') {
+			w.write(uniStateSplCode, uniStateSplCodeLen)
+			switch c {
+			case ' ':
+				w.write(0x00, 1)
+			case ',':
+				w.write(0xC0, 3)
+			case '.':
+				w.write(0xE0, 4)
+			case '\n':
+				w.write(0xF0, 4)
+			}
+			continue
+		}
+
+		switch {
+		case c >= 32 && c < 127:
+			if c >= 'A' && c <= 'Z' {
+				if state != setAlpha {
+					w.writeSwitch(state)
+					w.writeHCode(setAlpha)
+					state = setAlpha
+				}
+				w.writeSwitch(state)
+				w.writeHCode(setAlpha)
+			}
+			if c == ' ' {
+				if state == setNum {
+					w.writeCode(numSpcCode, &state)
+				} else {
+					w.writeVCode(1)
+				}
+			} else {
+				w.writeCode(code94[c-33], &state)
+			}
+		case c == '\r' && l+1 < len(in) && in[l+1] == '\n':
+			w.writeCode(crlfCode, &state)
+			l++
+		case c == '\n':
+			w.writeCode(lfCode, &state)
+		case c == '\r':
+			w.writeCode(crCode, &state)
+		case c == '\t':
+			w.writeCode(tabCode, &state)
+		default:
+			r, size := utf8.DecodeRuneInString(in[l:])
+			if r == utf8.RuneError && size <= 1 {
+				l = writeBinary(w, in, l, state)
+				continue
+			}
+			if state != setDelta {
+				if next, nextSize := utf8.DecodeRuneInString(in[l+size:]); next >= utf8.RuneSelf && !(next == utf8.RuneError && nextSize <= 1) {
+					// Several unicode characters in a row, switch to continuous delta coding
+					if state != setAlpha {
+						w.writeSwitch(state)
+						w.writeHCode(setAlpha)
+					}
+					w.writeSwitch(setAlpha)
+					w.writeHCode(setAlpha)
+					w.writeVCode(1)
+					state = setDelta
+				} else {
+					w.writeSwitch(state)
+					w.writeHCode(setDelta)
+				}
+			}
+			w.writeUnicode(int32(r), prevUni)
+			prevUni = int32(r)
+			l += size - 1
+		}
+	}
+	return w.buf
+}
+
+// freqSeqAt returns the index of the frequent sequence that starts at position l, or -1
+func freqSeqAt(in string, l int) int {
+	for i, seq := range freqSeq {
+		if strings.HasPrefix(in[l:], seq) {
+			return i
+		}
+	}
+	return -1
+}
+
+// writeBackReference looks for the longest earlier occurrence of the text at position l
+// and writes a dictionary reference to it if one is found
+func writeBackReference(w *bitWriter, in string, l int, state int) (int, bool) {
+	longestLen, longestDist := -1, 0
+	for j := l - niceLen; j >= 0; j-- {
+		k := l
+		for k < len(in) && j+k-l < l && in[k] == in[j+k-l] {
+			k++
+		}
+		// Don't split UTF-8 sequences
+		for k < len(in) && k > l && in[k]>>6 == 2 {
+			k--
+		}
+		if k-l >= niceLen && k-l-niceLen > longestLen {
+			longestLen = k - l - niceLen
+			longestDist = l - j - niceLen + 1
+		}
+	}
+	if longestLen < 0 {
+		return l, false
+	}
+	w.writeSwitch(state)
+	w.writeHCode(setDict)
+	w.writeCount(int32(longestLen))
+	w.writeCount(int32(longestDist))
+	return l + longestLen + niceLen - 1, true
+}
+
+// writeBinary writes a run of bytes that aren't valid UTF-8 verbatim, returning the last position written
+func writeBinary(w *bitWriter, in string, l int, state int) int {
+	count := 1
+	for i := l + 1; i < len(in); i++ {
+		if r, size := utf8.DecodeRuneInString(in[i:]); r != utf8.RuneError || size > 1 {
+			break
+		}
+		count++
+	}
+	w.writeSwitch(state)
+	w.writeHCode(setNum)
+	w.write(0, 2)
+	w.write(0xF8, 5)
+	w.writeCount(int32(count))
+	for i := 0; i < count; i++ {
+		w.writeValue(int32(in[l+i]), 8)
+	}
+	return l + count - 1
+}
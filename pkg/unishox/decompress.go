@@ -0,0 +1,356 @@
+package unishox
+
+import "unicode/utf8"
+
+const (
+	nibNum = iota
+	nibHexLower
+	nibHexUpper
+)
+
+func hexChar(nibble int32, hexType int) byte {
+	if nibble >= 0 && nibble <= 9 {
+		return byte('0' + nibble)
+	} else if hexType < nibHexUpper {
+		return byte('a' + nibble - 10)
+	}
+	return byte('A' + nibble - 10)
+}
+
+// decoder holds the output of a decompression run
+type decoder struct {
+	out []byte
+}
+
+func (d *decoder) put(b ...byte) error {
+	if len(d.out)+len(b) > MaxDecodedLen {
+		return ErrOutputTooLong
+	}
+	d.out = append(d.out, b...)
+	return nil
+}
+
+func (d *decoder) putRune(r int32) error {
+	if r < 0 || r > utf8.MaxRune {
+		return nil
+	}
+	return d.put(utf8.AppendRune(nil, rune(r))...)
+}
+
+// copyBack copies a previously decoded sequence, as referenced by the dictionary code
+func (d *decoder) copyBack(r *bitReader) (bool, error) {
+	count := r.readCount()
+	if count < 0 {
+		return false, nil
+	}
+	dist := r.readCount()
+	if dist < 0 {
+		return false, nil
+	}
+	count += niceLen
+	dist += niceLen - 1
+	start := len(d.out) - int(dist)
+	if start < 0 {
+		return false, nil
+	}
+	for i := 0; i < int(count); i++ {
+		if err := d.put(d.out[start+i]); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Decompress decodes a Unishox2 compressed buffer using the default preset
+func Decompress(in []byte) (string, error) {
+	r := &bitReader{in: in, pos: magicBitLen, len: len(in) * 8}
+	d := &decoder{}
+
+	dstate, h := setAlpha, setAlpha
+	isAllUpper := false
+	prevUni := int32(0)
+
+	for r.pos < r.len {
+		origPos := r.pos
+		if dstate == setDelta || h == setDelta {
+			if dstate != setDelta {
+				h = dstate
+			}
+			delta := r.readUnicode()
+			if delta>>8 == 0x7FFFFF {
+				splCodeIdx := delta & 0xFF
+				if splCodeIdx == splCodeEnd {
+					break
+				}
+				handled := true
+				switch splCodeIdx {
+				case 0:
+					if err := d.put(' '); err != nil {
+						return "", err
+					}
+				case 1:
+					h = r.readHCode()
+					if h == splCodeEnd {
+						r.pos = r.len
+					} else if h == setDelta || h == setAlpha {
+						dstate = h
+					} else if h == setDict {
+						ok, err := d.copyBack(r)
+						if err != nil {
+							return "", err
+						} else if !ok {
+							return string(d.out), nil
+						}
+						h = dstate
+					} else {
+						handled = false
+					}
+				case 2:
+					if err := d.put(','); err != nil {
+						return "", err
+					}
+				case 3:
+					if err := d.put('.'); err != nil {
+						return "", err
+					}
+				case 4:
+					if err := d.put('\n'); err != nil {
+						return "", err
+					}
+				}
+				if handled {
+					continue
+				}
+			} else {
+				prevUni += delta
+				if err := d.putRune(prevUni); err != nil {
+					return "", err
+				}
+			}
+			if dstate == setDelta && h == setDelta {
+				continue
+			}
+		} else {
+			h = dstate
+		}
+
+		var c byte
+		isUpper := isAllUpper
+		v := r.readVCode()
+		if v == splCodeEnd || h == setDelta {
+			break
+		}
+		if v == 0 && h != setSym {
+			if r.pos >= r.len {
+				break
+			}
+			if h != setNum || dstate != setDelta {
+				h = r.readHCode()
+				if h == splCodeEnd || r.pos >= r.len {
+					r.pos = origPos
+					break
+				}
+			}
+			if h == setAlpha {
+				if dstate == setAlpha {
+					if isAllUpper {
+						isUpper, isAllUpper = false, false
+						continue
+					}
+					v = r.readVCode()
+					if v == splCodeEnd {
+						break
+					}
+					if v == 0 {
+						v = r.readVCode()
+						if v == splCodeEnd {
+							break
+						}
+						if v == 0 {
+							isAllUpper = true
+							continue
+						}
+					}
+					isUpper = true
+				} else {
+					dstate = setAlpha
+					continue
+				}
+			} else if h == setDict {
+				ok, err := d.copyBack(r)
+				if err != nil {
+					return "", err
+				} else if !ok {
+					break
+				}
+				continue
+			} else if h == setDelta {
+				continue
+			} else {
+				if h != setNum || dstate != setDelta {
+					v = r.readVCode()
+				}
+				if v == splCodeEnd {
+					break
+				}
+				if h == setNum && v == 0 {
+					ok, err := d.readEscape(r)
+					if err != nil {
+						return "", err
+					} else if !ok {
+						break
+					}
+					if dstate == setDelta {
+						h = setDelta
+					}
+					continue
+				}
+			}
+		}
+		if isUpper && v == 1 {
+			// Continuous unicode delta coding
+			h, dstate = setDelta, setDelta
+			continue
+		}
+		if h < 3 && v < 28 {
+			c = sets[h][v]
+		}
+		if c >= 'a' && c <= 'z' {
+			dstate = setAlpha
+			if isUpper {
+				c -= 32
+			}
+		} else if c >= '0' && c <= '9' {
+			dstate = setNum
+		} else if c == 0 {
+			var err error
+			if v == 8 {
+				err = d.put('\r', '\n')
+			} else if h == setNum && v == 26 {
+				count := r.readCount()
+				if count < 0 || len(d.out) == 0 {
+					break
+				}
+				rpt := d.out[len(d.out)-1]
+				for i := int32(0); i < count+4 && err == nil; i++ {
+					err = d.put(rpt)
+				}
+			} else if h == setSym && v > 24 {
+				err = d.put([]byte(freqSeq[v-25])...)
+			} else if h == setNum && v > 22 && v < 26 {
+				err = d.put([]byte(freqSeq[v-20])...)
+			} else {
+				// Terminator
+				break
+			}
+			if err != nil {
+				return "", err
+			}
+			if dstate == setDelta {
+				h = setDelta
+			}
+			continue
+		}
+		if dstate == setDelta {
+			h = setDelta
+		}
+		if err := d.put(c); err != nil {
+			return "", err
+		}
+	}
+	return string(d.out), nil
+}
+
+// readEscape decodes the sequences that follow the nibble escape code:
+// templates, hex strings, GUIDs and raw binary
+func (d *decoder) readEscape(r *bitReader) (bool, error) {
+	idx := r.readStepCode(5)
+	switch {
+	case idx == splCodeEnd:
+		return false, nil
+	case idx == 0:
+		idx = r.readStepCode(4)
+		if idx >= 5 {
+			return false, nil
+		}
+		rem := r.readCount()
+		if rem < 0 || templates[idx] == "" {
+			return false, nil
+		}
+		tmpl := templates[idx]
+		if int(rem) > len(tmpl) {
+			return false, nil
+		}
+		for _, ct := range []byte(tmpl[:len(tmpl)-int(rem)]) {
+			var nibbleLen int
+			switch ct {
+			case 'f', 'F':
+				nibbleLen = 4
+			case 'r':
+				nibbleLen = 3
+			case 't':
+				nibbleLen = 2
+			case 'o':
+				nibbleLen = 1
+			}
+			if nibbleLen == 0 {
+				if err := d.put(ct); err != nil {
+					return false, err
+				}
+				continue
+			}
+			raw := r.readNum(nibbleLen)
+			if raw < 0 {
+				return false, nil
+			}
+			hexType := nibHexLower
+			if ct == 'F' {
+				hexType = nibHexUpper
+			}
+			if err := d.put(hexChar(raw, hexType)); err != nil {
+				return false, err
+			}
+		}
+	case idx == 5:
+		count := r.readCount()
+		if count <= 0 {
+			return false, nil
+		}
+		for ; count > 0; count-- {
+			raw := r.readNum(8)
+			if raw < 0 {
+				return false, nil
+			}
+			if err := d.put(byte(raw)); err != nil {
+				return false, err
+			}
+		}
+	default:
+		var count int32 = 32
+		if idx != 2 && idx != 4 {
+			count = r.readCount()
+			if count <= 0 {
+				return false, nil
+			}
+		}
+		hexType := nibHexLower
+		if idx >= 3 {
+			hexType = nibHexUpper
+		}
+		for ; count > 0; count-- {
+			nibble := r.readNum(4)
+			if nibble < 0 {
+				return false, nil
+			}
+			if err := d.put(hexChar(nibble, hexType)); err != nil {
+				return false, err
+			}
+			if (idx == 2 || idx == 4) && (count == 25 || count == 21 || count == 17 || count == 13) {
+				if err := d.put('-'); err != nil {
+					return false, err
+				}
+			}
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,49 @@
+// genvectors writes reference_vectors.txt from the reference C Unishox2 implementation, so the
+// Go codec can be checked against it. Build it against unishox2.c from the firmware or from
+// https://github.com/siara-cc/Unishox2 and run it from this directory:
+//
+//   cc -o genvectors genvectors.c path/to/unishox2.c -Ipath/to && ./genvectors > reference_vectors.txt
+//
+// Each line holds the hex encoded text and the hex encoded compressed bytes, separated by a tab
+
+#include <stdio.h>
+#include <string.h>
+
+#include "unishox2.h"
+
+static const char *const inputs[] = {
+	"hello",
+	"Hi",
+	"12",
+	"Hello World",
+	"HELLO WORLD",
+	"MeshTastic 2.5.3",
+	"Call me at 555-1234",
+	"Meet at the trailhead at 10:30, bring water",
+	"aaaaaaaaaaaaaaaaaaaa!!!!!!!!",
+	"the quick brown fox, the quick brown fox, the quick brown fox",
+	"{\"lat\": 45.4215, \"lon\": -75.6972}",
+	"see https://meshtastic.org/docs/",
+	"Line one\nLine two\r\nLine three\ttab",
+	"Gr\xc3\xbc\xc3\x9f" "e aus K\xc3\xb6ln",
+	"\xe3\x81\x93\xe3\x82\x93\xe3\x81\xab\xe3\x81\xa1\xe3\x81\xaf\xe4\xb8\x96\xe7\x95\x8c",
+	"Signal \xf0\x9f\x93\xb6 good \xf0\x9f\x91\x8d",
+};
+
+static void print_hex(const char *s, int len) {
+	for (int i = 0; i < len; i++) {
+		printf("%02x", (unsigned char)s[i]);
+	}
+}
+
+int main(void) {
+	char out[1024];
+	for (size_t i = 0; i < sizeof(inputs) / sizeof(inputs[0]); i++) {
+		int len = unishox2_compress_simple(inputs[i], strlen(inputs[i]), out);
+		print_hex(inputs[i], strlen(inputs[i]));
+		printf("\t");
+		print_hex(out, len);
+		printf("\n");
+	}
+	return 0;
+}
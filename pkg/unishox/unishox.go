@@ -0,0 +1,111 @@
+// Package unishox implements the Unishox2 short string compression scheme
+// used by Meshtastic devices for TEXT_MESSAGE_COMPRESSED_APP packets.
+//
+// Only the default preset is supported, which is the one used by the firmware.
+// The decoder understands the full format, while the encoder sticks to the subset
+// that matters for chat messages (character sets, repeats, back references and
+// unicode deltas)
+package unishox
+
+import "errors"
+
+// Indexes of the horizontal code sets
+const (
+	setAlpha = iota
+	setSym
+	setNum
+	setDict
+	setDelta
+)
+
+const (
+	// Minimum length of a back reference
+	niceLen = 5
+
+	// Maximum number of bytes the decoder will produce before giving up
+	MaxDecodedLen = 4096
+
+	rptCode    = (setNum << 5) + 26
+	lfCode     = (setSym << 5) + 7
+	crlfCode   = (setSym << 5) + 8
+	crCode     = (setSym << 5) + 22
+	tabCode    = (setSym << 5) + 14
+	numSpcCode = (setNum << 5) + 17
+
+	uniStateSplCode    = 0xF8
+	uniStateSplCodeLen = 5
+	uniStateSwCode     = 0x80
+	uniStateSwCodeLen  = 2
+	swCode             = 0
+	swCodeLen          = 2
+
+	magicBits   = 0xFF
+	magicBitLen = 1
+
+	splCodeEnd = 99
+)
+
+var ErrOutputTooLong = errors.New("decoded message is too long")
+
+var hCodes = [5]byte{0x00, 0x40, 0x80, 0xC0, 0xE0}
+var hCodeLens = [5]byte{2, 2, 2, 3, 3}
+
+var vCodes = [28]byte{
+	0x00, 0x40, 0x60, 0x80, 0x90, 0xA0, 0xB0,
+	0xC0, 0xD0, 0xD8, 0xE0, 0xE4, 0xE8, 0xEC,
+	0xEE, 0xF0, 0xF2, 0xF4, 0xF6, 0xF7, 0xF8,
+	0xF9, 0xFA, 0xFB, 0xFC, 0xFD, 0xFE, 0xFF,
+}
+var vCodeLens = [28]byte{
+	2, 3, 3, 4, 4, 4, 4,
+	4, 5, 5, 6, 6, 6, 7,
+	7, 7, 7, 7, 8, 8, 8,
+	8, 8, 8, 8, 8, 8, 8,
+}
+
+var sets = [3][28]byte{
+	{0, ' ', 'e', 't', 'a', 'o', 'i', 'n',
+		's', 'r', 'l', 'c', 'd', 'h', 'u', 'p',
+		'm', 'b', 'g', 'w', 'f', 'y', 'v', 'k',
+		'q', 'j', 'x', 'z'},
+	{'"', '{', '}', '_', '<', '>', ':', '\n',
+		0, '[', ']', '\\', ';', '\'', '\t', '@',
+		'*', '&', '?', '!', '^', '|', '\r', '~',
+		'`', 0, 0, 0},
+	{0, ',', '.', '0', '1', '9', '2', '5',
+		'-', '/', '3', '4', '6', '7', '8', '(',
+		')', ' ', '=', '+', '$', '%', '#', 0,
+		0, 0, 0, 0},
+}
+
+var freqSeq = [6]string{"\": \"", "\": ", "</", "=\"", "\":\"", "://"}
+var freqCodes = [6]byte{
+	(setSym << 5) + 25, (setSym << 5) + 26, (setSym << 5) + 27,
+	(setNum << 5) + 23, (setNum << 5) + 24, (setNum << 5) + 25,
+}
+
+var templates = [5]string{"tfff-of-tfTtf:rf:rf.fffZ", "tfff-of-tf", "(fff) fff-ffff", "tf:rf:rf", ""}
+
+var countBitLens = [5]byte{2, 4, 7, 11, 16}
+var countAdder = [5]int32{4, 20, 148, 2196, 67732}
+var countCodes = [5]byte{0x01, 0x82, 0xC3, 0xE4, 0xF4}
+
+var uniBitLens = [5]byte{6, 12, 14, 16, 21}
+var uniAdder = [5]int32{0, 64, 4160, 20544, 86080}
+var uniCodes = [5]byte{0x01, 0x82, 0xC3, 0xE4, 0xF5}
+
+// code94 maps printable ASCII characters (starting at '!') to their set and code index
+var code94 [94]byte
+
+func init() {
+	for i := range sets {
+		for j, c := range sets[i] {
+			if c > 32 {
+				code94[c-33] = byte(i<<5 + j)
+				if c >= 'a' && c <= 'z' {
+					code94[c-33-('a'-'A')] = byte(i<<5 + j)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package unishox
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Vectors assembled bit by bit from the default Unishox2 code tables, so they don't depend on
+// this encoder. Each starts with the magic bit, followed by the codes noted next to it.
+var vectors = []struct {
+	name       string
+	text       string
+	compressed []byte
+}{
+	// h 1110110, e 011, l 111000, l 111000, o 1010
+	{"lowercase", "hello", []byte{0xF6, 0x7C, 0x71, 0x40}},
+	// switch 00, alpha 00 (upper case), h 1110110, i 1011
+	{"uppercase", "Hi", []byte{0x87, 0x6B}},
+	// switch 00, num 10, 1 1001, 2 1011
+	{"numbers", "12", []byte{0x94, 0xD8}},
+}
+
+func TestDecompressVectors(t *testing.T) {
+	for _, v := range vectors {
+		t.Run(v.name, func(t *testing.T) {
+			out, err := Decompress(v.compressed)
+			if err != nil {
+				t.Fatalf("Decompress(%X) failed: %v", v.compressed, err)
+			} else if out != v.text {
+				t.Errorf("Decompress(%X) = %q, want %q", v.compressed, out, v.text)
+			}
+		})
+	}
+}
+
+func TestCompressVectors(t *testing.T) {
+	for _, v := range vectors {
+		t.Run(v.name, func(t *testing.T) {
+			if out := Compress(v.text); !bytes.Equal(out, v.compressed) {
+				t.Errorf("Compress(%q) = %X, want %X", v.text, out, v.compressed)
+			}
+		})
+	}
+}
+
+// TestReferenceVectors checks both directions against vectors produced by the reference C
+// implementation, which are generated with testdata/genvectors.c
+func TestReferenceVectors(t *testing.T) {
+	f, err := os.Open("testdata/reference_vectors.txt")
+	if errors.Is(err, fs.ErrNotExist) {
+		t.Skip("testdata/reference_vectors.txt hasn't been generated, see testdata/genvectors.c")
+	} else if err != nil {
+		t.Fatalf("Failed to open reference vectors: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		textHex, compressedHex, ok := strings.Cut(scanner.Text(), "\t")
+		if !ok {
+			t.Fatalf("Line %d of the reference vectors is malformed", line)
+		}
+		text, err := hex.DecodeString(textHex)
+		if err != nil {
+			t.Fatalf("Line %d has invalid text: %v", line, err)
+		}
+		compressed, err := hex.DecodeString(compressedHex)
+		if err != nil {
+			t.Fatalf("Line %d has invalid compressed bytes: %v", line, err)
+		}
+		if out := Compress(string(text)); !bytes.Equal(out, compressed) {
+			t.Errorf("Compress(%q) = %X, want %X", text, out, compressed)
+		}
+		if out, err := Decompress(compressed); err != nil {
+			t.Errorf("Decompress(%X) failed: %v", compressed, err)
+		} else if out != string(text) {
+			t.Errorf("Decompress(%X) = %q, want %q", compressed, out, text)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("Failed to read reference vectors: %v", err)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []string{
+		"",
+		"a",
+		"Hello, World!",
+		"HELLO WORLD",
+		"Meet at the trailhead at 10:30, bring water",
+		"Temp 21.5C, humidity 48%, pressure 1013.2 hPa",
+		"Line one\nLine two\r\nLine three\rtab\there",
+		"{\"lat\": 45.4215, \"lon\": -75.6972}",
+		"see https://meshtastic.org/docs/",
+		"aaaaaaaaaaaaaaaaaaaa!!!!!!!!",
+		"the quick brown fox, the quick brown fox, the quick brown fox",
+		"Grüße aus Köln",
+		"こんにちは世界",
+		"Signal 📶 good 👍 see you 🙂",
+		"mixed ünïcödé and ASCII 123",
+		"invalid \xff\xfe utf-8",
+		strings.Repeat("Mesh networking is fun. ", 8),
+	}
+	for _, text := range tests {
+		compressed := Compress(text)
+		out, err := Decompress(compressed)
+		if err != nil {
+			t.Errorf("Decompress(Compress(%q)) failed: %v", text, err)
+		} else if out != text {
+			t.Errorf("Decompress(Compress(%q)) = %q", text, out)
+		}
+	}
+}
+
+func TestCompressShrinksText(t *testing.T) {
+	text := "The quick brown fox jumps over the lazy dog near the river bank"
+	if compressed := Compress(text); len(compressed) >= len(text) {
+		t.Errorf("Compress(%q) produced %d bytes, expected fewer than %d", text, len(compressed), len(text))
+	}
+}
+
+func TestDecompressTooLong(t *testing.T) {
+	compressed := Compress(strings.Repeat("a", MaxDecodedLen+1))
+	if _, err := Decompress(compressed); err != ErrOutputTooLong {
+		t.Errorf("expected ErrOutputTooLong, got %v", err)
+	}
+}